@@ -7,29 +7,102 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/flike/golog"
+	"gopkg.in/bsm/ratelimit.v1"
 
-	redis "gopkg.in/redis.v3"
 	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/backoff"
 	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/core/metrics"
 	"github.com/flike/kingtask/core/timer"
+	"github.com/flike/kingtask/core/trace"
+	"github.com/flike/kingtask/store"
 	"github.com/flike/kingtask/task"
 )
 
+//定期从存储中删除到期的任务状态，每次最多删除statusPruneBatch个
+const statusPruneInterval = time.Minute
+const statusPruneBatch = 1000
+
 type Broker struct {
-	cfg         *config.BrokerConfig
-	addr        string
-	redisAddr   string
-	redisDB     int
-	running     bool
-	listener    net.Listener
-	redisClient *redis.Client
-	timer       *timer.Timer
+	//cfg、提交速率限制和回调的http client可以通过Reload替换，由cfgLock保护
+	cfgLock  sync.RWMutex
+	cfg      *config.BrokerConfig
+	addr     string
+	listener net.Listener
+	store    store.Store
+	timer    *timer.Timer
+	//投递任务结束回调
+	httpClient *http.Client
+	//等待任务结果的连接
+	waiters *resultWaiters
+
+	binLimits   map[string]*admissionLimit
+	queueLimits map[string]*admissionLimit
+
+	//Prometheus指标，没有配置metrics_addr时为空
+	metricsListener net.Listener
+	//记录入队和等待定时器的span
+	tracer *trace.Tracer
+	//web控制台，没有配置dashboard_addr时为空
+	dashboardListener net.Listener
+
+	//处理中的请求数和客户端连接，退出时等待请求完成后关闭连接
+	inflight int32
+	connLock sync.Mutex
+	conns    map[net.Conn]struct{}
+	//退出时定时器停止后，需要等待的任务直接写入存储
+	timerLock    sync.Mutex
+	timerStopped bool
+	//Drain或Close时关闭，后台循环和Accept循环随之退出
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+//提交任务的速率限制，只在本broker内生效
+type admissionLimit struct {
+	limiter  *ratelimit.RateLimiter
+	interval time.Duration //补充一个名额的时间
+	rate     string
+}
+
+//重新加载配置时，速率没有变化的限制沿用old中的令牌桶
+func newAdmissionLimits(rates map[string]string,
+	old map[string]*admissionLimit) (map[string]*admissionLimit, error) {
+	limits := make(map[string]*admissionLimit, len(rates))
+	for name, rate := range rates {
+		if l, ok := old[name]; ok && l.rate == rate {
+			limits[name] = l
+			continue
+		}
+		limit, period, err := config.ParseRateLimit(rate)
+		if err != nil {
+			return nil, err
+		}
+		limits[name] = &admissionLimit{
+			limiter:  ratelimit.New(limit, period),
+			interval: period / time.Duration(limit),
+			rate:     rate,
+		}
+	}
+	return limits, nil
+}
+
+func checkAdmissionMode(mode string) error {
+	switch mode {
+	case "", config.AdmissionReject, config.AdmissionDelay:
+		return nil
+	default:
+		return fmt.Errorf("invalid admission_mode %q", mode)
+	}
 }
 
 func NewBroker(cfg *config.BrokerConfig) (*Broker, error) {
@@ -39,52 +112,84 @@ func NewBroker(cfg *config.BrokerConfig) (*Broker, error) {
 	broker.cfg = cfg
 	broker.addr = cfg.Addr
 
-	vec := strings.SplitN(cfg.RedisAddr, "/", 2)
-	if len(vec) == 2 {
-		broker.redisAddr = vec[0]
-		broker.redisDB, err = strconv.Atoi(vec[1])
-		if err != nil {
-			return nil, err
+	if err = checkAdmissionMode(cfg.AdmissionMode); err != nil {
+		return nil, err
+	}
+	broker.binLimits, err = newAdmissionLimits(cfg.AdmissionBinLimit, nil)
+	if err != nil {
+		return nil, err
+	}
+	broker.queueLimits, err = newAdmissionLimits(cfg.AdmissionQueueLimit, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	exporter, err := trace.NewExporter(cfg.TraceExporter, cfg.TraceEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	broker.store, err = store.NewStore(&cfg.StoreConfig)
+	if err != nil {
+		golog.Error("broker", "NewBroker", "open store fail", 0, "err", err.Error())
+		if exporter != nil {
+			exporter.Close()
 		}
-	} else {
-		broker.redisAddr = vec[0]
-		broker.redisDB = config.DefaultRedisDB
+		return nil, err
 	}
+	broker.tracer = trace.NewTracer("kingtask-broker", exporter)
 
 	broker.listener, err = net.Listen("tcp", broker.addr)
 	if err != nil {
+		broker.store.Close()
+		broker.tracer.Close()
 		return nil, err
 	}
 
+	broker.httpClient = newCallbackClient(cfg)
+	broker.waiters = newResultWaiters()
+	broker.conns = make(map[net.Conn]struct{})
+	broker.quit = make(chan struct{})
 	broker.timer = timer.New(time.Millisecond * 10)
 	go broker.timer.Start()
 
-	broker.redisClient = redis.NewClient(
-		&redis.Options{
-			Addr:     broker.redisAddr,
-			Password: "", // no password set
-			DB:       int64(broker.redisDB),
-		},
-	)
-	_, err = broker.redisClient.Ping().Result()
-	if err != nil {
-		golog.Error("broker", "NewBroker", "ping redis fail", 0, "err", err.Error())
-		return nil, err
+	broker.registerMetrics()
+	if len(cfg.MetricsAddr) != 0 {
+		broker.metricsListener, err = metrics.Listen(cfg.MetricsAddr, metrics.Default)
+		if err != nil {
+			broker.Close()
+			return nil, err
+		}
+	}
+	if len(cfg.DashboardAddr) != 0 {
+		broker.dashboardListener, err = broker.listenDashboard(cfg.DashboardAddr)
+		if err != nil {
+			broker.Close()
+			return nil, err
+		}
 	}
 
 	return broker, nil
 }
 
 func (b *Broker) Run() error {
-	b.running = true
-
 	go b.HandleFailTask()
-	for b.running {
+	go b.HandleExpiredTask()
+	go b.HandleWorkflowTask()
+	go b.HandleLostWorkflowTask()
+	go b.HandleCallbackTask()
+	go b.HandleResultNotify()
+	for !b.stopping() {
 		conn, err := b.listener.Accept()
 		if err != nil {
+			//退出时关闭listener，Accept返回错误
+			if b.stopping() {
+				break
+			}
 			golog.Error("server", "Run", err.Error(), 0)
 			continue
 		}
+		acceptedConns.Inc()
 		//处理客户端请求
 		go b.handleConn(conn)
 	}
@@ -93,12 +198,19 @@ func (b *Broker) Run() error {
 }
 
 func (b *Broker) Close() {
-	b.running = false
+	b.stop()
 	if b.listener != nil {
 		b.listener.Close()
 	}
-	b.redisClient.Close()
+	if b.metricsListener != nil {
+		b.metricsListener.Close()
+	}
+	if b.dashboardListener != nil {
+		b.dashboardListener.Close()
+	}
+	b.store.Close()
 	b.timer.Stop()
+	b.tracer.Close()
 }
 
 func (b *Broker) WriteError(err error, c net.Conn) error {
@@ -120,10 +232,11 @@ func (b *Broker) WriteError(err error, c net.Conn) error {
 	return nil
 }
 
-func (b *Broker) WriteOK(c net.Conn) error {
+func (b *Broker) WriteOK(uuid string, c net.Conn) error {
 	var result task.StatusResult
 
 	result.Status = 0
+	result.Uuid = uuid
 	ret, err := json.Marshal(result)
 	if err != nil {
 		return err
@@ -160,6 +273,10 @@ func (b *Broker) WriteResult(status int, isSuccess string, r string, c net.Conn)
 }
 
 func (b *Broker) handleConn(c net.Conn) error {
+	openConns.Add(1)
+	defer openConns.Add(-1)
+	b.trackConn(c, true)
+	defer b.trackConn(c, false)
 	defer func() {
 		r := recover()
 		if err, ok := r.(error); ok {
@@ -174,7 +291,6 @@ func (b *Broker) handleConn(c net.Conn) error {
 		c.Close()
 	}()
 
-	var CloseConn bool
 	reader := bufio.NewReaderSize(c, 1024)
 	for {
 		msgType := []byte{0}
@@ -182,221 +298,356 @@ func (b *Broker) handleConn(c net.Conn) error {
 			return errors.ErrBadConn
 		}
 
-		switch msgType[0] {
-		case config.TypeRequestTask:
-			b.HandleRequest(reader, c)
-		case config.TypeGetTaskResult:
-			b.HandleTaskResult(reader, c)
-		case config.TypeCloseConn:
-			CloseConn = true
-		default:
-			golog.Error("Broker", "handleConn", "msgType error", 0, "msg_type", msgType[0])
-			CloseConn = true
-		}
-		if CloseConn {
+		if b.dispatch(msgType[0], reader, c) {
 			break
 		}
 	}
 	return nil
 }
 
+//处理一个请求，返回是否需要关闭连接
+func (b *Broker) dispatch(msgType byte, rb *bufio.Reader, c net.Conn) bool {
+	atomic.AddInt32(&b.inflight, 1)
+	defer atomic.AddInt32(&b.inflight, -1)
+
+	switch msgType {
+	case config.TypeRequestTask:
+		b.HandleRequest(rb, c)
+	case config.TypeGetTaskResult:
+		b.HandleTaskResult(rb, c)
+	case config.TypeSubmitWorkflow:
+		b.HandleSubmitWorkflow(rb, c)
+	case config.TypeGetWorkflow:
+		b.HandleGetWorkflow(rb, c)
+	case config.TypeCancelWorkflow:
+		b.HandleCancelWorkflow(rb, c)
+	case config.TypeGetCallback:
+		b.HandleGetCallback(rb, c)
+	case config.TypeWaitResult:
+		b.HandleWaitResult(rb, c)
+	case config.TypeGetProgress:
+		b.HandleGetProgress(rb, c)
+	case config.TypeGetLogs:
+		b.HandleGetLogs(rb, c)
+	case config.TypeGetStatus:
+		b.HandleGetStatus(rb, c)
+	case config.TypeListTasks:
+		b.HandleListTasks(rb, c)
+	case config.TypeCancelTask:
+		b.HandleCancelTask(rb, c)
+	case config.TypeRequeueTask:
+		b.HandleRequeueTask(rb, c)
+	case config.TypeListWorkers:
+		b.HandleListWorkers(rb, c)
+	case config.TypeQueueStats:
+		b.HandleQueueStats(rb, c)
+	case config.TypeCloseConn:
+		return true
+	default:
+		golog.Error("Broker", "handleConn", "msgType error", 0, "msg_type", msgType)
+		return true
+	}
+	return false
+}
+
 func (b *Broker) HandleTaskResult(rb *bufio.Reader, c net.Conn) error {
 	args := struct {
-		Key string `json:"key"`
+		Key       string `json:"key"`
+		FinalOnly bool   `json:"final_only,omitempty"`
 	}{}
-	buf := make([]byte, 128)
-	readLen, err := rb.Read(buf)
-	if err != nil {
-		b.WriteError(err, c)
-		return err
-	}
-
-	err = json.Unmarshal(buf[:readLen], &args)
+	err := json.NewDecoder(rb).Decode(&args)
 	if err != nil {
 		b.WriteError(err, c)
 		return err
 	}
 
-	result, err := b.redisClient.HMGet(args.Key,
-		"is_success",
-		"result",
-	).Result()
-	if err != nil {
-		golog.Error("Broker", "HandleFailTask", err.Error(), 0, "key", args.Key)
-		b.WriteError(err, c)
-		return err
+	uuid := strings.TrimPrefix(args.Key, "r_")
+	result, err := b.store.GetResult(uuid)
+	//还会重试的失败结果不是最终结果
+	if err == nil && args.FinalOnly && !result.IsFinal() {
+		err = errors.ErrKeyNotExist
 	}
-
 	//key不存在
-	if result[0] == nil {
+	if err == errors.ErrKeyNotExist {
 		err = b.WriteResult(config.ResultNotExist, "0", "", c)
 		return err
 	}
-	isSuccess := result[0].(string)
-	ret := result[1].(string)
-	return b.WriteResult(config.ResultIsExist, isSuccess, ret, c)
-}
-
-func (b *Broker) HandleRequest(rb *bufio.Reader, c net.Conn) error {
-	buf := make([]byte, 1024)
-	request := new(task.TaskRequest)
-	readLen, err := rb.Read(buf)
 	if err != nil {
+		golog.Error("Broker", "HandleTaskResult", err.Error(), 0, "uuid", uuid)
 		b.WriteError(err, c)
 		return err
 	}
+	isSuccess := strconv.FormatInt(result.IsSuccess, 10)
+	return b.WriteResult(config.ResultIsExist, isSuccess, result.Result, c)
+}
 
-	err = json.Unmarshal(buf[:readLen], request)
+func (b *Broker) HandleRequest(rb *bufio.Reader, c net.Conn) (err error) {
+	request := new(task.TaskRequest)
+	//请求可能大于一次读取的长度，按json边界读取
+	err = json.NewDecoder(rb).Decode(request)
 	if err != nil {
 		b.WriteError(err, c)
 		return err
 	}
 
+	//客户端传入的traceparent作为入队span的父span，保存的traceparent改为入队span
+	span := b.tracer.Start("kingtask.enqueue", trace.KindProducer, request.Traceparent)
+	span.SetAttr("uuid", request.Uuid)
+	span.SetAttr("bin_name", request.BinName)
+	span.SetAttr("queue", request.Queue)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	request.Traceparent = span.Traceparent()
+
 	now := time.Now().Unix()
 	if request.StartTime == 0 {
 		request.StartTime = now
 	}
 
+	//相同幂等键的任务已经提交过，直接返回已有任务的uuid，不占用提交速率
+	if len(request.IdempotencyKey) != 0 {
+		uuid, err := b.store.GetIdempotencyKey(request.IdempotencyKey)
+		if err == nil {
+			return b.writeDuplicate(request, uuid, c)
+		}
+		if err != errors.ErrKeyNotExist {
+			b.WriteError(err, c)
+			return err
+		}
+	}
+
+	//超过提交速率限制，reject模式直接拒绝，delay模式延迟后再次检查
+	if interval, limited := b.admit(request); limited {
+		if b.config().AdmissionMode != config.AdmissionDelay {
+			golog.Warn("Broker", "HandleRequest", "rate limited", 0,
+				request.LogFields("queue", request.Queue)...)
+			b.WriteError(errors.ErrRateLimited, c)
+			return errors.ErrRateLimited
+		}
+		if afterTime := time.Second * time.Duration(request.StartTime-now); interval < afterTime {
+			interval = afterTime
+		}
+		if len(request.IdempotencyKey) != 0 {
+			return b.addRequestOnce(request, time.Now().Add(interval), c)
+		}
+		b.setState(request, task.StateScheduled)
+		b.schedule(interval, b.addAdmittedRequest, request, "admission")
+		submittedTasks.Inc(request.BinName)
+		return b.WriteOK(request.Uuid, c)
+	}
+
+	if len(request.IdempotencyKey) != 0 {
+		return b.addRequestOnce(request, time.Unix(request.StartTime, 0), c)
+	}
 	if request.StartTime <= now {
-		err = b.AddRequestToRedis(request)
+		err = b.AddRequestToStore(request)
 		if err != nil {
 			b.WriteError(err, c)
 			return err
 		}
 	} else {
 		afterTime := time.Second * time.Duration(request.StartTime-now)
-		b.timer.NewTimer(afterTime, b.AddRequestToRedis, request)
+		b.setState(request, task.StateScheduled)
+		b.schedule(afterTime, b.addRequestWithRetry, request, "start_time")
+	}
+	submittedTasks.Inc(request.BinName)
+
+	return b.WriteOK(request.Uuid, c)
+}
+
+//带幂等键的任务与幂等键在同一次存储操作中写入，broker崩溃时不会留下没有任务的幂等键。
+//开始时间未到或者被延迟入队的任务保存在存储中，到期后直接放入待执行队列，不再检查提交速率
+func (b *Broker) addRequestOnce(r *task.TaskRequest, at time.Time, c net.Conn) error {
+	window := b.config().IdempotencyWindow
+	if window == 0 {
+		window = config.DefaultIdempotencyWindow
 	}
+	uuid, err := b.store.AddRequestOnce(r, time.Second*time.Duration(window), at)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	if uuid != r.Uuid {
+		return b.writeDuplicate(r, uuid, c)
+	}
+	submittedTasks.Inc(r.BinName)
+	return b.WriteOK(r.Uuid, c)
+}
 
-	return b.WriteOK(c)
+func (b *Broker) writeDuplicate(r *task.TaskRequest, uuid string, c net.Conn) error {
+	golog.Info("Broker", "HandleRequest", "duplicate request", 0,
+		"uuid", uuid,
+		"idempotency_key", r.IdempotencyKey)
+	return b.WriteOK(uuid, c)
 }
 
 //处理失败的任务
 func (b *Broker) HandleFailTask() error {
-	var uuid string
-	var err error
-	for b.running {
-		uuid, err = b.redisClient.SPop(config.FailResultUuidSet).Result()
+	//redis主从切换期间请求会失败，退避重试直到连上新的master
+	bf := backoff.New(time.Millisecond*100, time.Second*5)
+	for !b.stopping() {
+		result, err := b.store.PopFailResult()
 		//没有结果，直接返回
-		if err == redis.Nil {
-			time.Sleep(time.Second)
+		if err == errors.ErrKeyNotExist {
+			bf.Reset()
+			b.sleep(time.Second)
 			continue
 		}
 		if err != nil {
-			golog.Error("Broker", "HandleResult", "spop error", 0, "error", err.Error())
+			golog.Error("Broker", "HandleFailTask", "pop fail result error", 0, "error", err.Error())
+			b.sleep(bf.Next())
 			continue
 		}
+		bf.Reset()
 
-		key := fmt.Sprintf("r_%s", uuid)
-		timeInterval, err := b.redisClient.HGet(key, "time_interval").Result()
-		if err != nil {
-			golog.Error("Broker", "HandleFailTask", err.Error(), 0, "key", key)
-			continue
-		}
 		//没有超时重试机制
-		if len(timeInterval) == 0 {
+		if len(result.TimeInterval) == 0 {
 			continue
 		}
-		//获取结果中所有值,改为逐个获取
-		results, err := b.redisClient.HMGet(key,
-			"uuid",
-			"bin_name",
-			"args",
-			"start_time",
-			"time_interval",
-			"index",
-		).Result()
-		if err != nil {
-			golog.Error("Broker", "HandleFailTask", err.Error(), 0, "key", key)
+		//工作流已经结束，不再重试
+		if len(result.Workflow) != 0 && b.stopWorkflowRetry(result) {
 			continue
 		}
-		//key已经过期
-		if results[0] == nil {
-			golog.Error("Broker", "HandleFailTask", "result expired", 0, "key", key)
+		//下一次重试已在PopFailResult中写入存储，到期后由HandleExpiredTask放回待执行队列
+		if !result.HasRetry() {
+			golog.Error("Broker", "HandleFailTask", "retry max time", 0, result.LogFields()...)
 			continue
 		}
-		//删除结果
-		_, err = b.redisClient.Del(key).Result()
+		retriedTasks.Inc(result.BinName)
+	}
+
+	return nil
+}
+
+//worker崩溃后其正在执行的任务租约会过期，定期放回待执行队列
+func (b *Broker) HandleExpiredTask() error {
+	lastPrune := time.Now()
+	for !b.stopping() {
+		count, err := b.store.RequeueExpired()
 		if err != nil {
-			golog.Error("Broker", "HandleFailTask", "delete result failed", 0, "key", key)
+			golog.Error("Broker", "HandleExpiredTask", "requeue error", 0, "error", err.Error())
 		}
-		err = b.resetTaskRequest(results)
-		if err != nil {
-			golog.Error("Broker", "HandleFailTask", err.Error(), 0, "key", key)
+		if count != 0 {
+			golog.Warn("Broker", "HandleExpiredTask", "requeue expired task", 0, "count", count)
+		}
+		if statusPruneInterval <= time.Since(lastPrune) {
+			lastPrune = time.Now()
+			b.pruneStatus()
 		}
+		b.sleep(time.Second)
 	}
 
 	return nil
 }
 
-func (b *Broker) resetTaskRequest(args []interface{}) error {
-	var err error
-	if len(args) == 0 || len(args) != config.TaskRequestItemCount {
-		return errors.ErrInvalidArgument
+//删除到期的任务状态，避免查询索引无限增长
+func (b *Broker) pruneStatus() {
+	for !b.stopping() {
+		count, err := b.store.PruneStatus(statusPruneBatch)
+		if err != nil {
+			golog.Error("Broker", "pruneStatus", "prune status error", 0, "error", err.Error())
+			return
+		}
+		if count < statusPruneBatch {
+			return
+		}
 	}
-	request := new(task.TaskRequest)
-	request.Uuid = args[0].(string)
-	request.BinName = args[1].(string)
-	request.Args = args[2].(string)
-	request.StartTime, err = strconv.ParseInt(args[3].(string), 10, 64)
-	if err != nil {
-		return err
+}
+
+//检查任务的可执行文件和队列是否超过提交速率，超过时返回下次可以提交的间隔
+func (b *Broker) admit(r *task.TaskRequest) (time.Duration, bool) {
+	queue := r.Queue
+	if len(queue) == 0 {
+		queue = config.DefaultQueue
 	}
-	request.TimeInterval = args[4].(string)
-	request.Index, err = strconv.Atoi(args[5].(string))
-	if err != nil {
-		return err
+	b.cfgLock.RLock()
+	bin, hasBin := b.binLimits[r.BinName]
+	q, hasQueue := b.queueLimits[queue]
+	b.cfgLock.RUnlock()
+	if hasBin && bin.limiter.Limit() {
+		return bin.interval, true
 	}
-	vec := strings.Split(request.TimeInterval, " ")
-	request.Index++
-	if request.Index < len(vec) {
-		timeLater, err := strconv.Atoi(vec[request.Index])
-		if err != nil {
-			return err
+	if hasQueue && q.limiter.Limit() {
+		//队列被限制时归还已占用的可执行文件名额
+		if hasBin {
+			bin.limiter.Undo()
 		}
-		afterTime := time.Second * time.Duration(timeLater)
-		b.timer.NewTimer(afterTime, b.AddRequestToRedis, request)
-	} else {
-		golog.Error("Broker", "HandleFailTask", "retry max time", 0,
-			"key", fmt.Sprintf("t_%s", request.Uuid))
-		return errors.ErrTryMaxTimes
+		return q.interval, true
 	}
-	return nil
+	return 0, false
 }
 
-func (b *Broker) AddRequestToRedis(tr interface{}) error {
+//delay模式下被限速的任务，到时后重新检查速率限制
+func (b *Broker) addAdmittedRequest(tr interface{}) error {
 	r, ok := tr.(*task.TaskRequest)
 	if !ok {
 		return errors.ErrInvalidArgument
 	}
-	key := fmt.Sprintf("t_%s", r.Uuid)
-	setCmd := b.redisClient.HMSet(key,
-		"uuid", r.Uuid,
-		"bin_name", r.BinName,
-		"args", r.Args,
-		"start_time", strconv.FormatInt(r.StartTime, 10),
-		"time_interval", r.TimeInterval,
-		"index", strconv.Itoa(r.Index),
-	)
-	err := setCmd.Err()
-	if err != nil {
-		golog.Error("Broker", "AddRequestToRedis", "HMSET error", 0,
-			"set", config.RequestUuidSet,
-			"uuid", r.Uuid,
-			"err", err.Error(),
-		)
-		return err
+	if interval, limited := b.admit(r); limited {
+		b.schedule(interval, b.addAdmittedRequest, r, "admission")
+		return nil
+	}
+	return b.addRequestWithRetry(r)
+}
+
+//任务在定时器中等待时记录一个span，任务的traceparent改为该span，worker取出任务时作为父span
+func (b *Broker) schedule(d time.Duration, fn func(interface{}) error, r *task.TaskRequest, reason string) {
+	span := b.tracer.Start("kingtask.timer_wait", trace.KindInternal, r.Traceparent)
+	span.SetAttr("uuid", r.Uuid)
+	span.SetAttr("reason", reason)
+	r.Traceparent = span.Traceparent()
+	b.timerLock.Lock()
+	defer b.timerLock.Unlock()
+	if b.timerStopped {
+		span.Finish()
+		b.saveScheduled(r, d)
+		return
+	}
+	b.timer.NewTimer(d, func(arg interface{}) error {
+		atomic.AddInt32(&b.inflight, 1)
+		defer atomic.AddInt32(&b.inflight, -1)
+		span.Finish()
+		return fn(arg)
+	}, r)
+}
+
+//定时器触发的任务没有客户端等待结果，存储不可用时退避重试，避免任务丢失
+func (b *Broker) addRequestWithRetry(tr interface{}) error {
+	r, ok := tr.(*task.TaskRequest)
+	if !ok {
+		return errors.ErrInvalidArgument
+	}
+	//等待期间已被取消的任务不再入队
+	if st, err := b.store.GetStatus(r.Uuid); err == nil && st.State == task.StateCancelled {
+		golog.Info("Broker", "addRequestWithRetry", "task cancelled", 0, r.LogFields()...)
+		return nil
+	}
+	bf := backoff.New(time.Millisecond*100, time.Second*5)
+	for {
+		err := b.AddRequestToStore(tr)
+		if err == nil || err == errors.ErrInvalidArgument || b.stopping() {
+			return err
+		}
+		golog.Error("Broker", "addRequestWithRetry", "add request error, retry", 0,
+			"err", err.Error())
+		b.sleep(bf.Next())
 	}
-	saddCmd := b.redisClient.SAdd(config.RequestUuidSet, r.Uuid)
-	err = saddCmd.Err()
+}
+
+//记录由broker决定的状态变更，失败时只记录日志，不影响任务的执行
+func (b *Broker) setState(r *task.TaskRequest, state string) {
+	err := b.store.SetState(r, state)
 	if err != nil {
-		golog.Error("Broker", "AddRequestToRedis", "SADD error", 0,
-			"set", config.RequestUuidSet,
-			"uuid", r.Uuid,
-			"err", err.Error(),
-		)
-		return err
+		golog.Error("Broker", "setState", err.Error(), 0, r.LogFields("state", state)...)
 	}
+}
 
-	return nil
+func (b *Broker) AddRequestToStore(tr interface{}) error {
+	r, ok := tr.(*task.TaskRequest)
+	if !ok {
+		return errors.ErrInvalidArgument
+	}
+	return b.store.AddRequest(r)
 }
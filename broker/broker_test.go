@@ -0,0 +1,58 @@
+package broker
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/task"
+)
+
+func sendMessage(t *testing.T, c net.Conn, msgType byte, args interface{}, reply interface{}) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write(append([]byte{msgType}, data...)); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.NewDecoder(c).Decode(reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//超过一次读取长度的请求完整读取，同一连接上的下一个请求不受影响
+func TestHandleLargeRequest(t *testing.T) {
+	b, cleanup := newTestBroker(t, &config.BrokerConfig{})
+	defer cleanup()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+	go b.handleConn(server)
+
+	arg := strings.Repeat("x", 4096)
+	r, err := task.NewTaskRequest("example", []string{arg}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := new(task.StatusResult)
+	sendMessage(t, client, config.TypeRequestTask, r, reply)
+	if reply.Status != 0 || reply.Uuid != r.Uuid {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	got, err := b.store.PopRequest([]string{config.DefaultQueue}, time.Minute)
+	if err != nil || got.Args != arg {
+		t.Fatalf("stored request is truncated: %v", err)
+	}
+
+	result := new(task.Reply)
+	sendMessage(t, client, config.TypeGetTaskResult,
+		map[string]interface{}{"key": "r_" + r.Uuid, "final_only": true}, result)
+	if result.IsResultExist != config.ResultNotExist {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
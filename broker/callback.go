@@ -0,0 +1,234 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flike/golog"
+	"github.com/pborman/uuid"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/backoff"
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+//每轮并发投递的回调数
+const callbackBatch = 32
+
+//回调失败后重试的退避时间，测试中调小
+var callbackBackoffMin, callbackBackoffMax = time.Second, time.Second * 30
+
+//投递回调的租约在一次请求和一次退避之外额外保留的时间
+const callbackLeaseGrace = time.Second * 10
+
+func newCallbackClient(cfg *config.BrokerConfig) *http.Client {
+	timeout := cfg.CallbackTimeout
+	if timeout == 0 {
+		timeout = config.DefaultCallbackTimeout
+	}
+	return &http.Client{Timeout: time.Millisecond * time.Duration(timeout)}
+}
+
+func (b *Broker) HandleGetCallback(rb *bufio.Reader, c net.Conn) error {
+	args := struct {
+		Uuid string `json:"uuid"`
+	}{}
+	err := json.NewDecoder(rb).Decode(&args)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	st, err := b.store.GetCallback(args.Uuid)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	ret, err := json.Marshal(&task.CallbackReply{Callback: st})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(ret)
+	return err
+}
+
+//把已结束任务的结果POST到其回调地址
+func (b *Broker) HandleCallbackTask() error {
+	bf := backoff.New(time.Millisecond*100, time.Second*5)
+	for !b.stopping() {
+		err := b.deliverCallbacks()
+		if err == errors.ErrKeyNotExist {
+			bf.Reset()
+			b.sleep(time.Second)
+			continue
+		}
+		if err != nil {
+			golog.Error("Broker", "HandleCallbackTask", "get callback result error", 0,
+				"error", err.Error())
+			b.sleep(bf.Next())
+			continue
+		}
+		bf.Reset()
+	}
+	return nil
+}
+
+//并发投递一批回调，投递成功或者超过最大尝试次数后从通知队列中删除。
+//每个回调投递前先获取租约，多个broker取到同一回调时只有一个投递
+func (b *Broker) deliverCallbacks() error {
+	results, err := b.store.NextNotify(config.NotifyCallback, callbackBatch)
+	if err != nil {
+		return err
+	}
+	holder := uuid.New()
+	lease := b.callbackLease()
+	claimed := 0
+	var wg sync.WaitGroup
+	for _, r := range results {
+		ok, err := b.store.AcquireSlot(callbackSlot(r.Uuid), holder, 1, lease)
+		if err != nil {
+			golog.Error("Broker", "deliverCallbacks", "claim callback error", 0,
+				r.LogFields("error", err.Error())...)
+			continue
+		}
+		//其它broker正在投递
+		if !ok {
+			continue
+		}
+		claimed++
+		wg.Add(1)
+		go func(r *task.TaskResult) {
+			defer wg.Done()
+			defer b.store.ReleaseSlot(callbackSlot(r.Uuid), holder)
+			if !b.deliverCallback(r, holder, lease) {
+				return
+			}
+			err := b.store.AckNotify(config.NotifyCallback, r.Uuid)
+			if err != nil {
+				golog.Error("Broker", "deliverCallbacks", "ack callback error", 0,
+					r.LogFields("error", err.Error())...)
+			}
+		}(r)
+	}
+	wg.Wait()
+	//取到的回调都在由其它broker投递，等待后再查看
+	if claimed == 0 {
+		return errors.ErrKeyNotExist
+	}
+	return nil
+}
+
+func callbackSlot(uuid string) string {
+	return "callback:" + uuid
+}
+
+//租约覆盖一次请求的超时和一次退避，每次尝试前续约
+func (b *Broker) callbackLease() time.Duration {
+	timeout := b.config().CallbackTimeout
+	if timeout == 0 {
+		timeout = config.DefaultCallbackTimeout
+	}
+	return time.Millisecond*time.Duration(timeout) + callbackBackoffMax + callbackLeaseGrace
+}
+
+//退避重试投递回调并记录每次尝试的状态，返回投递是否已经结束
+func (b *Broker) deliverCallback(r *task.TaskResult, holder string, lease time.Duration) bool {
+	attempts := b.config().CallbackAttempts
+	if attempts == 0 {
+		attempts = config.DefaultCallbackAttempts
+	}
+	st := &task.CallbackStatus{Uuid: r.Uuid, Url: r.CallbackUrl}
+	//broker在投递后、删除通知前崩溃时不重复投递
+	if old, err := b.store.GetCallback(r.Uuid); err == nil {
+		if old.Delivered || attempts <= old.Attempts {
+			return true
+		}
+		st.Attempts = old.Attempts
+	}
+
+	timestamp := time.Now().Unix()
+	body, err := json.Marshal(task.NewCallbackPayload(r, timestamp))
+	if err != nil {
+		return true
+	}
+	bf := backoff.New(callbackBackoffMin, callbackBackoffMax)
+	for st.Attempts < attempts {
+		if b.stopping() {
+			return false
+		}
+		//租约已经过期并被其它broker获取时由其接着投递
+		ok, err := b.store.AcquireSlot(callbackSlot(r.Uuid), holder, 1, lease)
+		if err != nil || !ok {
+			return false
+		}
+		st.Attempts++
+		st.StatusCode, err = b.postCallback(r.CallbackUrl, timestamp, body)
+		st.Delivered = err == nil
+		st.Error = ""
+		if err != nil {
+			st.Error = err.Error()
+		}
+		st.UpdateTime = time.Now().Unix()
+		b.saveCallback(st)
+		if st.Delivered {
+			return true
+		}
+		golog.Warn("Broker", "deliverCallback", "callback failed", 0,
+			r.LogFields(
+				"url", r.CallbackUrl,
+				"attempts", st.Attempts,
+				"error", st.Error)...)
+		if st.Attempts < attempts {
+			b.sleep(bf.Next())
+		}
+	}
+	golog.Error("Broker", "deliverCallback", "callback give up", 0,
+		r.LogFields("url", r.CallbackUrl)...)
+	return true
+}
+
+func (b *Broker) postCallback(url string, timestamp int64, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(task.CallbackTimestampHeader, strconv.FormatInt(timestamp, 10))
+	b.cfgLock.RLock()
+	secret, client := b.cfg.CallbackSecret, b.httpClient
+	b.cfgLock.RUnlock()
+	if len(secret) != 0 {
+		req.Header.Set(task.CallbackSignatureHeader,
+			task.SignCallback(secret, timestamp, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (b *Broker) saveCallback(st *task.CallbackStatus) {
+	keep := b.config().CallbackKeepTime
+	if keep == 0 {
+		keep = config.DefaultCallbackKeepTime
+	}
+	err := b.store.SetCallback(st, time.Second*time.Duration(keep))
+	if err != nil {
+		golog.Error("Broker", "saveCallback", err.Error(), 0, "uuid", st.Uuid)
+	}
+}
@@ -0,0 +1,187 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/core/timer"
+	"github.com/flike/kingtask/store"
+	"github.com/flike/kingtask/task"
+)
+
+func newTestBroker(t *testing.T, cfg *config.BrokerConfig) (*Broker, func()) {
+	dir, err := ioutil.TempDir("", "kingtask_broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := store.NewFileStore(dir, 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	b := &Broker{
+		cfg:        cfg,
+		quit:       make(chan struct{}),
+		store:      s,
+		httpClient: newCallbackClient(cfg),
+		waiters:    newResultWaiters(),
+		timer:      timer.New(time.Millisecond * 10),
+		conns:      make(map[net.Conn]struct{}),
+	}
+	return b, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+//第一次投递返回500，退避重试后校验签名和结果
+func TestDeliverCallback(t *testing.T) {
+	callbackBackoffMin, callbackBackoffMax = time.Millisecond, time.Millisecond*10
+	const secret = "s3cret"
+
+	var requests int32
+	var payload task.CallbackPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if !task.VerifyCallback(secret, r.Header.Get(task.CallbackTimestampHeader),
+			body, r.Header.Get(task.CallbackSignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.Unmarshal(body, &payload)
+	}))
+	defer server.Close()
+
+	b, cleanup := newTestBroker(t, &config.BrokerConfig{CallbackSecret: secret, CallbackAttempts: 3})
+	defer cleanup()
+
+	r, err := task.NewTaskRequest("example", []string{"1", "2"}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.CallbackUrl = server.URL
+	err = b.store.SetResult(&task.TaskResult{TaskRequest: *r, IsSuccess: 1, Result: "3"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.deliverCallbacks(); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Uuid != r.Uuid || payload.Result != "3" || payload.IsSuccess != 1 {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+	st, err := b.store.GetCallback(r.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Delivered || st.Attempts != 2 || st.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected callback status %+v", st)
+	}
+	//投递成功后不再重复投递
+	if err = b.deliverCallbacks(); err != errors.ErrKeyNotExist {
+		t.Fatalf("delivered callback returned again, err %v", err)
+	}
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Fatalf("expect 2 requests, got %d", requests)
+	}
+}
+
+func TestDeliverCallbackGiveUp(t *testing.T) {
+	callbackBackoffMin, callbackBackoffMax = time.Millisecond, time.Millisecond*10
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	b, cleanup := newTestBroker(t, &config.BrokerConfig{CallbackAttempts: 2})
+	defer cleanup()
+
+	r, err := task.NewTaskRequest("example", nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.CallbackUrl = server.URL
+	err = b.store.SetResult(&task.TaskResult{TaskRequest: *r, IsSuccess: 0, Result: "boom"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.deliverCallbacks(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := b.store.GetCallback(r.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Delivered || st.Attempts != 2 || st.StatusCode != http.StatusBadGateway || len(st.Error) == 0 {
+		t.Fatalf("unexpected callback status %+v", st)
+	}
+	if err = b.deliverCallbacks(); err != errors.ErrKeyNotExist {
+		t.Fatalf("abandoned callback returned again, err %v", err)
+	}
+}
+
+//多个broker同时取到同一回调时只投递一次
+func TestDeliverCallbackClaim(t *testing.T) {
+	callbackBackoffMin, callbackBackoffMax = time.Millisecond, time.Millisecond*10
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(time.Millisecond * 100)
+	}))
+	defer server.Close()
+
+	b, cleanup := newTestBroker(t, &config.BrokerConfig{})
+	defer cleanup()
+	other := &Broker{
+		cfg:        b.cfg,
+		quit:       make(chan struct{}),
+		store:      b.store,
+		httpClient: b.httpClient,
+	}
+
+	r, err := task.NewTaskRequest("example", nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.CallbackUrl = server.URL
+	err = b.store.SetResult(&task.TaskResult{TaskRequest: *r, IsSuccess: 1, Result: "ok"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//other在b投递期间取到同一回调
+	done := make(chan error, 1)
+	go func() { done <- b.deliverCallbacks() }()
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err = other.deliverCallbacks(); err != errors.ErrKeyNotExist {
+		t.Fatalf("claimed callback delivered by other broker, err %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err = other.deliverCallbacks(); err != errors.ErrKeyNotExist {
+		t.Fatalf("delivered callback returned again, err %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expect 1 request, got %d", n)
+	}
+}
@@ -0,0 +1,345 @@
+package broker
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flike/golog"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+//控制台中可以按状态查看的任务列表
+var dashboardStates = []string{
+	task.StateScheduled,
+	task.StateQueued,
+	task.StateRunning,
+	task.StateRetrying,
+	task.StateFailed,
+	task.StateDead,
+}
+
+type dashboardPage struct {
+	Title   string
+	Refresh bool //概览页定时刷新
+	States  []string
+	Error   string
+	Data    interface{}
+}
+
+type overviewData struct {
+	Queues  []*task.QueueStats
+	Workers []*task.WorkerInfo
+}
+
+type taskListData struct {
+	Query *task.TaskQuery
+	Tasks []*task.TaskStatus
+	//下一页的链接，没有更多任务时为空
+	Next string
+}
+
+type taskDetailData struct {
+	Status  *task.TaskStatus
+	Result  *task.TaskResult
+	Logs    []*task.LogLine
+	LogNext int64
+	LogMore bool
+}
+
+//broker内置的web控制台，数据和操作与客户端接口使用相同的实现
+func (b *Broker) dashboardHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", b.dashboardOverview)
+	mux.HandleFunc("/tasks", b.dashboardTasks)
+	mux.HandleFunc("/task", b.dashboardTask)
+	mux.HandleFunc("/task/cancel", b.dashboardAction(b.cancelTask))
+	mux.HandleFunc("/task/requeue", b.dashboardAction(b.requeueTask))
+	return mux
+}
+
+//在addr上提供控制台，返回的listener关闭后停止服务
+func (b *Broker) listenDashboard(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(l, b.dashboardHandler())
+	return l, nil
+}
+
+func (b *Broker) renderDashboard(w http.ResponseWriter, status int, page *dashboardPage, name string) {
+	page.States = dashboardStates
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := dashboardTemplates.ExecuteTemplate(w, name, page)
+	if err != nil {
+		golog.Error("Broker", "renderDashboard", err.Error(), 0, "page", name)
+	}
+}
+
+func (b *Broker) dashboardError(w http.ResponseWriter, status int, err error) {
+	b.renderDashboard(w, status, &dashboardPage{Title: "Error", Error: err.Error()}, "error")
+}
+
+func (b *Broker) dashboardOverview(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	queues, err := b.queueStats()
+	if err != nil {
+		b.dashboardError(w, http.StatusInternalServerError, err)
+		return
+	}
+	workers, err := b.store.ListWorkers()
+	if err != nil {
+		b.dashboardError(w, http.StatusInternalServerError, err)
+		return
+	}
+	b.renderDashboard(w, http.StatusOK, &dashboardPage{
+		Title:   "Overview",
+		Refresh: true,
+		Data:    &overviewData{Queues: queues, Workers: workers},
+	}, "overview")
+}
+
+func (b *Broker) dashboardTasks(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	q := &task.TaskQuery{
+		State:   v.Get("state"),
+		BinName: v.Get("bin"),
+		Queue:   v.Get("queue"),
+		Cursor:  v.Get("cursor"),
+		Limit:   config.DefaultListLimit,
+	}
+	tasks, cursor, err := b.store.ListTasks(q)
+	if err != nil {
+		b.dashboardError(w, http.StatusBadRequest, err)
+		return
+	}
+	data := &taskListData{Query: q, Tasks: tasks}
+	if len(cursor) != 0 {
+		v.Set("cursor", cursor)
+		data.Next = "/tasks?" + v.Encode()
+	}
+	title := "Tasks"
+	if len(q.State) != 0 {
+		title = "Tasks: " + q.State
+	}
+	b.renderDashboard(w, http.StatusOK, &dashboardPage{Title: title, Data: data}, "tasks")
+}
+
+func (b *Broker) dashboardTask(w http.ResponseWriter, r *http.Request) {
+	uuid := r.URL.Query().Get("uuid")
+	st, err := b.store.GetStatus(uuid)
+	if err == errors.ErrKeyNotExist {
+		b.dashboardError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		b.dashboardError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if p, err := b.store.GetProgress(uuid); err == nil {
+		st.Progress = p
+	}
+	data := &taskDetailData{Status: st}
+	if result, err := b.store.GetResult(uuid); err == nil {
+		data.Result = result
+	}
+	from, _ := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+	data.Logs, data.LogNext, err = b.store.GetLogs(uuid, from, config.DefaultLogBatch)
+	if err != nil {
+		b.dashboardError(w, http.StatusInternalServerError, err)
+		return
+	}
+	data.LogMore = len(data.Logs) == config.DefaultLogBatch
+	b.renderDashboard(w, http.StatusOK, &dashboardPage{Title: "Task " + uuid, Data: data}, "task")
+}
+
+//表单提交的任务操作，完成后回到任务详情页
+func (b *Broker) dashboardAction(fn func(uuid string) (*task.TaskStatus, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			b.dashboardError(w, http.StatusMethodNotAllowed, errors.ErrInvalidArgument)
+			return
+		}
+		if !b.allowOrigin(r.Header.Get("Origin"), r.Host) {
+			b.dashboardError(w, http.StatusForbidden, errors.ErrInvalidArgument)
+			return
+		}
+		uuid := r.PostFormValue("uuid")
+		if _, err := fn(uuid); err != nil {
+			b.dashboardError(w, http.StatusBadRequest, err)
+			return
+		}
+		http.Redirect(w, r, "/task?uuid="+url.QueryEscape(uuid), http.StatusSeeOther)
+	}
+}
+
+//只接受本站页面发起的请求，浏览器提交表单时都带有Origin。
+//反向代理改写Host时Origin为配置的dashboard_origin
+func (b *Broker) allowOrigin(origin string, host string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || len(u.Host) == 0 {
+		return false
+	}
+	if u.Host == host {
+		return true
+	}
+	allowed := b.config().DashboardOrigin
+	if len(allowed) == 0 {
+		return false
+	}
+	a, err := url.Parse(allowed)
+	return err == nil && strings.EqualFold(a.Scheme, u.Scheme) && strings.EqualFold(a.Host, u.Host)
+}
+
+func formatMilli(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).Format("2006-01-02 15:04:05")
+}
+
+func formatUnix(s int64) string {
+	if s == 0 {
+		return "-"
+	}
+	return time.Unix(s, 0).Format("2006-01-02 15:04:05")
+}
+
+var dashboardTemplates = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"milli": formatMilli,
+	"unix":  formatUnix,
+	"cancellable": func(state string) bool {
+		return state == task.StateScheduled || state == task.StateQueued || state == task.StateRetrying
+	},
+	"requeueable": func(st *task.TaskStatus) bool {
+		return (st.State == task.StateDead || st.State == task.StateFailed) && len(st.Workflow) == 0
+	},
+}).Parse(dashboardHTML))
+
+const dashboardHTML = `
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+{{if .Refresh}}<meta http-equiv="refresh" content="5">{{end}}
+<title>kingtask - {{.Title}}</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 0 24px 24px; color: #222; }
+nav { padding: 12px 0; border-bottom: 1px solid #ddd; margin-bottom: 16px; }
+nav a { margin-right: 16px; }
+table { border-collapse: collapse; margin-bottom: 24px; }
+th, td { text-align: left; padding: 4px 12px 4px 0; border-bottom: 1px solid #eee; vertical-align: top; }
+pre { background: #f6f6f6; padding: 8px; overflow-x: auto; }
+form { display: inline; }
+.error { color: #b00; }
+.stderr { color: #b00; }
+</style>
+</head>
+<body>
+<nav>
+<a href="/"><b>kingtask</b></a>
+{{range .States}}<a href="/tasks?state={{.}}">{{if eq . "dead"}}dead letters{{else}}{{.}}{{end}}</a>{{end}}
+<a href="/tasks">all tasks</a>
+</nav>
+<h2>{{.Title}}</h2>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "actions"}}
+{{if cancellable .State}}<form method="post" action="/task/cancel"><input type="hidden" name="uuid" value="{{.Uuid}}"><button>cancel</button></form>{{end}}
+{{if requeueable .}}<form method="post" action="/task/requeue"><input type="hidden" name="uuid" value="{{.Uuid}}"><button>requeue</button></form>{{end}}
+{{end}}
+
+{{define "error"}}{{template "header" .}}
+<p class="error">{{.Error}}</p>
+{{template "footer" .}}{{end}}
+
+{{define "overview"}}{{template "header" .}}
+<h3>Queues</h3>
+<table>
+<tr><th>queue</th><th>pending</th><th>workers</th></tr>
+{{range .Data.Queues}}<tr><td><a href="/tasks?queue={{.Queue}}">{{.Queue}}</a></td><td>{{.Pending}}</td><td>{{.Workers}}</td></tr>
+{{else}}<tr><td colspan="3">no queues</td></tr>
+{{end}}
+</table>
+<h3>Workers</h3>
+<table>
+<tr><th>id</th><th>queues</th><th>running</th><th>started</th><th>heartbeat</th></tr>
+{{range .Data.Workers}}<tr><td>{{.Id}}</td><td>{{range $i, $q := .Queues}}{{if $i}}, {{end}}{{$q}}{{end}}</td>
+<td>{{if .Running}}<a href="/task?uuid={{.Running}}">{{.Running}}</a>{{else}}-{{end}}</td>
+<td>{{milli .StartTime}}</td><td>{{milli .Heartbeat}}</td></tr>
+{{else}}<tr><td colspan="5">no live workers</td></tr>
+{{end}}
+</table>
+{{template "footer" .}}{{end}}
+
+{{define "tasks"}}{{template "header" .}}
+<form method="get" action="/tasks">
+<input type="hidden" name="state" value="{{.Data.Query.State}}">
+bin <input name="bin" value="{{.Data.Query.BinName}}">
+queue <input name="queue" value="{{.Data.Query.Queue}}">
+<button>filter</button>
+</form>
+<table>
+<tr><th>uuid</th><th>bin</th><th>queue</th><th>state</th><th>attempt</th><th>submitted</th><th>updated</th><th></th></tr>
+{{range .Data.Tasks}}<tr><td><a href="/task?uuid={{.Uuid}}">{{.Uuid}}</a></td><td>{{.BinName}}</td><td>{{.Queue}}</td>
+<td>{{.State}}</td><td>{{.Attempt}}</td><td>{{milli .SubmitTime}}</td><td>{{milli .UpdateTime}}</td>
+<td>{{template "actions" .}}</td></tr>
+{{else}}<tr><td colspan="8">no tasks</td></tr>
+{{end}}
+</table>
+{{if .Data.Next}}<a href="{{.Data.Next}}">next page</a>{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "task"}}{{template "header" .}}
+{{with .Data.Status}}
+<table>
+<tr><th>uuid</th><td>{{.Uuid}}</td></tr>
+<tr><th>bin</th><td>{{.BinName}}</td></tr>
+<tr><th>queue</th><td>{{.Queue}}</td></tr>
+{{if .Workflow}}<tr><th>workflow</th><td>{{.Workflow}}</td></tr>{{end}}
+<tr><th>state</th><td>{{.State}} {{template "actions" .}}</td></tr>
+<tr><th>attempt</th><td>{{.Attempt}}</td></tr>
+<tr><th>submitted</th><td>{{milli .SubmitTime}}</td></tr>
+<tr><th>updated</th><td>{{milli .UpdateTime}}</td></tr>
+{{if .ResultExpireAt}}<tr><th>result expires</th><td>{{milli .ResultExpireAt}}</td></tr>{{end}}
+{{with .Progress}}<tr><th>progress</th><td>{{.Percent}}% {{.Message}} ({{unix .UpdateTime}})</td></tr>{{end}}
+</table>
+<h3>History</h3>
+<table>
+{{range .History}}<tr><td>{{milli .Time}}</td><td>{{.State}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{with .Data.Result}}
+<h3>Result</h3>
+<table>
+<tr><th>success</th><td>{{if eq .IsSuccess 1}}yes{{else}}no{{end}}</td></tr>
+<tr><th>args</th><td>{{.Args}}</td></tr>
+{{if .TimeInterval}}<tr><th>retry intervals</th><td>{{.TimeInterval}}</td></tr>{{end}}
+</table>
+<pre>{{.Result}}</pre>
+{{end}}
+<h3>Logs</h3>
+{{if .Data.Logs}}<pre>{{range .Data.Logs}}<span class="{{.Stream}}">{{unix .Time}} {{.Text}}</span>
+{{end}}</pre>
+{{if .Data.LogMore}}<a href="/task?uuid={{.Data.Status.Uuid}}&from={{.Data.LogNext}}">more logs</a>{{end}}
+{{else}}<p>no logs</p>{{end}}
+{{template "footer" .}}{{end}}
+`
@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/task"
+)
+
+func dashboardGet(t *testing.T, h http.Handler, path string) (int, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	return w.Code, string(body)
+}
+
+//概览、列表和详情页，死信任务通过表单重新执行
+func TestDashboard(t *testing.T) {
+	b, cleanup := newTestBroker(t, &config.BrokerConfig{})
+	defer cleanup()
+	h := b.dashboardHandler()
+
+	queued, err := task.NewTaskRequest("report", nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued.Queue = "mail"
+	if err = b.store.AddRequest(queued); err != nil {
+		t.Fatal(err)
+	}
+	dead, err := task.NewTaskRequest("example", nil, 0, []int{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Index = 1
+	err = b.store.SetResult(&task.TaskResult{TaskRequest: *dead, IsSuccess: 0, Result: "boom"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := dashboardGet(t, h, "/")
+	if code != http.StatusOK || !strings.Contains(body, `href="/tasks?queue=mail"`) {
+		t.Fatalf("overview %d: %s", code, body)
+	}
+	code, body = dashboardGet(t, h, "/tasks?state=dead")
+	if code != http.StatusOK || !strings.Contains(body, dead.Uuid) || strings.Contains(body, queued.Uuid) {
+		t.Fatalf("dead list %d: %s", code, body)
+	}
+	code, body = dashboardGet(t, h, "/task?uuid="+dead.Uuid)
+	if code != http.StatusOK || !strings.Contains(body, "boom") || !strings.Contains(body, "/task/requeue") {
+		t.Fatalf("task detail %d: %s", code, body)
+	}
+	if code, _ = dashboardGet(t, h, "/task?uuid=missing"); code != http.StatusNotFound {
+		t.Fatalf("missing task: %d", code)
+	}
+
+	//其他站点发起的请求被拒绝
+	form := url.Values{"uuid": {dead.Uuid}}.Encode()
+	req := httptest.NewRequest("POST", "/task/requeue", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://evil.example.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("cross site requeue: %d", w.Code)
+	}
+
+	//没有Origin的请求同样被拒绝
+	req = httptest.NewRequest("POST", "/task/requeue", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("requeue without origin: %d", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/task/requeue", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://"+req.Host)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("requeue: %d %s", w.Code, w.Body.String())
+	}
+	st, err := b.store.GetStatus(dead.Uuid)
+	if err != nil || st.State != task.StateQueued {
+		t.Fatalf("requeued task %+v %v", st, err)
+	}
+}
+
+//反向代理改写Host后，Origin为配置的dashboard_origin时接受
+func TestDashboardOrigin(t *testing.T) {
+	b, cleanup := newTestBroker(t, &config.BrokerConfig{})
+	defer cleanup()
+	const host = "127.0.0.1:9598"
+
+	cases := []struct {
+		allowed string
+		origin  string
+		ok      bool
+	}{
+		{"", "http://" + host, true},
+		{"", "https://tasks.example.com", false},
+		{"", "", false},
+		{"https://tasks.example.com", "https://tasks.example.com", true},
+		{"https://tasks.example.com/", "https://TASKS.example.com", true},
+		{"https://tasks.example.com", "http://tasks.example.com", false},
+		{"https://tasks.example.com", "https://evil.example.com", false},
+		{"https://tasks.example.com", "http://" + host, true},
+	}
+	for _, c := range cases {
+		b.cfg.DashboardOrigin = c.allowed
+		if ok := b.allowOrigin(c.origin, host); ok != c.ok {
+			t.Errorf("dashboard_origin %q, origin %q: %v, want %v", c.allowed, c.origin, ok, c.ok)
+		}
+	}
+}
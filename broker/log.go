@@ -0,0 +1,42 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/task"
+)
+
+func (b *Broker) HandleGetLogs(rb *bufio.Reader, c net.Conn) error {
+	args := struct {
+		Uuid  string `json:"uuid"`
+		From  int64  `json:"from"`
+		Count int    `json:"count"`
+	}{}
+	err := json.NewDecoder(rb).Decode(&args)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	if args.Count <= 0 || config.DefaultLogBatch < args.Count {
+		args.Count = config.DefaultLogBatch
+	}
+	//worker写入全部输出后才写入结果，先查询结果保证Done时已经读到全部输出
+	reply := new(task.LogReply)
+	if result, err := b.store.GetResult(args.Uuid); err == nil {
+		reply.Done = result.IsFinal()
+	}
+	reply.Lines, reply.Next, err = b.store.GetLogs(args.Uuid, args.From, args.Count)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	ret, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(ret)
+	return err
+}
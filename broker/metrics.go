@@ -0,0 +1,41 @@
+package broker
+
+import (
+	"github.com/flike/golog"
+
+	"github.com/flike/kingtask/core/metrics"
+)
+
+var (
+	submittedTasks = metrics.NewCounterVec("kingtask_tasks_submitted_total",
+		"Tasks accepted by the broker.", "bin")
+	retriedTasks = metrics.NewCounterVec("kingtask_tasks_retried_total",
+		"Failed tasks scheduled for another attempt.", "bin")
+	openConns = metrics.NewGaugeVec("kingtask_broker_connections",
+		"Open client connections.")
+	acceptedConns = metrics.NewCounterVec("kingtask_broker_connections_total",
+		"Accepted client connections.")
+)
+
+//队列积压和定时器中的任务在采集时查询
+func (b *Broker) registerMetrics() {
+	metrics.NewGaugeFunc("kingtask_queue_depth", "Tasks waiting in each queue.", "queue",
+		func() map[string]float64 {
+			depths, err := b.store.QueueDepths()
+			if err != nil {
+				golog.Error("Broker", "registerMetrics", "get queue depths error", 0,
+					"err", err.Error())
+				return nil
+			}
+			vals := make(map[string]float64, len(depths))
+			for queue, n := range depths {
+				vals[queue] = float64(n)
+			}
+			return vals
+		})
+	metrics.NewGaugeFunc("kingtask_timer_pending_nodes",
+		"Delayed and rate limited tasks waiting in the broker timer.", "",
+		func() map[string]float64 {
+			return map[string]float64{"": float64(b.timer.Pending())}
+		})
+}
@@ -0,0 +1,31 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+
+	"github.com/flike/kingtask/task"
+)
+
+func (b *Broker) HandleGetProgress(rb *bufio.Reader, c net.Conn) error {
+	args := struct {
+		Uuid string `json:"uuid"`
+	}{}
+	err := json.NewDecoder(rb).Decode(&args)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	p, err := b.store.GetProgress(args.Uuid)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	ret, err := json.Marshal(&task.ProgressReply{Progress: p})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(ret)
+	return err
+}
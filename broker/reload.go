@@ -0,0 +1,45 @@
+package broker
+
+import (
+	"github.com/flike/golog"
+
+	"github.com/flike/kingtask/config"
+)
+
+func (b *Broker) config() *config.BrokerConfig {
+	b.cfgLock.RLock()
+	defer b.cfgLock.RUnlock()
+	return b.cfg
+}
+
+//应用重新读取的配置，需要重启才能生效的配置项保持原值并返回其名称。
+//配置有误时返回错误，不做任何修改
+func (b *Broker) Reload(cfg *config.BrokerConfig) ([]string, error) {
+	if err := checkAdmissionMode(cfg.AdmissionMode); err != nil {
+		return nil, err
+	}
+	b.cfgLock.RLock()
+	old, oldBin, oldQueue := b.cfg, b.binLimits, b.queueLimits
+	b.cfgLock.RUnlock()
+	binLimits, err := newAdmissionLimits(cfg.AdmissionBinLimit, oldBin)
+	if err != nil {
+		return nil, err
+	}
+	queueLimits, err := newAdmissionLimits(cfg.AdmissionQueueLimit, oldQueue)
+	if err != nil {
+		return nil, err
+	}
+	restart := cfg.KeepRestartFields(old)
+
+	b.cfgLock.Lock()
+	b.cfg = cfg
+	b.binLimits = binLimits
+	b.queueLimits = queueLimits
+	b.httpClient = newCallbackClient(cfg)
+	b.cfgLock.Unlock()
+	golog.Info("Broker", "Reload", "config reloaded", 0,
+		"admission_mode", cfg.AdmissionMode,
+		"admission_bin_limit", len(binLimits),
+		"admission_queue_limit", len(queueLimits))
+	return restart, nil
+}
@@ -0,0 +1,44 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/flike/kingtask/config"
+)
+
+//速率没有变化的限制沿用原来的令牌桶，需要重启的配置项保持原值
+func TestReload(t *testing.T) {
+	cfg := &config.BrokerConfig{
+		Addr:              "127.0.0.1:9595",
+		AdmissionBinLimit: map[string]string{"report": "10/s", "mail": "1/s"},
+	}
+	b, cleanup := newTestBroker(t, cfg)
+	defer cleanup()
+	var err error
+	if b.binLimits, err = newAdmissionLimits(cfg.AdmissionBinLimit, nil); err != nil {
+		t.Fatal(err)
+	}
+	report := b.binLimits["report"]
+
+	if _, err = b.Reload(&config.BrokerConfig{AdmissionMode: "drop"}); err == nil {
+		t.Fatal("invalid admission_mode reloaded")
+	}
+	restart, err := b.Reload(&config.BrokerConfig{
+		Addr:              "127.0.0.1:9696",
+		AdmissionMode:     config.AdmissionDelay,
+		AdmissionBinLimit: map[string]string{"report": "10/s", "mail": "2/s"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restart, []string{"addr"}) || b.config().Addr != cfg.Addr {
+		t.Fatalf("restart fields %v, addr %s", restart, b.config().Addr)
+	}
+	if b.config().AdmissionMode != config.AdmissionDelay {
+		t.Fatalf("admission_mode not reloaded")
+	}
+	if b.binLimits["report"] != report || b.binLimits["mail"].rate != "2/s" {
+		t.Fatalf("unexpected limits %v", b.binLimits)
+	}
+}
@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/flike/golog"
+
+	"github.com/flike/kingtask/task"
+)
+
+//停止接受新连接，等待处理中的请求完成后关闭客户端连接，
+//再把定时器中还在等待的任务写入存储，由RequeueExpired在到期时放回待执行队列。
+//超过timeout时不再等待，之后调用Close关闭存储
+func (b *Broker) Drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	b.stop()
+	if b.listener != nil {
+		b.listener.Close()
+	}
+	if !b.waitInflight(deadline) {
+		golog.Warn("Broker", "Drain", "wait requests timeout, close connections", 0,
+			"inflight", atomic.LoadInt32(&b.inflight))
+	}
+	b.connLock.Lock()
+	for c := range b.conns {
+		c.Close()
+	}
+	b.connLock.Unlock()
+
+	b.timerLock.Lock()
+	b.timerStopped = true
+	b.timer.Stop()
+	waiting := b.timer.Drain()
+	b.timerLock.Unlock()
+	for _, w := range waiting {
+		if r, ok := w.Arg.(*task.TaskRequest); ok {
+			b.saveScheduled(r, w.Delay)
+		}
+	}
+	//已到期的任务正在入队
+	b.waitInflight(deadline)
+	golog.Info("Broker", "Drain", "broker drained", 0,
+		"scheduled", len(waiting))
+}
+
+//通知后台循环退出，可以重复调用
+func (b *Broker) stop() {
+	b.quitOnce.Do(func() { close(b.quit) })
+}
+
+func (b *Broker) stopping() bool {
+	select {
+	case <-b.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+//等待d或者直到开始退出
+func (b *Broker) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-b.quit:
+	}
+}
+
+//等待处理中的请求和已到期的定时任务完成，超过deadline时返回false
+func (b *Broker) waitInflight(deadline time.Time) bool {
+	for atomic.LoadInt32(&b.inflight) != 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return true
+}
+
+func (b *Broker) trackConn(c net.Conn, add bool) {
+	b.connLock.Lock()
+	if add {
+		b.conns[c] = struct{}{}
+	} else {
+		delete(b.conns, c)
+	}
+	b.connLock.Unlock()
+}
+
+//定时器停止后，等待中的任务写入存储，delay后由RequeueExpired放回待执行队列
+func (b *Broker) saveScheduled(r *task.TaskRequest, delay time.Duration) {
+	err := b.store.ScheduleRequest(r, time.Now().Add(delay))
+	if err != nil {
+		golog.Error("Broker", "saveScheduled", "save scheduled task error", 0,
+			r.LogFields("err", err.Error())...)
+		return
+	}
+	golog.Info("Broker", "saveScheduled", "save scheduled task", 0,
+		r.LogFields("delay", delay.String())...)
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+//退出时定时器中等待的任务写入存储，到期后放回待执行队列
+func TestDrainScheduled(t *testing.T) {
+	b, cleanup := newTestBroker(t, &config.BrokerConfig{})
+	defer cleanup()
+	queues := []string{config.DefaultQueue}
+
+	var reqs []*task.TaskRequest
+	for i := 0; i < 2; i++ {
+		r, err := task.NewTaskRequest("example", nil, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.setState(r, task.StateScheduled)
+		reqs = append(reqs, r)
+	}
+	b.schedule(time.Millisecond*200, b.addRequestWithRetry, reqs[0], "start_time")
+	b.Drain(time.Second)
+	//定时器停止后等待的任务直接写入存储
+	b.schedule(time.Millisecond*200, b.addAdmittedRequest, reqs[1], "admission")
+	if n := b.timer.Pending(); n != 0 {
+		t.Fatalf("pending timers after drain: %d", n)
+	}
+
+	if _, err := b.store.RequeueExpired(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.store.PopRequest(queues, time.Minute); err != errors.ErrKeyNotExist {
+		t.Fatalf("scheduled task queued before due, err %v", err)
+	}
+	time.Sleep(time.Millisecond * 250)
+	if _, err := b.store.RequeueExpired(); err != nil {
+		t.Fatal(err)
+	}
+	popped := map[string]bool{}
+	for range reqs {
+		r, err := b.store.PopRequest(queues, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		popped[r.Uuid] = true
+	}
+	if !popped[reqs[0].Uuid] || !popped[reqs[1].Uuid] {
+		t.Fatalf("unexpected tasks %v", popped)
+	}
+}
+
+//Drain后Accept循环和后台循环都退出，用-race检查退出标志没有数据竞争
+func TestRunDrain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kingtask_broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &config.BrokerConfig{Addr: "127.0.0.1:0"}
+	cfg.Store = config.StoreFile
+	cfg.DataDir = dir
+	b, err := NewBroker(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- b.Run() }()
+	time.Sleep(time.Millisecond * 100)
+	b.Drain(time.Second)
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("Run does not return after drain")
+	}
+	//后台循环在等待中也会立即退出，重复关闭不会panic
+	b.Drain(time.Second)
+}
@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/flike/golog"
+
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+func (b *Broker) HandleGetStatus(rb *bufio.Reader, c net.Conn) error {
+	args := struct {
+		Uuid string `json:"uuid"`
+	}{}
+	err := json.NewDecoder(rb).Decode(&args)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	st, err := b.store.GetStatus(args.Uuid)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	if p, err := b.store.GetProgress(args.Uuid); err == nil {
+		st.Progress = p
+	}
+	return b.WriteStatus(st, c)
+}
+
+func (b *Broker) WriteStatus(st *task.TaskStatus, c net.Conn) error {
+	ret, err := json.Marshal(&task.StatusReply{TaskStatus: st})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(ret)
+	return err
+}
+
+func (b *Broker) HandleCancelTask(rb *bufio.Reader, c net.Conn) error {
+	args := struct {
+		Uuid string `json:"uuid"`
+	}{}
+	err := json.NewDecoder(rb).Decode(&args)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	st, err := b.cancelTask(args.Uuid)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	return b.WriteStatus(st, c)
+}
+
+//队列中的任务直接删除；等待定时器的任务标记为取消，定时器到期时不再入队
+func (b *Broker) cancelTask(uuid string) (*task.TaskStatus, error) {
+	st, err := b.store.GetStatus(uuid)
+	if err != nil {
+		return nil, err
+	}
+	switch st.State {
+	case task.StateQueued:
+		deleted, err := b.store.DelRequest(uuid)
+		if err == nil && !deleted {
+			err = errors.ErrNotCancellable
+		}
+		if err != nil {
+			return nil, err
+		}
+	case task.StateScheduled, task.StateRetrying:
+		r := &task.TaskRequest{
+			Uuid:     st.Uuid,
+			BinName:  st.BinName,
+			Queue:    st.Queue,
+			Workflow: st.Workflow,
+			Index:    st.Attempt,
+		}
+		err = b.store.SetState(r, task.StateCancelled)
+		if err != nil {
+			return nil, err
+		}
+		//定时器可能在查询状态之后已经把任务放回队列
+		b.store.DelRequest(uuid)
+	default:
+		return nil, errors.ErrNotCancellable
+	}
+	golog.Info("Broker", "cancelTask", "cancel task", 0,
+		"uuid", uuid,
+		"state", st.State)
+
+	return b.store.GetStatus(uuid)
+}
+
+func (b *Broker) HandleRequeueTask(rb *bufio.Reader, c net.Conn) error {
+	args := struct {
+		Uuid string `json:"uuid"`
+	}{}
+	err := json.NewDecoder(rb).Decode(&args)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	st, err := b.requeueTask(args.Uuid)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	return b.WriteStatus(st, c)
+}
+
+//重新执行已经失败的任务，工作流中的任务由工作流决定是否重试，不能单独重新执行
+func (b *Broker) requeueTask(uuid string) (*task.TaskStatus, error) {
+	result, err := b.store.GetResult(uuid)
+	if err == nil && (!result.IsFinal() || result.IsSuccess != 0 || len(result.Workflow) != 0) {
+		err = errors.ErrNotRequeueable
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	request := new(task.TaskRequest)
+	*request = result.TaskRequest
+	request.Index = 0
+	request.StartTime = time.Now().Unix()
+	err = b.store.RetryRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	golog.Info("Broker", "requeueTask", "requeue task", 0, request.LogFields()...)
+
+	return b.store.GetStatus(uuid)
+}
+
+func (b *Broker) HandleListTasks(rb *bufio.Reader, c net.Conn) error {
+	q := new(task.TaskQuery)
+	err := json.NewDecoder(rb).Decode(q)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	tasks, cursor, err := b.store.ListTasks(q)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	ret, err := json.Marshal(&task.TaskListReply{Tasks: tasks, Cursor: cursor})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(ret)
+	return err
+}
@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/task"
+)
+
+func statusCall(handle func(*bufio.Reader, net.Conn) error, uuid string) (*task.StatusReply, error) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		handle(bufio.NewReader(strings.NewReader(`{"uuid":"`+uuid+`"}`)), server)
+		server.Close()
+	}()
+	reply := new(task.StatusReply)
+	err := json.NewDecoder(client).Decode(reply)
+	return reply, err
+}
+
+//等待定时器的任务取消后不再入队，失败的任务重新执行时删除旧结果
+func TestCancelAndRequeue(t *testing.T) {
+	b, cleanup := newTestBroker(t, &config.BrokerConfig{})
+	defer cleanup()
+
+	r, err := task.NewTaskRequest("example", nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.setState(r, task.StateScheduled)
+	reply, err := statusCall(b.HandleCancelTask, r.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Status != 0 || reply.TaskStatus.State != task.StateCancelled {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	if err = b.addRequestWithRetry(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.store.PopRequest([]string{config.DefaultQueue}, time.Minute); err == nil {
+		t.Fatal("cancelled task is queued")
+	}
+	reply, err = statusCall(b.HandleCancelTask, r.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Status != 1 {
+		t.Fatalf("cancelled task is cancelled again: %+v", reply)
+	}
+
+	failed, err := task.NewTaskRequest("example", nil, 0, []int{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed.Index = 1
+	err = b.store.SetResult(&task.TaskResult{TaskRequest: *failed, IsSuccess: 0, Result: "boom"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err = statusCall(b.HandleRequeueTask, failed.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Status != 0 || reply.TaskStatus.State != task.StateQueued || reply.TaskStatus.Attempt != 0 {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	if _, err = b.store.GetResult(failed.Uuid); err == nil {
+		t.Fatal("old result is not deleted")
+	}
+}
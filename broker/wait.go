@@ -0,0 +1,137 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flike/golog"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/backoff"
+	"github.com/flike/kingtask/core/errors"
+)
+
+//订阅断开期间的通知会丢失，等待者定期重新查询结果
+const waitRecheckInterval = time.Second * 5
+
+//等待结果的连接，结果写入后关闭对应的channel唤醒等待者
+type resultWaiters struct {
+	sync.Mutex
+	waiters map[string]map[chan struct{}]bool
+}
+
+func newResultWaiters() *resultWaiters {
+	return &resultWaiters{
+		waiters: make(map[string]map[chan struct{}]bool),
+	}
+}
+
+func (w *resultWaiters) add(uuid string) chan struct{} {
+	ch := make(chan struct{})
+	w.Lock()
+	defer w.Unlock()
+	set, ok := w.waiters[uuid]
+	if !ok {
+		set = make(map[chan struct{}]bool)
+		w.waiters[uuid] = set
+	}
+	set[ch] = true
+	return ch
+}
+
+func (w *resultWaiters) remove(uuid string, ch chan struct{}) {
+	w.Lock()
+	defer w.Unlock()
+	set, ok := w.waiters[uuid]
+	if !ok {
+		return
+	}
+	delete(set, ch)
+	if len(set) == 0 {
+		delete(w.waiters, uuid)
+	}
+}
+
+func (w *resultWaiters) notify(uuid string) {
+	w.Lock()
+	defer w.Unlock()
+	for ch := range w.waiters[uuid] {
+		close(ch)
+	}
+	delete(w.waiters, uuid)
+}
+
+//订阅结果写入的通知并唤醒等待的连接，订阅断开后重新订阅
+func (b *Broker) HandleResultNotify() error {
+	bf := backoff.New(time.Millisecond*100, time.Second*5)
+	for !b.stopping() {
+		watcher, err := b.store.WatchResults()
+		if err != nil {
+			golog.Error("Broker", "HandleResultNotify", "watch results error", 0,
+				"error", err.Error())
+			b.sleep(bf.Next())
+			continue
+		}
+		bf.Reset()
+		for uuid := range watcher.Uuids() {
+			b.waiters.notify(uuid)
+		}
+		watcher.Close()
+	}
+	return nil
+}
+
+//阻塞到任务的最终结果写入或者超时，超时后返回结果不存在
+func (b *Broker) HandleWaitResult(rb *bufio.Reader, c net.Conn) error {
+	args := struct {
+		Uuid    string `json:"uuid"`
+		Timeout int64  `json:"timeout"` //毫秒
+	}{}
+	err := json.NewDecoder(rb).Decode(&args)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	timeout := time.Millisecond * time.Duration(args.Timeout)
+	if timeout <= 0 || time.Second*config.MaxWaitResultTime < timeout {
+		timeout = time.Second * config.MaxWaitResultTime
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	recheck := time.NewTicker(waitRecheckInterval)
+	defer recheck.Stop()
+
+	for {
+		//先注册再查询，查询之后写入的结果一定能唤醒等待者
+		ch := b.waiters.add(args.Uuid)
+		result, err := b.store.GetResult(args.Uuid)
+		//还会重试的失败结果不是最终结果，继续等待
+		if err == nil && !result.IsFinal() {
+			err = errors.ErrKeyNotExist
+		}
+		if err == nil {
+			b.waiters.remove(args.Uuid, ch)
+			isSuccess := strconv.FormatInt(result.IsSuccess, 10)
+			return b.WriteResult(config.ResultIsExist, isSuccess, result.Result, c)
+		}
+		if err != errors.ErrKeyNotExist {
+			b.waiters.remove(args.Uuid, ch)
+			golog.Error("Broker", "HandleWaitResult", err.Error(), 0, "uuid", args.Uuid)
+			b.WriteError(err, c)
+			return err
+		}
+
+		select {
+		case <-ch:
+		case <-recheck.C:
+			b.waiters.remove(args.Uuid, ch)
+		case <-deadline.C:
+			b.waiters.remove(args.Uuid, ch)
+			return b.WriteResult(config.ResultNotExist, "0", "", c)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/task"
+)
+
+func waitResult(b *Broker, uuid string, timeout time.Duration) (*task.Reply, error) {
+	server, client := net.Pipe()
+	defer client.Close()
+	args := `{"uuid":"` + uuid + `","timeout":` +
+		strconv.FormatInt(int64(timeout/time.Millisecond), 10) + `}`
+	go func() {
+		b.HandleWaitResult(bufio.NewReader(strings.NewReader(args)), server)
+		server.Close()
+	}()
+	reply := new(task.Reply)
+	err := json.NewDecoder(client).Decode(reply)
+	return reply, err
+}
+
+//结果写入后唤醒等待者，未写入时超时返回结果不存在
+func TestWaitResult(t *testing.T) {
+	b, cleanup := newTestBroker(t, &config.BrokerConfig{})
+	defer cleanup()
+	go b.HandleResultNotify()
+	defer b.stop()
+
+	r, err := task.NewTaskRequest("example", nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		b.store.SetResult(&task.TaskResult{TaskRequest: *r, IsSuccess: 1, Result: "ok"}, time.Minute)
+	}()
+	start := time.Now()
+	reply, err := waitResult(b, r.Uuid, time.Second*3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.IsResultExist != config.ResultIsExist || reply.IsSuccess != 1 || reply.Result != "ok" {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	if time.Second*2 < time.Since(start) {
+		t.Fatalf("waiter is not woken up, waited %v", time.Since(start))
+	}
+
+	reply, err = waitResult(b, "not_exist", time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.IsResultExist != config.ResultNotExist {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+}
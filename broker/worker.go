@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"sort"
+
+	"github.com/flike/kingtask/task"
+)
+
+func (b *Broker) HandleListWorkers(rb *bufio.Reader, c net.Conn) error {
+	var args struct{}
+	err := json.NewDecoder(rb).Decode(&args)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	workers, err := b.store.ListWorkers()
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	ret, err := json.Marshal(&task.WorkerListReply{Workers: workers})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(ret)
+	return err
+}
+
+func (b *Broker) HandleQueueStats(rb *bufio.Reader, c net.Conn) error {
+	var args struct{}
+	err := json.NewDecoder(rb).Decode(&args)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	queues, err := b.queueStats()
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	ret, err := json.Marshal(&task.QueueStatsReply{Queues: queues})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(ret)
+	return err
+}
+
+//队列包括有待执行任务的队列和worker正在消费的队列，按队列名排列
+func (b *Broker) queueStats() ([]*task.QueueStats, error) {
+	depths, err := b.store.QueueDepths()
+	if err != nil {
+		return nil, err
+	}
+	workers, err := b.store.ListWorkers()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]*task.QueueStats)
+	get := func(queue string) *task.QueueStats {
+		qs, ok := stats[queue]
+		if !ok {
+			qs = &task.QueueStats{Queue: queue}
+			stats[queue] = qs
+		}
+		return qs
+	}
+	for queue, n := range depths {
+		get(queue).Pending = n
+	}
+	for _, w := range workers {
+		for _, queue := range w.Queues {
+			get(queue).Workers++
+		}
+	}
+	names := make([]string, 0, len(stats))
+	for queue := range stats {
+		names = append(names, queue)
+	}
+	sort.Strings(names)
+	queues := make([]*task.QueueStats, 0, len(names))
+	for _, queue := range names {
+		queues = append(queues, stats[queue])
+	}
+	return queues, nil
+}
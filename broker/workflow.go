@@ -0,0 +1,392 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/flike/golog"
+	"github.com/pborman/uuid"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/backoff"
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+//同一工作流的状态只能由一个broker修改，锁的租约保证broker崩溃后锁会释放
+const workflowLockLease = time.Second * 10
+
+//检查工作流中丢失任务的间隔
+const workflowRecoverInterval = time.Second * 30
+
+var errWorkflowLocked = errors.NewError("workflow is locked")
+
+type workflowArgs struct {
+	Uuid string `json:"uuid"`
+}
+
+func (b *Broker) WriteWorkflow(wf *task.Workflow, c net.Conn) error {
+	ret, err := json.Marshal(&task.WorkflowReply{Workflow: wf})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(ret)
+	return err
+}
+
+func (b *Broker) HandleSubmitWorkflow(rb *bufio.Reader, c net.Conn) error {
+	wf := new(task.Workflow)
+	//工作流可能大于一次读取的长度，按json边界读取
+	err := json.NewDecoder(rb).Decode(wf)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	err = wf.Validate()
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	wf.Prepare()
+
+	err = b.createWorkflow(wf)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+
+	golog.Info("Broker", "HandleSubmitWorkflow", "submit workflow", 0,
+		"workflow", wf.Uuid, "tasks", len(wf.Tasks))
+	return b.WriteOK(wf.Uuid, c)
+}
+
+func (b *Broker) HandleGetWorkflow(rb *bufio.Reader, c net.Conn) error {
+	args := new(workflowArgs)
+	err := json.NewDecoder(rb).Decode(args)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	wf, err := b.store.GetWorkflow(args.Uuid)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	return b.WriteWorkflow(wf, c)
+}
+
+func (b *Broker) HandleCancelWorkflow(rb *bufio.Reader, c net.Conn) error {
+	args := new(workflowArgs)
+	err := json.NewDecoder(rb).Decode(args)
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+
+	var wf *task.Workflow
+	bf := backoff.New(time.Millisecond*50, time.Second)
+	for i := 0; i < 20; i++ {
+		wf, err = b.updateWorkflow(args.Uuid, func(wf *task.Workflow) ([]*task.WorkflowTask, error) {
+			if wf.Status == task.WorkflowRunning {
+				wf.Status = task.WorkflowCancelled
+				b.cancelWorkflowTasks(wf)
+			}
+			return nil, nil
+		})
+		if err != errWorkflowLocked {
+			break
+		}
+		bf.Sleep()
+	}
+	if err != nil {
+		b.WriteError(err, c)
+		return err
+	}
+	golog.Info("Broker", "HandleCancelWorkflow", "cancel workflow", 0, "workflow", args.Uuid)
+	return b.WriteWorkflow(wf, c)
+}
+
+//根据工作流中任务的结果推进工作流
+func (b *Broker) HandleWorkflowTask() error {
+	bf := backoff.New(time.Millisecond*100, time.Second*5)
+	for !b.stopping() {
+		results, err := b.store.NextNotify(config.NotifyWorkflow, 1)
+		if err == errors.ErrKeyNotExist {
+			bf.Reset()
+			b.sleep(time.Second)
+			continue
+		}
+		if err != nil {
+			golog.Error("Broker", "HandleWorkflowTask", "get workflow result error", 0,
+				"error", err.Error())
+			b.sleep(bf.Next())
+			continue
+		}
+
+		result := results[0]
+		_, err = b.updateWorkflow(result.Workflow, func(wf *task.Workflow) ([]*task.WorkflowTask, error) {
+			return b.advanceWorkflow(wf, result), nil
+		})
+		//其它broker正在修改该工作流，稍后再处理
+		if err == errWorkflowLocked {
+			b.sleep(bf.Next())
+			continue
+		}
+		if err != nil && err != errors.ErrKeyNotExist {
+			golog.Error("Broker", "HandleWorkflowTask", "advance workflow error", 0,
+				result.LogFields(
+					"workflow", result.Workflow,
+					"error", err.Error())...)
+			b.sleep(bf.Next())
+			continue
+		}
+		bf.Reset()
+		err = b.store.AckNotify(config.NotifyWorkflow, result.Uuid)
+		if err != nil {
+			golog.Error("Broker", "HandleWorkflowTask", "ack workflow result error", 0,
+				result.LogFields("error", err.Error())...)
+		}
+	}
+	return nil
+}
+
+//记录任务结果，返回满足触发条件、需要入队的任务。任务失败时结束工作流，
+//ContinueOnFailure的工作流只取消依赖失败任务的任务
+func (b *Broker) advanceWorkflow(wf *task.Workflow, result *task.TaskResult) []*task.WorkflowTask {
+	t := wf.TaskByUuid(result.Uuid)
+	if t == nil || t.Status != task.TaskQueued {
+		return nil
+	}
+	t.Result = result.Result
+	t.Status = task.TaskSucceeded
+	if result.IsSuccess == 0 {
+		t.Status = task.TaskFailed
+		if wf.Status == task.WorkflowRunning && !wf.ContinueOnFailure {
+			b.failWorkflow(wf)
+			return nil
+		}
+	}
+	if wf.Status != task.WorkflowRunning {
+		return nil
+	}
+
+	wf.CancelUnreachable()
+	ready := wf.ReadyTasks()
+	for _, child := range ready {
+		child.Status = task.TaskQueued
+	}
+	return ready
+}
+
+//把任务入队，工作流中这些任务已经保存为queued状态。
+//入队失败或broker崩溃时由HandleLostWorkflowTask补入队列
+func (b *Broker) enqueueWorkflowTasks(wf *task.Workflow, tasks []*task.WorkflowTask) error {
+	for _, t := range tasks {
+		err := b.AddRequestToStore(wf.ReadyRequest(t))
+		if err != nil {
+			golog.Error("Broker", "enqueueWorkflowTasks", "add request error", 0,
+				t.Request.LogFields(
+					"workflow", wf.Uuid,
+					"error", err.Error())...)
+			return err
+		}
+	}
+	return nil
+}
+
+//定期检查未结束的工作流，把已保存为queued但不在存储中的任务重新入队
+func (b *Broker) HandleLostWorkflowTask() error {
+	for !b.stopping() {
+		uuids, err := b.store.RunningWorkflows()
+		if err != nil {
+			golog.Error("Broker", "HandleLostWorkflowTask", "list workflows error", 0,
+				"error", err.Error())
+		}
+		for _, flowUuid := range uuids {
+			err = b.recoverWorkflow(flowUuid)
+			if err != nil && err != errWorkflowLocked && err != errors.ErrKeyNotExist {
+				golog.Error("Broker", "HandleLostWorkflowTask", "recover workflow error", 0,
+					"workflow", flowUuid,
+					"error", err.Error())
+			}
+		}
+		b.sleep(workflowRecoverInterval)
+	}
+	return nil
+}
+
+func (b *Broker) recoverWorkflow(flowUuid string) error {
+	unlock, err := b.lockWorkflow(flowUuid)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	wf, err := b.store.GetWorkflow(flowUuid)
+	if err != nil {
+		return err
+	}
+	if wf.Status != task.WorkflowRunning {
+		return nil
+	}
+	var lost []*task.WorkflowTask
+	for _, t := range wf.Tasks {
+		if t.Status != task.TaskQueued {
+			continue
+		}
+		_, err = b.store.GetStatus(t.Request.Uuid)
+		if err == errors.ErrKeyNotExist {
+			lost = append(lost, t)
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(lost) == 0 {
+		return nil
+	}
+	golog.Warn("Broker", "recoverWorkflow", "enqueue lost workflow tasks", 0,
+		"workflow", flowUuid, "count", len(lost))
+	return b.enqueueWorkflowTasks(wf, lost)
+}
+
+//工作流已经失败或被取消时，把等待重试的任务记为失败，返回是否停止重试
+func (b *Broker) stopWorkflowRetry(result *task.TaskResult) bool {
+	stopped := false
+	_, err := b.updateWorkflow(result.Workflow, func(wf *task.Workflow) ([]*task.WorkflowTask, error) {
+		if wf.Status == task.WorkflowRunning {
+			return nil, nil
+		}
+		if t := wf.TaskByUuid(result.Uuid); t != nil && t.Status == task.TaskQueued {
+			t.Status = task.TaskFailed
+			t.Result = result.Result
+		}
+		//存储中等待的重试到期时丢弃，已经放回队列的直接删除
+		b.setState(&result.TaskRequest, task.StateFailed)
+		b.store.DelRequest(result.Uuid)
+		stopped = true
+		return nil, nil
+	})
+	return err == nil && stopped
+}
+
+func (b *Broker) failWorkflow(wf *task.Workflow) {
+	wf.Status = task.WorkflowFailed
+	b.cancelWorkflowTasks(wf)
+}
+
+//取消还未执行的任务，已经开始执行的任务等待其结果
+func (b *Broker) cancelWorkflowTasks(wf *task.Workflow) {
+	wf.CancelPending()
+	for _, t := range wf.Tasks {
+		if t.Status != task.TaskQueued {
+			continue
+		}
+		deleted, err := b.store.DelRequest(t.Request.Uuid)
+		if err != nil {
+			golog.Error("Broker", "cancelWorkflowTasks", "delete request error", 0,
+				t.Request.LogFields(
+					"workflow", wf.Uuid,
+					"error", err.Error())...)
+			continue
+		}
+		if !deleted {
+			//保存工作流后还没有入队的任务也直接取消
+			_, err = b.store.GetStatus(t.Request.Uuid)
+			deleted = err == errors.ErrKeyNotExist
+		}
+		if deleted {
+			t.Status = task.TaskCancelled
+		}
+	}
+}
+
+//获取工作流锁，返回释放锁的函数
+func (b *Broker) lockWorkflow(flowUuid string) (func(), error) {
+	lockKey := "workflow:" + flowUuid
+	holder := uuid.New()
+	ok, err := b.store.AcquireSlot(lockKey, holder, 1, workflowLockLease)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errWorkflowLocked
+	}
+	return func() { b.store.ReleaseSlot(lockKey, holder) }, nil
+}
+
+//在工作流锁的保护下保存新提交的工作流并把起始任务入队，uuid已存在时返回ErrWorkflowExist
+func (b *Broker) createWorkflow(wf *task.Workflow) error {
+	unlock, err := b.lockWorkflow(wf.Uuid)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = b.store.GetWorkflow(wf.Uuid)
+	if err == nil {
+		return errors.ErrWorkflowExist
+	}
+	if err != errors.ErrKeyNotExist {
+		return err
+	}
+	//先保存工作流再入队，broker在两者之间崩溃时由HandleLostWorkflowTask补入队列
+	roots := wf.ReadyTasks()
+	for _, t := range roots {
+		t.Status = task.TaskQueued
+	}
+	err = b.store.SetWorkflow(wf, 0)
+	if err != nil {
+		return err
+	}
+	err = b.enqueueWorkflowTasks(wf, roots)
+	if err != nil {
+		//入队失败时结束工作流，已入队的任务从队列中删除
+		b.failWorkflow(wf)
+		b.saveWorkflow(wf)
+		return err
+	}
+	return nil
+}
+
+//在工作流锁的保护下读取、修改并保存工作流，保存后把fn返回的任务入队
+func (b *Broker) updateWorkflow(flowUuid string,
+	fn func(wf *task.Workflow) ([]*task.WorkflowTask, error)) (*task.Workflow, error) {
+	unlock, err := b.lockWorkflow(flowUuid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	wf, err := b.store.GetWorkflow(flowUuid)
+	if err != nil {
+		return nil, err
+	}
+	ready, err := fn(wf)
+	if err != nil {
+		return nil, err
+	}
+	err = b.saveWorkflow(wf)
+	if err != nil {
+		return nil, err
+	}
+	err = b.enqueueWorkflowTasks(wf, ready)
+	if err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+//工作流结束后按配置的时间保存，未结束的工作流不过期
+func (b *Broker) saveWorkflow(wf *task.Workflow) error {
+	var keepTime time.Duration
+	if wf.Finish() {
+		keep := b.config().WorkflowKeepTime
+		if keep == 0 {
+			keep = config.DefaultWorkflowKeepTime
+		}
+		keepTime = time.Second * time.Duration(keep)
+	}
+	return b.store.SetWorkflow(wf, keepTime)
+}
@@ -0,0 +1,138 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/store"
+	"github.com/flike/kingtask/task"
+)
+
+//入队失败的存储，模拟broker在保存工作流和入队之间崩溃
+type failAddStore struct {
+	store.Store
+	fail bool
+}
+
+func (s *failAddStore) AddRequest(r *task.TaskRequest) error {
+	if s.fail {
+		return errors.ErrStoreClosed
+	}
+	return s.Store.AddRequest(r)
+}
+
+func newTestWorkflow(t *testing.T) *task.Workflow {
+	wf := task.NewWorkflow()
+	for _, name := range []string{"a", "b"} {
+		r, err := task.NewTaskRequest("example", []string{name}, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "a" {
+			wf.AddTask(name, r)
+		} else {
+			wf.AddTask(name, r, "a")
+		}
+	}
+	wf.Prepare()
+	return wf
+}
+
+func TestCreateWorkflowExist(t *testing.T) {
+	b, cleanup := newTestBroker(t, &config.BrokerConfig{})
+	defer cleanup()
+
+	wf := newTestWorkflow(t)
+	if err := b.createWorkflow(wf); err != nil {
+		t.Fatal(err)
+	}
+	again := newTestWorkflow(t)
+	again.Uuid = wf.Uuid
+	if err := b.createWorkflow(again); err != errors.ErrWorkflowExist {
+		t.Fatalf("submit existing workflow: %v", err)
+	}
+	saved, err := b.store.GetWorkflow(wf.Uuid)
+	if err != nil || saved.Tasks[0].Request.Uuid != wf.Tasks[0].Request.Uuid {
+		t.Fatalf("existing workflow overwritten: %v", err)
+	}
+}
+
+//子任务保存为queued后入队失败，由recoverWorkflow补入队列
+func TestRecoverWorkflowTask(t *testing.T) {
+	b, cleanup := newTestBroker(t, &config.BrokerConfig{})
+	defer cleanup()
+	s := &failAddStore{Store: b.store}
+	b.store = s
+	queues := []string{config.DefaultQueue}
+
+	wf := newTestWorkflow(t)
+	if err := b.createWorkflow(wf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.PopRequest(queues, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &task.TaskResult{TaskRequest: *r, IsSuccess: 1, Result: "ok"}
+	s.fail = true
+	_, err = b.updateWorkflow(wf.Uuid, func(wf *task.Workflow) ([]*task.WorkflowTask, error) {
+		return b.advanceWorkflow(wf, result), nil
+	})
+	if err != errors.ErrStoreClosed {
+		t.Fatalf("advance workflow: %v", err)
+	}
+	saved, err := s.GetWorkflow(wf.Uuid)
+	if err != nil || saved.Tasks[1].Status != task.TaskQueued {
+		t.Fatalf("child is not saved as queued before enqueue: %v", err)
+	}
+	if _, err = s.PopRequest(queues, time.Minute); err != errors.ErrKeyNotExist {
+		t.Fatalf("child is queued: %v", err)
+	}
+
+	uuids, err := s.RunningWorkflows()
+	if err != nil || len(uuids) != 1 || uuids[0] != wf.Uuid {
+		t.Fatalf("running workflows %v, %v", uuids, err)
+	}
+	s.fail = false
+	if err = b.recoverWorkflow(wf.Uuid); err != nil {
+		t.Fatal(err)
+	}
+	child, err := s.PopRequest(queues, time.Minute)
+	if err != nil || child.Uuid != wf.Tasks[1].Request.Uuid {
+		t.Fatalf("lost child is not enqueued: %+v, %v", child, err)
+	}
+	//已在存储中的任务不会重复入队
+	if err = b.recoverWorkflow(wf.Uuid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.PopRequest(queues, time.Minute); err != errors.ErrKeyNotExist {
+		t.Fatalf("child is enqueued twice: %v", err)
+	}
+}
+
+//取消工作流时还没有入队的任务直接取消
+func TestCancelWorkflowLostTask(t *testing.T) {
+	b, cleanup := newTestBroker(t, &config.BrokerConfig{})
+	defer cleanup()
+	s := &failAddStore{Store: b.store, fail: true}
+	b.store = s
+
+	wf := newTestWorkflow(t)
+	if err := b.createWorkflow(wf); err != errors.ErrStoreClosed {
+		t.Fatalf("create workflow: %v", err)
+	}
+	saved, err := s.GetWorkflow(wf.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != task.WorkflowFailed || !saved.Finish() {
+		t.Fatalf("workflow is not finished after enqueue error: %+v", saved)
+	}
+	for _, wt := range saved.Tasks {
+		if wt.Status != task.TaskCancelled {
+			t.Fatalf("task %s status %s", wt.Name, wt.Status)
+		}
+	}
+}
@@ -9,14 +9,22 @@ import (
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/flike/golog"
 	"github.com/flike/kingtask/broker"
 	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/logging"
 )
 
-var configFile *string = flag.String("config", "/etc/broker.conf", "broker config file")
+var configFile *string = flag.String("config", "/etc/broker.conf", "broker config file, empty to configure by environment variables and -set only")
 var logLevel *string = flag.String("log-level", "", "log level [debug|info|warn|error], default error")
+var printConfig *bool = flag.Bool("print-config", false, "print the effective config and exit")
+var overrides config.Overrides
+
+func init() {
+	flag.Var(&overrides, "set", "override a config setting, e.g. -set log_level=info, can be repeated")
+}
 
 const (
 	sysLogName = "sys.log"
@@ -27,18 +35,24 @@ func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
 
-	if len(*configFile) == 0 {
-		fmt.Println("must use a config file")
+	//配置依次来自默认值、配置文件、KINGTASK_前缀的环境变量和-set参数
+	cfg, err := config.LoadBrokerConfig(*configFile, overrides)
+	if err != nil {
+		fmt.Printf("load config error:%v\n", err.Error())
 		return
 	}
-
-	cfg, err := config.ParseBrokerConfigFile(*configFile)
-	if err != nil {
-		fmt.Printf("parse config file error:%v\n", err.Error())
+	if *printConfig {
+		data, err := cfg.Dump()
+		if err != nil {
+			fmt.Printf("dump config error:%v\n", err.Error())
+			return
+		}
+		fmt.Print(string(data))
 		return
 	}
 
 	//when the log file size greater than 1GB, kingtask will generate a new file
+	var sysHandler golog.Handler
 	if len(cfg.LogPath) != 0 {
 		sysFilePath := path.Join(cfg.LogPath, sysLogName)
 		sysFile, err := golog.NewRotatingFileHandler(sysFilePath, MaxLogSize, 1)
@@ -46,8 +60,14 @@ func main() {
 			fmt.Printf("new log file error:%v\n", err.Error())
 			return
 		}
-		golog.GlobalLogger = golog.New(sysFile, golog.Lfile|golog.Ltime|golog.Llevel)
+		sysHandler = sysFile
+	}
+	handler, err := logging.NewHandler(sysHandler, cfg.LogFormat, "", "service", "broker")
+	if err != nil {
+		fmt.Printf("new log handler error:%v\n", err.Error())
+		return
 	}
+	golog.GlobalLogger = golog.New(handler, logging.Flags)
 
 	if *logLevel != "" {
 		setLogLevel(*logLevel)
@@ -60,7 +80,6 @@ func main() {
 	if err != nil {
 		golog.Error("main", "main", err.Error(), 0)
 		golog.GlobalLogger.Close()
-		bk.Close()
 		return
 	}
 
@@ -71,14 +90,57 @@ func main() {
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 
+	done := make(chan struct{})
 	go func() {
-		sig := <-sc
-		golog.Info("main", "main", "Got signal", 0, "signal", sig)
-		golog.GlobalLogger.Close()
-		bk.Close()
+		for {
+			sig := <-sc
+			golog.Info("main", "main", "Got signal", 0, "signal", sig)
+			//SIGHUP重新加载配置，其它信号退出
+			if sig == syscall.SIGHUP {
+				cfg = reloadConfig(bk, cfg)
+				continue
+			}
+			bk.Drain(shutdownTimeout(cfg.ShutdownTimeout))
+			bk.Close()
+			golog.GlobalLogger.Close()
+			close(done)
+			return
+		}
 	}()
 	golog.Info("main", "main", "Broker start!", 0)
 	bk.Run()
+	<-done
+}
+
+//重新读取配置文件，可以在运行时修改的配置项立即生效，日志级别以-log-level参数优先。
+//环境变量和-set参数同样覆盖配置文件，配置有误时继续使用原来的配置
+func reloadConfig(bk *broker.Broker, cfg *config.BrokerConfig) *config.BrokerConfig {
+	newCfg, err := config.LoadBrokerConfig(*configFile, overrides)
+	if err != nil {
+		golog.Error("main", "reloadConfig", "load config error", 0, "err", err.Error())
+		return cfg
+	}
+	restart, err := bk.Reload(newCfg)
+	if err != nil {
+		golog.Error("main", "reloadConfig", "reload config error", 0, "err", err.Error())
+		return cfg
+	}
+	if *logLevel == "" {
+		setLogLevel(newCfg.LogLevel)
+	}
+	if len(restart) != 0 {
+		golog.Warn("main", "reloadConfig", "settings changed, restart to apply", 0,
+			"settings", strings.Join(restart, ","))
+	}
+	return newCfg
+}
+
+//退出时等待的最长时间，没有配置时使用默认值
+func shutdownTimeout(timeout int64) time.Duration {
+	if timeout == 0 {
+		timeout = config.DefaultShutdownTimeout
+	}
+	return time.Second * time.Duration(timeout)
 }
 
 func setLogLevel(level string) {
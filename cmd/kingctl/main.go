@@ -0,0 +1,437 @@
+//kingtask的命令行管理工具，通过broker提交、查询、取消任务，查看worker和队列
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+var brokerAddr *string = flag.String("broker", "127.0.0.1:9595", "broker address, comma separated addresses for failover")
+var output *string = flag.String("o", "table", "output format [table|json]")
+
+const usage = `Usage: kingctl [-broker addr] [-o table|json] <command> [args]
+
+Commands:
+  submit [flags] <bin> [args...]   submit a task
+  status <uuid>                    show the state and state history of a task
+  result [-wait d] <uuid>          show the latest result of a task
+  cancel <uuid>...                 cancel scheduled, queued or retrying tasks
+  list [flags]                     list tasks, newest first
+  dead list [flags]                list dead tasks
+  dead show <uuid>                 show the state and last result of a dead task
+  dead requeue <uuid>...           run failed tasks again with a fresh retry budget
+  workers                          list workers that are sending heartbeats
+  queues                           show pending tasks and workers of each queue
+  schedules list [flags]           list tasks waiting for their start time
+  schedules cancel <uuid>...       cancel scheduled tasks
+`
+
+type command func(c *task.BrokerClient, args []string) error
+
+var commands = map[string]command{
+	"submit":    submitCmd,
+	"status":    statusCmd,
+	"result":    resultCmd,
+	"cancel":    cancelCmd,
+	"list":      listCmd,
+	"dead":      deadCmd,
+	"workers":   workersCmd,
+	"queues":    queuesCmd,
+	"schedules": schedulesCmd,
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fatal(fmt.Errorf("invalid output format %q", *output))
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client, err := task.NewBrokerClient(*brokerAddr)
+	if err != nil {
+		fatal(err)
+	}
+	err = cmd(client, flag.Args()[1:])
+	client.Close()
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "kingctl: %v\n", err)
+	os.Exit(1)
+}
+
+//子命令的参数，args为空时打印用法
+func parseFlags(fs *flag.FlagSet, args []string, minArgs int, argsUsage string) []string {
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: kingctl %s [flags] %s\n", fs.Name(), argsUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < minArgs {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+func submitCmd(c *task.BrokerClient, args []string) error {
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
+	queue := fs.String("queue", "", "task queue, default queue if empty")
+	delay := fs.Duration("delay", 0, "start the task after this delay")
+	retry := fs.String("retry", "", "comma separated retry intervals in seconds, e.g. 5,30,300")
+	stdin := fs.String("stdin", "", "data written to the stdin of the task")
+	idemKey := fs.String("idempotency-key", "", "idempotency key of the task")
+	callback := fs.String("callback", "", "url to POST the final result to")
+	wait := fs.Duration("wait", 0, "wait for the final result up to this long")
+	traceparent := fs.String("traceparent", os.Getenv("TRACEPARENT"), "W3C trace context of the caller")
+	args = parseFlags(fs, args, 1, "<bin> [args...]")
+
+	var intervals []int
+	if len(*retry) != 0 {
+		for _, s := range strings.Split(*retry, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("invalid retry interval %q", s)
+			}
+			intervals = append(intervals, n)
+		}
+	}
+	var startTime int64
+	if 0 < *delay {
+		startTime = time.Now().Add(*delay).Unix()
+	}
+	r, err := task.NewTaskRequest(args[0], args[1:], startTime, intervals)
+	if err != nil {
+		return err
+	}
+	r.Queue = *queue
+	r.Stdin = *stdin
+	r.IdempotencyKey = *idemKey
+	r.CallbackUrl = *callback
+	r.Traceparent = *traceparent
+
+	err = c.Delay(r)
+	if err != nil {
+		return err
+	}
+	if *wait <= 0 {
+		if *output == "json" {
+			return printJSON(map[string]string{"uuid": r.Uuid})
+		}
+		fmt.Println(r.Uuid)
+		return nil
+	}
+	reply, err := c.WaitResult(r.Uuid, *wait)
+	if err != nil {
+		return fmt.Errorf("task %s: %v", r.Uuid, err)
+	}
+	return printResult(r.Uuid, reply)
+}
+
+func statusCmd(c *task.BrokerClient, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	args = parseFlags(fs, args, 1, "<uuid>")
+	st, err := c.GetStatus(args[0])
+	if err != nil {
+		return err
+	}
+	return printStatus(st)
+}
+
+func resultCmd(c *task.BrokerClient, args []string) error {
+	fs := flag.NewFlagSet("result", flag.ExitOnError)
+	wait := fs.Duration("wait", 0, "wait for the final result up to this long")
+	args = parseFlags(fs, args, 1, "<uuid>")
+	var reply *task.Reply
+	var err error
+	if 0 < *wait {
+		reply, err = c.WaitResult(args[0], *wait)
+	} else {
+		reply, err = c.GetResult(&task.TaskRequest{Uuid: args[0]})
+	}
+	if err != nil {
+		return err
+	}
+	return printResult(args[0], reply)
+}
+
+func cancelCmd(c *task.BrokerClient, args []string) error {
+	fs := flag.NewFlagSet("cancel", flag.ExitOnError)
+	args = parseFlags(fs, args, 1, "<uuid>...")
+	return eachTask(args, c.CancelTask)
+}
+
+//逐个处理任务，出错的任务不影响后面的任务
+func eachTask(uuids []string, fn func(uuid string) (*task.TaskStatus, error)) error {
+	var tasks []*task.TaskStatus
+	failed := 0
+	for _, uuid := range uuids {
+		st, err := fn(uuid)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "kingctl: %s: %v\n", uuid, err)
+			failed++
+			continue
+		}
+		tasks = append(tasks, st)
+	}
+	if len(tasks) != 0 || *output == "json" {
+		if err := printTasks(tasks, ""); err != nil {
+			return err
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d tasks failed", failed, len(uuids))
+	}
+	return nil
+}
+
+//查询任务的通用参数，state为默认的状态条件
+func listFlags(fs *flag.FlagSet, state string) func() *task.TaskQuery {
+	q := new(task.TaskQuery)
+	if len(state) == 0 {
+		fs.StringVar(&q.State, "state", "", "filter by state")
+	}
+	fs.StringVar(&q.BinName, "bin", "", "filter by bin name")
+	fs.StringVar(&q.Queue, "queue", "", "filter by queue")
+	since := fs.Duration("since", 0, "only tasks submitted within this duration")
+	fs.StringVar(&q.Cursor, "cursor", "", "cursor returned by the previous page")
+	fs.IntVar(&q.Limit, "limit", 0, "max tasks per page, default 100")
+	return func() *task.TaskQuery {
+		if len(state) != 0 {
+			q.State = state
+		}
+		if 0 < *since {
+			q.Since = time.Now().Add(-*since).UnixNano() / int64(time.Millisecond)
+		}
+		return q
+	}
+}
+
+func listCmd(c *task.BrokerClient, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	query := listFlags(fs, "")
+	parseFlags(fs, args, 0, "")
+	return listTasks(c, query())
+}
+
+func listTasks(c *task.BrokerClient, q *task.TaskQuery) error {
+	tasks, cursor, err := c.ListTasks(q)
+	if err != nil {
+		return err
+	}
+	return printTasks(tasks, cursor)
+}
+
+func deadCmd(c *task.BrokerClient, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: kingctl dead list|show|requeue")
+	}
+	fs := flag.NewFlagSet("dead "+args[0], flag.ExitOnError)
+	switch args[0] {
+	case "list":
+		query := listFlags(fs, task.StateDead)
+		parseFlags(fs, args[1:], 0, "")
+		return listTasks(c, query())
+	case "show":
+		args = parseFlags(fs, args[1:], 1, "<uuid>")
+		st, err := c.GetStatus(args[0])
+		if err != nil {
+			return err
+		}
+		reply, err := c.GetResult(&task.TaskRequest{Uuid: args[0]})
+		if err != nil && err != errors.ErrResultNotReady {
+			return err
+		}
+		if *output == "json" {
+			return printJSON(struct {
+				*task.TaskStatus
+				Result *task.Reply `json:"result,omitempty"`
+			}{st, reply})
+		}
+		if err = printStatus(st); err != nil {
+			return err
+		}
+		if reply != nil {
+			fmt.Printf("\nresult:\n%s\n", reply.Result)
+		}
+		return nil
+	case "requeue":
+		args = parseFlags(fs, args[1:], 1, "<uuid>...")
+		return eachTask(args, c.RequeueTask)
+	}
+	return fmt.Errorf("unknown dead command %q", args[0])
+}
+
+func workersCmd(c *task.BrokerClient, args []string) error {
+	fs := flag.NewFlagSet("workers", flag.ExitOnError)
+	parseFlags(fs, args, 0, "")
+	workers, err := c.ListWorkers()
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return printJSON(workers)
+	}
+	w := newTable("ID", "HOST", "PID", "QUEUES", "RUNNING", "STARTED", "HEARTBEAT")
+	for _, wk := range workers {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", wk.Id, wk.Host, wk.Pid,
+			strings.Join(wk.Queues, ","), orDash(wk.Running),
+			formatTime(wk.StartTime), formatTime(wk.Heartbeat))
+	}
+	return w.Flush()
+}
+
+func queuesCmd(c *task.BrokerClient, args []string) error {
+	fs := flag.NewFlagSet("queues", flag.ExitOnError)
+	parseFlags(fs, args, 0, "")
+	queues, err := c.QueueStats()
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return printJSON(queues)
+	}
+	w := newTable("QUEUE", "PENDING", "WORKERS")
+	for _, q := range queues {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", q.Queue, q.Pending, q.Workers)
+	}
+	return w.Flush()
+}
+
+//定时任务即设置了开始时间、还在等待的任务
+func schedulesCmd(c *task.BrokerClient, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: kingctl schedules list|cancel")
+	}
+	fs := flag.NewFlagSet("schedules "+args[0], flag.ExitOnError)
+	switch args[0] {
+	case "list":
+		query := listFlags(fs, task.StateScheduled)
+		parseFlags(fs, args[1:], 0, "")
+		return listTasks(c, query())
+	case "cancel":
+		args = parseFlags(fs, args[1:], 1, "<uuid>...")
+		return eachTask(args, c.CancelTask)
+	}
+	return fmt.Errorf("unknown schedules command %q", args[0])
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func newTable(headers ...string) *tabwriter.Writer {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+	return w
+}
+
+//毫秒时间戳转成本地时间，0表示没有
+func formatTime(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).Format("2006-01-02 15:04:05")
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+func printTasks(tasks []*task.TaskStatus, cursor string) error {
+	if *output == "json" {
+		return printJSON(struct {
+			Tasks  []*task.TaskStatus `json:"tasks"`
+			Cursor string             `json:"cursor,omitempty"`
+		}{tasks, cursor})
+	}
+	w := newTable("UUID", "STATE", "BIN", "QUEUE", "ATTEMPT", "SUBMITTED", "UPDATED")
+	for _, st := range tasks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", st.Uuid, st.State, st.BinName,
+			orDash(st.Queue), st.Attempt, formatTime(st.SubmitTime), formatTime(st.UpdateTime))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(cursor) != 0 {
+		fmt.Fprintf(os.Stderr, "more tasks: -cursor %s\n", cursor)
+	}
+	return nil
+}
+
+func printStatus(st *task.TaskStatus) error {
+	if *output == "json" {
+		return printJSON(st)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "uuid:\t%s\n", st.Uuid)
+	fmt.Fprintf(w, "state:\t%s\n", st.State)
+	fmt.Fprintf(w, "bin:\t%s\n", st.BinName)
+	fmt.Fprintf(w, "queue:\t%s\n", orDash(st.Queue))
+	fmt.Fprintf(w, "workflow:\t%s\n", orDash(st.Workflow))
+	fmt.Fprintf(w, "attempt:\t%d\n", st.Attempt)
+	fmt.Fprintf(w, "submitted:\t%s\n", formatTime(st.SubmitTime))
+	fmt.Fprintf(w, "updated:\t%s\n", formatTime(st.UpdateTime))
+	if st.ResultExpireAt != 0 {
+		fmt.Fprintf(w, "result expires:\t%s\n", formatTime(st.ResultExpireAt))
+	}
+	if st.Progress != nil {
+		fmt.Fprintf(w, "progress:\t%d%% %s\n", st.Progress.Percent, st.Progress.Message)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(st.History) == 0 {
+		return nil
+	}
+	fmt.Println()
+	w = newTable("TIME", "STATE")
+	for _, h := range st.History {
+		fmt.Fprintf(w, "%s\t%s\n", formatTime(h.Time), h.State)
+	}
+	return w.Flush()
+}
+
+func printResult(uuid string, reply *task.Reply) error {
+	if *output == "json" {
+		return printJSON(struct {
+			Uuid string `json:"uuid"`
+			*task.Reply
+		}{uuid, reply})
+	}
+	status := "failed"
+	if reply.IsSuccess == 1 {
+		status = "succeeded"
+	}
+	fmt.Printf("uuid:    %s\nstatus:  %s\nresult:\n%s\n", uuid, status, reply.Result)
+	return nil
+}
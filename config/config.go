@@ -1,27 +1,123 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
+//任务存储配置，broker和worker共用
+type StoreConfig struct {
+	Store           string   `yaml:"store"`
+	RedisAddr       string   `yaml:"redis"`
+	SentinelMaster  string   `yaml:"sentinel_master"`
+	SentinelAddrs   []string `yaml:"sentinel_addrs"`
+	ClusterAddrs    []string `yaml:"cluster_addrs"`
+	RedisShards     int      `yaml:"redis_shards"`
+	DataDir         string   `yaml:"data_dir"`
+	CompactInterval int64    `yaml:"compact_interval"`
+
+	//redis认证，密码优先从环境变量或文件中读取，避免明文写在配置文件里
+	RedisUser         string `yaml:"redis_user"`
+	RedisPassword     string `yaml:"redis_password"`
+	RedisPasswordFile string `yaml:"redis_password_file"`
+	RedisPasswordEnv  string `yaml:"redis_password_env"`
+
+	RedisTLS           bool   `yaml:"redis_tls"`
+	RedisTLSCA         string `yaml:"redis_tls_ca"`
+	RedisTLSCert       string `yaml:"redis_tls_cert"`
+	RedisTLSKey        string `yaml:"redis_tls_key"`
+	RedisTLSServerName string `yaml:"redis_tls_server_name"`
+	RedisTLSSkipVerify bool   `yaml:"redis_tls_skip_verify"`
+
+	//超时时间单位为毫秒，为0时使用redis客户端的默认值
+	RedisDialTimeout  int64 `yaml:"redis_dial_timeout"`
+	RedisReadTimeout  int64 `yaml:"redis_read_timeout"`
+	RedisWriteTimeout int64 `yaml:"redis_write_timeout"`
+	RedisPoolSize     int   `yaml:"redis_pool_size"`
+	RedisPoolTimeout  int64 `yaml:"redis_pool_timeout"`
+	RedisIdleTimeout  int64 `yaml:"redis_idle_timeout"`
+}
+
 type BrokerConfig struct {
-	Addr      string `yaml:"addr"`
-	RedisAddr string `yaml:"redis"`
-	LogPath   string `yaml:"log_path"`
-	LogLevel  string `yaml:"log_level"`
+	Addr        string `yaml:"addr"`
+	StoreConfig `yaml:",inline"`
+	LogPath     string `yaml:"log_path"`
+	LogLevel    string `yaml:"log_level"`
+	//幂等键的有效时间，单位为秒
+	IdempotencyWindow int64 `yaml:"idempotency_window"`
+	//提交任务时按可执行文件或队列限速，格式为 次数/时间，如 100/s、10/m，
+	//超过限制的请求按admission_mode拒绝(reject)或延迟入队(delay)
+	AdmissionBinLimit   map[string]string `yaml:"admission_bin_limit"`
+	AdmissionQueueLimit map[string]string `yaml:"admission_queue_limit"`
+	AdmissionMode       string            `yaml:"admission_mode"`
+	//工作流结束后保存的时间，单位为秒
+	WorkflowKeepTime int64 `yaml:"workflow_keep_time"`
+	//任务结束回调的签名密钥，为空时不签名
+	CallbackSecret string `yaml:"callback_secret"`
+	//回调超时时间，单位为毫秒
+	CallbackTimeout int64 `yaml:"callback_timeout"`
+	//回调失败后退避重试，超过最大尝试次数后放弃
+	CallbackAttempts int `yaml:"callback_attempts"`
+	//投递状态保存的时间，单位为秒
+	CallbackKeepTime int64 `yaml:"callback_keep_time"`
+	//Prometheus指标的http地址，为空时不开启
+	MetricsAddr string `yaml:"metrics_addr"`
+	//span的导出方式，file或者otlp，为空时不记录span。file方式trace_endpoint为文件路径，
+	//otlp方式为OTLP/HTTP的地址
+	TraceExporter string `yaml:"trace_exporter"`
+	TraceEndpoint string `yaml:"trace_endpoint"`
+	//日志格式，text或者json
+	LogFormat string `yaml:"log_format"`
+	//web控制台的http地址，为空时不开启
+	DashboardAddr string `yaml:"dashboard_addr"`
+	//通过反向代理访问控制台时页面的地址，如 https://tasks.example.com，
+	//为空时只接受Origin与请求的Host一致的操作
+	DashboardOrigin string `yaml:"dashboard_origin"`
+	//退出时等待处理中的请求完成的最长时间，单位为秒
+	ShutdownTimeout int64 `yaml:"shutdown_timeout"`
 }
 
 type WorkerConfig struct {
 	BrokerAddr     string `yaml:"broker"`
-	RedisAddr      string `yaml:"redis"`
+	StoreConfig    `yaml:",inline"`
 	LogPath        string `yaml:"log_path"`
 	LogLevel       string `yaml:"log_level"`
 	BinPath        string `yaml:"bin_path"`
-	Peroid         int64  `yaml:"peroid"`
+	Period         int64  `yaml:"period"`
 	ResultKeepTime int64  `yaml:"result_keep_time"`
-	TaskRunTime    int64  `yaml:"task_run_time"`
+	//任务最长执行时间，单位为秒，为0时使用默认值3600
+	TaskRunTime int64 `yaml:"task_run_time"`
+	//每个可执行文件在所有worker上同时执行的最大数量，所有worker需要配置一致
+	BinConcurrency map[string]int `yaml:"bin_concurrency"`
+	//订阅的队列，按顺序优先执行前面队列中的任务，默认只订阅default队列
+	Queues []string `yaml:"queues"`
+	//所有worker共同遵守的执行速率限制，格式为 次数/时间，如 10/s、100/m
+	BinRateLimit   map[string]string `yaml:"bin_rate_limit"`
+	QueueRateLimit map[string]string `yaml:"queue_rate_limit"`
+	//任务输出日志的行数上限、单行长度上限(字节)和保存时间(秒)
+	LogMaxLines int   `yaml:"log_max_lines"`
+	LogLineSize int   `yaml:"log_line_size"`
+	LogKeepTime int64 `yaml:"log_keep_time"`
+	//Prometheus指标的http地址，为空时不开启
+	MetricsAddr string `yaml:"metrics_addr"`
+	//span的导出方式，file或者otlp，为空时不记录span。file方式trace_endpoint为文件路径，
+	//otlp方式为OTLP/HTTP的地址
+	TraceExporter string `yaml:"trace_exporter"`
+	TraceEndpoint string `yaml:"trace_endpoint"`
+	//日志格式，text或者json
+	LogFormat string `yaml:"log_format"`
+	//不为空时，带有任务uuid的日志同时写入该目录下以uuid命名的文件
+	TaskLogDir string `yaml:"task_log_dir"`
+	//退出时等待正在执行的任务完成的最长时间，单位为秒，超时的任务被终止并放回待执行队列
+	ShutdownTimeout int64 `yaml:"shutdown_timeout"`
+	//period的旧拼写，加载时合并到Period
+	Peroid int64 `yaml:"peroid,omitempty"`
 }
 
 func ParseBrokerConfigFile(fileName string) (*BrokerConfig, error) {
@@ -35,6 +131,9 @@ func ParseBrokerConfigFile(fileName string) (*BrokerConfig, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	if err := checkUnknownKeys(data, &cfg); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
@@ -49,5 +148,47 @@ func ParseWorkerConfigFile(fileName string) (*WorkerConfig, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	if err := checkUnknownKeys(data, &cfg); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
+
+//获取redis密码，优先级：环境变量 > 密码文件 > 配置文件
+func (cfg *StoreConfig) LoadRedisPassword() (string, error) {
+	if len(cfg.RedisPasswordEnv) != 0 {
+		if password, ok := os.LookupEnv(cfg.RedisPasswordEnv); ok {
+			return password, nil
+		}
+	}
+	if len(cfg.RedisPasswordFile) != 0 {
+		data, err := ioutil.ReadFile(cfg.RedisPasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return cfg.RedisPassword, nil
+}
+
+//解析速率限制，格式为 次数/时间，时间为s、m、h或者带数字的时长，如 10/s、100/30s
+func ParseRateLimit(rate string) (int, time.Duration, error) {
+	vec := strings.SplitN(strings.TrimSpace(rate), "/", 2)
+	if len(vec) != 2 {
+		return 0, 0, fmt.Errorf("invalid rate limit %q", rate)
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(vec[0]))
+	if err != nil || limit <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate limit %q", rate)
+	}
+	unit := strings.TrimSpace(vec[1])
+	switch unit {
+	case "s", "m", "h":
+		unit = "1" + unit
+	}
+	period, err := time.ParseDuration(unit)
+	if err != nil || period <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate limit %q", rate)
+	}
+	return limit, period, nil
+}
@@ -2,15 +2,84 @@ package config
 
 const (
 	DefaultRedisDB       = 0
-	TaskRequestItemCount = 6
 	RequestUuidSet       = "request_uuid_set"
 	FailResultUuidSet    = "fail_result_uuid_set"
+	RunningUuidSet       = "running_uuid_set"
 	TypeRequestTask      = 1
 	TypeGetTaskResult    = 2
 	TypeCloseConn        = 3
+	TypeSubmitWorkflow   = 4
+	TypeGetWorkflow      = 5
+	TypeCancelWorkflow   = 6
+	TypeGetCallback      = 7
+	TypeWaitResult       = 8
+	TypeGetProgress      = 9
+	TypeGetLogs          = 10
+	TypeGetStatus        = 11
+	TypeListTasks        = 12
+	TypeCancelTask       = 13
+	TypeRequeueTask      = 14
+	TypeListWorkers      = 15
+	TypeQueueStats       = 16
+	ResultChannel        = "result_channel"
 )
 
 const (
 	ResultNotExist = 0
 	ResultIsExist  = 1
 )
+
+const (
+	StoreRedis             = "redis"
+	StoreFile              = "file"
+	DefaultCompactInterval = 300
+	DefaultRedisShards     = 16
+	//任务租约在最长执行时间之外的宽限时间，单位为秒
+	LeaseGraceTime = 30
+	//幂等键默认有效时间，单位为秒
+	DefaultIdempotencyWindow = 86400
+	//没有空闲并发名额时任务延迟放回队列的时间，单位为秒
+	ConcurrencyWaitTime = 1
+	DefaultQueue        = "default"
+	AdmissionReject     = "reject"
+	AdmissionDelay      = "delay"
+	//工作流结束后保存的时间，单位为秒
+	DefaultWorkflowKeepTime = 86400
+	//回调的超时时间，单位为毫秒
+	DefaultCallbackTimeout = 5000
+	//回调的最大尝试次数
+	DefaultCallbackAttempts = 5
+	//回调投递状态保存的时间，单位为秒
+	DefaultCallbackKeepTime = 86400
+	//WaitResult最长等待时间，单位为秒
+	MaxWaitResultTime = 300
+	//每个任务保存的日志行数上限，超过时丢弃最旧的行
+	DefaultLogMaxLines = 10000
+	//单行日志的长度上限，超过时截断
+	DefaultLogLineSize = 4096
+	//任务日志最后一次写入后保存的时间，单位为秒
+	DefaultLogKeepTime = 86400
+	//TailLogs每次读取的行数
+	DefaultLogBatch = 1000
+	//任务结束后状态保存的时间，单位为秒
+	DefaultStatusKeepTime = 604800
+	//ListTasks每页默认和最多返回的任务数
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+	//worker上报心跳的间隔和心跳的有效时间，单位为秒
+	WorkerHeartbeatInterval = 5
+	WorkerHeartbeatTTL      = 15
+	//退出时等待请求或任务完成的默认时间，单位为秒
+	DefaultShutdownTimeout = 30
+	//任务默认的最长执行时间和结果保存时间，单位为秒
+	DefaultTaskRunTime    = 3600
+	DefaultResultKeepTime = 86400
+	DefaultLogLevel       = "error"
+	DefaultLogFormat      = "text"
+)
+
+//任务结束后需要broker处理的通知，每种通知一个队列
+const (
+	NotifyWorkflow = "workflow"
+	NotifyCallback = "callback"
+)
@@ -0,0 +1,446 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//环境变量覆盖配置项时的前缀，变量名为前缀加上大写的配置项名，如 KINGTASK_TASK_RUN_TIME
+const EnvPrefix = "KINGTASK_"
+
+//命令行中多次出现的 -set 配置项=值
+type Overrides []string
+
+func (o *Overrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *Overrides) Set(v string) error {
+	*o = append(*o, v)
+	return nil
+}
+
+//按 默认值 < 配置文件 < 环境变量 < 命令行参数 的顺序加载broker配置，并检查配置是否有效。
+//fileName为空时不读取配置文件
+func LoadBrokerConfig(fileName string, overrides []string) (*BrokerConfig, error) {
+	cfg := new(BrokerConfig)
+	if len(fileName) != 0 {
+		var err error
+		if cfg, err = ParseBrokerConfigFile(fileName); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyOverrides(cfg, overrides); err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func LoadWorkerConfig(fileName string, overrides []string) (*WorkerConfig, error) {
+	cfg := new(WorkerConfig)
+	if len(fileName) != 0 {
+		var err error
+		if cfg, err = ParseWorkerConfigFile(fileName); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyOverrides(cfg, overrides); err != nil {
+		return nil, err
+	}
+	//兼容旧的peroid拼写
+	if cfg.Peroid != 0 {
+		if cfg.Period != 0 && cfg.Period != cfg.Peroid {
+			return nil, fmt.Errorf("peroid(%d) conflicts with period(%d), peroid is deprecated",
+				cfg.Peroid, cfg.Period)
+		}
+		cfg.Period = cfg.Peroid
+		cfg.Peroid = 0
+	}
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+//先用环境变量再用命令行参数覆盖配置文件中的值
+func applyOverrides(cfg interface{}, overrides []string) error {
+	fields := make(map[string]reflect.Value)
+	var names []string
+	collectFields(reflect.ValueOf(cfg).Elem(), fields, &names)
+	for _, name := range names {
+		env := EnvPrefix + strings.ToUpper(name)
+		if value, ok := os.LookupEnv(env); ok {
+			if err := setField(fields[name], value); err != nil {
+				return fmt.Errorf("%s: %v", env, err)
+			}
+		}
+	}
+	for _, o := range overrides {
+		vec := strings.SplitN(o, "=", 2)
+		field, ok := fields[strings.TrimSpace(vec[0])]
+		if len(vec) != 2 || !ok {
+			return fmt.Errorf("-set %q: unknown setting, want name=value", o)
+		}
+		if err := setField(field, vec[1]); err != nil {
+			return fmt.Errorf("-set %s: %v", vec[0], err)
+		}
+	}
+	return nil
+}
+
+//按yaml中的名称收集配置项，展开inline的StoreConfig
+func collectFields(v reflect.Value, fields map[string]reflect.Value, names *[]string) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Anonymous {
+			collectFields(v.Field(i), fields, names)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		fields[name] = v.Field(i)
+		*names = append(*names, name)
+	}
+}
+
+//配置文件中拼错或者不存在的配置项会被yaml忽略，加载时报错
+func checkUnknownKeys(data []byte, cfg interface{}) error {
+	keys := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	fields := make(map[string]reflect.Value)
+	var names []string
+	collectFields(reflect.ValueOf(cfg).Elem(), fields, &names)
+	var unknown []string
+	for key := range keys {
+		if _, ok := fields[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown setting %s in config file", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+//列表的值以逗号分隔，如 default,mail；map的值为逗号分隔的 键=值，如 report=10/s,mail=1/s
+func setField(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) != 0 {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) == 0 {
+				continue
+			}
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid item %q, want key=value", item)
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := setField(elem, strings.TrimSpace(kv[1])); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(kv[0])), elem)
+		}
+		v.Set(m)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+func (cfg *StoreConfig) setDefaults() {
+	if len(cfg.Store) == 0 {
+		cfg.Store = StoreRedis
+	}
+	if cfg.RedisShards == 0 {
+		cfg.RedisShards = DefaultRedisShards
+	}
+	if cfg.CompactInterval == 0 {
+		cfg.CompactInterval = DefaultCompactInterval
+	}
+}
+
+func (cfg *BrokerConfig) setDefaults() {
+	cfg.StoreConfig.setDefaults()
+	setString(&cfg.LogLevel, DefaultLogLevel)
+	setString(&cfg.LogFormat, DefaultLogFormat)
+	setString(&cfg.AdmissionMode, AdmissionReject)
+	setInt(&cfg.IdempotencyWindow, DefaultIdempotencyWindow)
+	setInt(&cfg.WorkflowKeepTime, DefaultWorkflowKeepTime)
+	setInt(&cfg.CallbackTimeout, DefaultCallbackTimeout)
+	setInt(&cfg.CallbackKeepTime, DefaultCallbackKeepTime)
+	setInt(&cfg.ShutdownTimeout, DefaultShutdownTimeout)
+	if cfg.CallbackAttempts == 0 {
+		cfg.CallbackAttempts = DefaultCallbackAttempts
+	}
+}
+
+func (cfg *WorkerConfig) setDefaults() {
+	cfg.StoreConfig.setDefaults()
+	setString(&cfg.LogLevel, DefaultLogLevel)
+	setString(&cfg.LogFormat, DefaultLogFormat)
+	setInt(&cfg.TaskRunTime, DefaultTaskRunTime)
+	setInt(&cfg.ResultKeepTime, DefaultResultKeepTime)
+	setInt(&cfg.LogKeepTime, DefaultLogKeepTime)
+	setInt(&cfg.ShutdownTimeout, DefaultShutdownTimeout)
+	if len(cfg.Queues) == 0 {
+		cfg.Queues = []string{DefaultQueue}
+	}
+	if cfg.LogMaxLines == 0 {
+		cfg.LogMaxLines = DefaultLogMaxLines
+	}
+	if cfg.LogLineSize == 0 {
+		cfg.LogLineSize = DefaultLogLineSize
+	}
+}
+
+func setString(v *string, def string) {
+	if len(*v) == 0 {
+		*v = def
+	}
+}
+
+func setInt(v *int64, def int64) {
+	if *v == 0 {
+		*v = def
+	}
+}
+
+func (cfg *StoreConfig) Validate() error {
+	switch cfg.Store {
+	case "", StoreRedis:
+		if len(cfg.RedisAddr) == 0 && len(cfg.SentinelAddrs) == 0 && len(cfg.ClusterAddrs) == 0 {
+			return fmt.Errorf("one of redis, sentinel_addrs and cluster_addrs is required when store is redis")
+		}
+		if len(cfg.SentinelAddrs) != 0 && len(cfg.SentinelMaster) == 0 {
+			return fmt.Errorf("sentinel_master is required when sentinel_addrs is set")
+		}
+		if vec := strings.SplitN(cfg.RedisAddr, "/", 2); len(vec) == 2 {
+			if _, err := strconv.Atoi(vec[1]); err != nil {
+				return fmt.Errorf("redis: invalid database %q in %q", vec[1], cfg.RedisAddr)
+			}
+		}
+	case StoreFile:
+		if len(cfg.DataDir) == 0 {
+			return fmt.Errorf("data_dir is required when store is file")
+		}
+	default:
+		return fmt.Errorf("store must be redis or file, got %q", cfg.Store)
+	}
+	return checkNonNegative(map[string]int64{
+		"redis_shards":        int64(cfg.RedisShards),
+		"compact_interval":    cfg.CompactInterval,
+		"redis_dial_timeout":  cfg.RedisDialTimeout,
+		"redis_read_timeout":  cfg.RedisReadTimeout,
+		"redis_write_timeout": cfg.RedisWriteTimeout,
+		"redis_pool_size":     int64(cfg.RedisPoolSize),
+		"redis_pool_timeout":  cfg.RedisPoolTimeout,
+		"redis_idle_timeout":  cfg.RedisIdleTimeout,
+	})
+}
+
+func (cfg *BrokerConfig) Validate() error {
+	if len(cfg.Addr) == 0 {
+		return fmt.Errorf("addr is required")
+	}
+	if err := cfg.StoreConfig.Validate(); err != nil {
+		return err
+	}
+	if err := checkLog(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+	if err := checkTrace(cfg.TraceExporter, cfg.TraceEndpoint); err != nil {
+		return err
+	}
+	switch cfg.AdmissionMode {
+	case "", AdmissionReject, AdmissionDelay:
+	default:
+		return fmt.Errorf("admission_mode must be reject or delay, got %q", cfg.AdmissionMode)
+	}
+	if len(cfg.DashboardOrigin) != 0 {
+		u, err := url.Parse(cfg.DashboardOrigin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("dashboard_origin must be like https://host, got %q", cfg.DashboardOrigin)
+		}
+	}
+	if err := checkRateLimits("admission_bin_limit", cfg.AdmissionBinLimit); err != nil {
+		return err
+	}
+	if err := checkRateLimits("admission_queue_limit", cfg.AdmissionQueueLimit); err != nil {
+		return err
+	}
+	return checkNonNegative(map[string]int64{
+		"idempotency_window": cfg.IdempotencyWindow,
+		"workflow_keep_time": cfg.WorkflowKeepTime,
+		"callback_timeout":   cfg.CallbackTimeout,
+		"callback_attempts":  int64(cfg.CallbackAttempts),
+		"callback_keep_time": cfg.CallbackKeepTime,
+		"shutdown_timeout":   cfg.ShutdownTimeout,
+	})
+}
+
+func (cfg *WorkerConfig) Validate() error {
+	if len(cfg.BinPath) == 0 {
+		return fmt.Errorf("bin_path is required")
+	}
+	if err := cfg.StoreConfig.Validate(); err != nil {
+		return err
+	}
+	if err := checkLog(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+	if err := checkTrace(cfg.TraceExporter, cfg.TraceEndpoint); err != nil {
+		return err
+	}
+	if cfg.TaskRunTime <= 0 {
+		return fmt.Errorf("task_run_time must be positive, got %d", cfg.TaskRunTime)
+	}
+	seen := make(map[string]bool)
+	for _, queue := range cfg.Queues {
+		if len(queue) == 0 || seen[queue] {
+			return fmt.Errorf("queues: empty or duplicate queue %q", queue)
+		}
+		seen[queue] = true
+	}
+	for bin, limit := range cfg.BinConcurrency {
+		if limit <= 0 {
+			return fmt.Errorf("bin_concurrency[%s] must be positive, got %d", bin, limit)
+		}
+	}
+	if err := checkRateLimits("bin_rate_limit", cfg.BinRateLimit); err != nil {
+		return err
+	}
+	if err := checkRateLimits("queue_rate_limit", cfg.QueueRateLimit); err != nil {
+		return err
+	}
+	return checkNonNegative(map[string]int64{
+		"period":           cfg.Period,
+		"result_keep_time": cfg.ResultKeepTime,
+		"log_max_lines":    int64(cfg.LogMaxLines),
+		"log_line_size":    int64(cfg.LogLineSize),
+		"log_keep_time":    cfg.LogKeepTime,
+		"shutdown_timeout": cfg.ShutdownTimeout,
+	})
+}
+
+func checkLog(level string, format string) error {
+	switch strings.ToLower(level) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log_level must be debug, info, warn or error, got %q", level)
+	}
+	switch format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("log_format must be text or json, got %q", format)
+	}
+	return nil
+}
+
+func checkTrace(exporter string, endpoint string) error {
+	switch exporter {
+	case "":
+	case "file", "otlp":
+		if len(endpoint) == 0 {
+			return fmt.Errorf("trace_endpoint is required when trace_exporter is %s", exporter)
+		}
+	default:
+		return fmt.Errorf("trace_exporter must be file or otlp, got %q", exporter)
+	}
+	return nil
+}
+
+func checkRateLimits(name string, rates map[string]string) error {
+	for key, rate := range rates {
+		if _, _, err := ParseRateLimit(rate); err != nil {
+			return fmt.Errorf("%s[%s]: %v", name, key, err)
+		}
+	}
+	return nil
+}
+
+func checkNonNegative(values map[string]int64) error {
+	for name, v := range values {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative, got %d", name, v)
+		}
+	}
+	return nil
+}
+
+//输出生效的配置，redis密码、回调签名密钥和地址中的密码以******代替
+func (cfg *BrokerConfig) Dump() ([]byte, error) {
+	c := *cfg
+	c.StoreConfig.redact()
+	redactSecret(&c.CallbackSecret)
+	c.TraceEndpoint = redactURL(c.TraceEndpoint)
+	return yaml.Marshal(&c)
+}
+
+func (cfg *WorkerConfig) Dump() ([]byte, error) {
+	c := *cfg
+	c.StoreConfig.redact()
+	c.TraceEndpoint = redactURL(c.TraceEndpoint)
+	return yaml.Marshal(&c)
+}
+
+func (cfg *StoreConfig) redact() {
+	redactSecret(&cfg.RedisPassword)
+}
+
+const redacted = "******"
+
+func redactSecret(s *string) {
+	if len(*s) != 0 {
+		*s = redacted
+	}
+}
+
+//http地址中可能带有user:password@
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	u.User = url.UserPassword(u.User.Username(), redacted)
+	return u.String()
+}
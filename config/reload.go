@@ -0,0 +1,58 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+//收到SIGHUP时可以重新加载的配置项，其它配置项修改后需要重启才能生效
+var brokerReloadable = []string{
+	"log_level", "idempotency_window", "admission_bin_limit", "admission_queue_limit",
+	"admission_mode", "workflow_keep_time", "callback_secret", "callback_timeout",
+	"callback_attempts", "callback_keep_time", "shutdown_timeout", "dashboard_origin",
+}
+
+//bin_concurrency在任务获取并发名额时读取，重新加载后新的名额上限对之后获取名额的任务生效
+var workerReloadable = []string{
+	"log_level", "bin_path", "period", "peroid", "result_keep_time", "task_run_time",
+	"bin_concurrency", "queues", "bin_rate_limit", "queue_rate_limit",
+	"log_max_lines", "log_line_size", "log_keep_time", "shutdown_timeout",
+}
+
+//cfg为重新读取的配置，其中修改了的需要重启才能生效的配置项恢复为old中的值，返回这些配置项的名称
+func (cfg *BrokerConfig) KeepRestartFields(old *BrokerConfig) []string {
+	return keepFields(reflect.ValueOf(cfg).Elem(), reflect.ValueOf(old).Elem(), brokerReloadable)
+}
+
+func (cfg *WorkerConfig) KeepRestartFields(old *WorkerConfig) []string {
+	return keepFields(reflect.ValueOf(cfg).Elem(), reflect.ValueOf(old).Elem(), workerReloadable)
+}
+
+func keepFields(cur, old reflect.Value, reloadable []string) []string {
+	var names []string
+	for i := 0; i < cur.NumField(); i++ {
+		field := cur.Type().Field(i)
+		//inline的StoreConfig
+		if field.Anonymous {
+			names = append(names, keepFields(cur.Field(i), old.Field(i), reloadable)...)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if isReloadable(name, reloadable) ||
+			reflect.DeepEqual(cur.Field(i).Interface(), old.Field(i).Interface()) {
+			continue
+		}
+		cur.Field(i).Set(old.Field(i))
+		names = append(names, name)
+	}
+	return names
+}
+
+func isReloadable(name string, reloadable []string) bool {
+	for _, n := range reloadable {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
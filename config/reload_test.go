@@ -0,0 +1,33 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeepRestartFields(t *testing.T) {
+	old := &WorkerConfig{
+		BrokerAddr:  "127.0.0.1:9595",
+		StoreConfig: StoreConfig{RedisAddr: "127.0.0.1:6379"},
+		BinPath:     "/usr/local/bin",
+		TaskRunTime: 10,
+	}
+	cfg := &WorkerConfig{
+		BrokerAddr:  "127.0.0.1:9595",
+		StoreConfig: StoreConfig{RedisAddr: "127.0.0.1:6380"},
+		BinPath:     "/opt/bin",
+		TaskRunTime: 20,
+		Queues:      []string{"mail"},
+		MetricsAddr: "127.0.0.1:9597",
+	}
+	restart := cfg.KeepRestartFields(old)
+	if !reflect.DeepEqual(restart, []string{"redis", "metrics_addr"}) {
+		t.Fatalf("restart fields %v", restart)
+	}
+	if cfg.RedisAddr != old.RedisAddr || len(cfg.MetricsAddr) != 0 {
+		t.Fatalf("restart fields not kept: %+v", cfg)
+	}
+	if cfg.BinPath != "/opt/bin" || cfg.TaskRunTime != 20 || len(cfg.Queues) != 1 {
+		t.Fatalf("reloadable fields not applied: %+v", cfg)
+	}
+}
@@ -0,0 +1,40 @@
+//指数退避，用于存储或网络异常时的重试等待
+package backoff
+
+import (
+	"time"
+)
+
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+	cur time.Duration
+}
+
+func New(min, max time.Duration) *Backoff {
+	return &Backoff{
+		Min: min,
+		Max: max,
+	}
+}
+
+//返回下一次重试前需要等待的时间，每次翻倍，不超过Max
+func (b *Backoff) Next() time.Duration {
+	if b.cur == 0 {
+		b.cur = b.Min
+	} else {
+		b.cur *= 2
+	}
+	if b.Max < b.cur {
+		b.cur = b.Max
+	}
+	return b.cur
+}
+
+func (b *Backoff) Sleep() {
+	time.Sleep(b.Next())
+}
+
+func (b *Backoff) Reset() {
+	b.cur = 0
+}
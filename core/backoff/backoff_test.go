@@ -0,0 +1,27 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := New(time.Millisecond*100, time.Second)
+	expect := []time.Duration{
+		time.Millisecond * 100,
+		time.Millisecond * 200,
+		time.Millisecond * 400,
+		time.Millisecond * 800,
+		time.Second,
+		time.Second,
+	}
+	for i, d := range expect {
+		if n := b.Next(); n != d {
+			t.Errorf("step %d:%s, expect %s", i, n, d)
+		}
+	}
+	b.Reset()
+	if n := b.Next(); n != time.Millisecond*100 {
+		t.Errorf("after reset:%s", n)
+	}
+}
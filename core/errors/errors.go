@@ -16,4 +16,14 @@ var (
 	ErrBadConn         = errors.New("bad net connection")
 	ErrResultNotReady  = errors.New("result not ready")
 	ErrExecTimeout     = errors.New("exec time out")
+	ErrExecInterrupted = errors.New("exec interrupted by shutdown")
+	ErrKeyNotExist     = errors.New("key not exist")
+	ErrStoreType       = errors.New("store type error")
+	ErrStoreClosed     = errors.New("store closed")
+	ErrCorruptedLog    = errors.New("corrupted log record")
+	ErrRateLimited     = errors.New("rate limit exceeded")
+	ErrNotCancellable  = errors.New("task can not be cancelled")
+	ErrNotRequeueable  = errors.New("task can not be requeued")
+	ErrClientClosed    = errors.New("broker client closed")
+	ErrWorkflowExist   = errors.New("workflow already exists")
 )
@@ -0,0 +1,175 @@
+//golog输出的日志转换为json格式，以及按任务uuid分开的日志文件
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/flike/golog"
+)
+
+//日志格式
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+//golog使用的标志，JSONHandler按这个格式解析
+const Flags = golog.Ltime | golog.Lfile | golog.Llevel
+
+//按日志格式包装h，h为空时输出到标准输出。taskLogDir不为空时带有uuid的日志同时写入任务日志文件，
+//fields为json格式中每条日志都带有的键值对
+func NewHandler(h golog.Handler, format string, taskLogDir string, fields ...string) (golog.Handler, error) {
+	switch format {
+	case "", FormatText, FormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid log_format %q", format)
+	}
+	if h == nil {
+		h, _ = golog.NewStreamHandler(os.Stdout)
+	}
+	if len(taskLogDir) != 0 {
+		th, err := NewTaskFileHandler(h, taskLogDir)
+		if err != nil {
+			return nil, err
+		}
+		h = th
+	}
+	if format == FormatJSON {
+		h = NewJSONHandler(h, fields...)
+	}
+	return h, nil
+}
+
+//把golog的文本日志转换为一行json，fields为每条日志都带有的键值对，如服务名
+type JSONHandler struct {
+	h      golog.Handler
+	fields []string
+}
+
+func NewJSONHandler(h golog.Handler, fields ...string) *JSONHandler {
+	return &JSONHandler{h: h, fields: fields}
+}
+
+//一条日志的各个部分，args保持原有的顺序
+type entry struct {
+	time   string
+	level  string
+	file   string
+	module string
+	method string
+	msg    string
+	args   [][2]string
+	reqId  string
+}
+
+//解析golog的日志行，格式为
+//2006/01/02 15:04:05 - LEVEL - file.go:[1] - [module] "method" "msg" "k1=v1|k2=v2" req_id=0
+//无法解析的部分整体作为msg
+func parseLine(line string) *entry {
+	line = strings.TrimRight(line, "\n")
+	e := new(entry)
+	parts := strings.SplitN(line, " - ", 4)
+	if len(parts) != 4 {
+		e.msg = line
+		return e
+	}
+	e.time, e.level, e.file = parts[0], parts[1], parts[2]
+	if t, err := time.ParseInLocation(golog.TimeFormat, e.time, time.Local); err == nil {
+		e.time = t.Format(time.RFC3339)
+	}
+	content := parts[3]
+	e.msg = content
+
+	if !strings.HasPrefix(content, "[") {
+		return e
+	}
+	end := strings.Index(content, "] \"")
+	if end < 0 {
+		return e
+	}
+	module := content[1:end]
+	rest := content[end+2:]
+	if i := strings.LastIndex(rest, "\" req_id="); 0 <= i {
+		e.reqId = rest[i+len("\" req_id="):]
+		rest = rest[:i+1]
+	}
+	//rest为 "method" "msg" "args"
+	first := strings.Index(rest, "\" \"")
+	last := strings.LastIndex(rest, "\" \"")
+	if first < 0 || first == last || len(rest) < 2 || !strings.HasSuffix(rest, "\"") {
+		return e
+	}
+	e.module = module
+	e.method = rest[1:first]
+	e.msg = rest[first+3 : last]
+	args := rest[last+3 : len(rest)-1]
+	if len(args) != 0 {
+		for _, kv := range strings.Split(args, "|") {
+			i := strings.Index(kv, "=")
+			if i < 0 {
+				e.args = append(e.args, [2]string{"arg", kv})
+			} else {
+				e.args = append(e.args, [2]string{kv[:i], kv[i+1:]})
+			}
+		}
+	}
+	return e
+}
+
+func appendField(buf *bytes.Buffer, key, value string) {
+	if 1 < buf.Len() {
+		buf.WriteByte(',')
+	}
+	k, _ := json.Marshal(key)
+	v, _ := json.Marshal(value)
+	buf.Write(k)
+	buf.WriteByte(':')
+	buf.Write(v)
+}
+
+func (e *entry) json(fields []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	if len(e.time) != 0 {
+		appendField(&buf, "time", e.time)
+	}
+	if len(e.level) != 0 {
+		appendField(&buf, "level", strings.ToLower(e.level))
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		appendField(&buf, fields[i], fields[i+1])
+	}
+	if len(e.module) != 0 {
+		appendField(&buf, "module", e.module)
+		appendField(&buf, "method", e.method)
+	}
+	appendField(&buf, "msg", e.msg)
+	for _, kv := range e.args {
+		appendField(&buf, kv[0], kv[1])
+	}
+	if len(e.file) != 0 {
+		appendField(&buf, "file", e.file)
+	}
+	if len(e.reqId) != 0 && e.reqId != "0" {
+		appendField(&buf, "req_id", e.reqId)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func (h *JSONHandler) Write(p []byte) (int, error) {
+	_, err := h.h.Write(parseLine(string(p)).json(h.fields))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (h *JSONHandler) Close() error {
+	return h.h.Close()
+}
@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/flike/golog"
+)
+
+//替换全局日志，返回恢复函数
+func captureLog(h golog.Handler) func() {
+	old := golog.GlobalLogger
+	golog.GlobalLogger = golog.New(h, Flags)
+	golog.GlobalLogger.SetLevel(golog.LevelDebug)
+	return func() {
+		golog.GlobalLogger.Close()
+		golog.GlobalLogger = old
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	var buf bytes.Buffer
+	stream, _ := golog.NewStreamHandler(&buf)
+	restore := captureLog(NewJSONHandler(stream, "service", "worker"))
+	golog.Error("Worker", "run", "exec error", 0, "uuid", "abc", "attempt", 2, "err", "exit status 1")
+	golog.Info("main", "main", "Worker start!", 0)
+	restore()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expect 2 lines, got %q", buf.String())
+	}
+	var m map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"level":   "error",
+		"service": "worker",
+		"module":  "Worker",
+		"method":  "run",
+		"msg":     "exec error",
+		"uuid":    "abc",
+		"attempt": "2",
+		"err":     "exit status 1",
+	}
+	for k, v := range expect {
+		if m[k] != v {
+			t.Errorf("%s: expect %q, got %q", k, v, m[k])
+		}
+	}
+	if len(m["time"]) == 0 || !strings.HasPrefix(m["file"], "logging_test.go:") {
+		t.Errorf("bad entry %v", m)
+	}
+
+	//无法解析的日志整体作为msg
+	e := parseLine("unexpected line\n")
+	if e.msg != "unexpected line" || len(e.module) != 0 {
+		t.Errorf("bad entry %+v", e)
+	}
+}
+
+func TestTaskFileHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tasklog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, format := range []string{FormatText, FormatJSON} {
+		var buf bytes.Buffer
+		stream, _ := golog.NewStreamHandler(&buf)
+		files, err := NewTaskFileHandler(stream, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//json格式时先转换再写入任务日志文件
+		var h golog.Handler = files
+		if format == FormatJSON {
+			h = NewJSONHandler(files)
+		}
+		restore := captureLog(h)
+		golog.Info("Worker", "run", "start task", 0, "uuid", format+"-1", "bin_name", "report")
+		golog.Info("Worker", "run", "no task", 0)
+		golog.Info("Worker", "run", "bad uuid", 0, "uuid", "../x")
+		restore()
+
+		if n := strings.Count(buf.String(), "\n"); n != 3 {
+			t.Fatalf("%s: expect 3 lines in main log, got %d", format, n)
+		}
+		data, err := ioutil.ReadFile(TaskFilePath(dir, format+"-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(string(data), "\n") != 1 || !strings.Contains(string(data), "start task") {
+			t.Fatalf("%s: bad task log %q", format, data)
+		}
+	}
+	if _, err := os.Stat(TaskFilePath(dir, "../x")); err == nil {
+		t.Fatal("invalid uuid should not create a file")
+	}
+}
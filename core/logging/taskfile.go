@@ -0,0 +1,130 @@
+package logging
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/flike/golog"
+)
+
+//同时打开的任务日志文件数，超过时关闭最久没有写入的文件
+const maxTaskFiles = 64
+
+//日志写入h，带有uuid字段的日志同时追加到dir下以uuid命名的文件中
+type TaskFileHandler struct {
+	sync.Mutex
+	h     golog.Handler
+	dir   string
+	files map[string]*list.Element
+	lru   *list.List
+}
+
+type taskFile struct {
+	uuid string
+	f    *os.File
+}
+
+func NewTaskFileHandler(h golog.Handler, dir string) (*TaskFileHandler, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &TaskFileHandler{
+		h:     h,
+		dir:   dir,
+		files: make(map[string]*list.Element),
+		lru:   list.New(),
+	}, nil
+}
+
+//任务日志文件的路径
+func TaskFilePath(dir string, uuid string) string {
+	return path.Join(dir, uuid+".log")
+}
+
+//从文本或者json格式的日志中取出uuid字段
+func lineUuid(p []byte) string {
+	if 0 < len(p) && p[0] == '{' {
+		var v struct {
+			Uuid string `json:"uuid"`
+		}
+		if json.Unmarshal(p, &v) != nil {
+			return ""
+		}
+		return v.Uuid
+	}
+	line := string(p)
+	i := strings.Index(line, "\"uuid=")
+	if i < 0 {
+		i = strings.Index(line, "|uuid=")
+	}
+	if i < 0 {
+		return ""
+	}
+	v := line[i+len("|uuid="):]
+	if j := strings.IndexAny(v, "|\""); 0 <= j {
+		v = v[:j]
+	}
+	return v
+}
+
+//uuid用作文件名，只允许字母、数字和 - _
+func validUuid(uuid string) bool {
+	if len(uuid) == 0 || 64 < len(uuid) {
+		return false
+	}
+	for _, c := range uuid {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (h *TaskFileHandler) file(uuid string) (*os.File, error) {
+	if e, ok := h.files[uuid]; ok {
+		h.lru.MoveToFront(e)
+		return e.Value.(*taskFile).f, nil
+	}
+	f, err := os.OpenFile(TaskFilePath(h.dir, uuid), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	h.files[uuid] = h.lru.PushFront(&taskFile{uuid, f})
+	if maxTaskFiles < h.lru.Len() {
+		oldest := h.lru.Remove(h.lru.Back()).(*taskFile)
+		delete(h.files, oldest.uuid)
+		oldest.f.Close()
+	}
+	return f, nil
+}
+
+func (h *TaskFileHandler) Write(p []byte) (int, error) {
+	n, err := h.h.Write(p)
+	if uuid := lineUuid(bytes.TrimSpace(p)); validUuid(uuid) {
+		h.Lock()
+		f, ferr := h.file(uuid)
+		if ferr == nil {
+			f.Write(p)
+		}
+		h.Unlock()
+	}
+	return n, err
+}
+
+func (h *TaskFileHandler) Close() error {
+	h.Lock()
+	for e := h.lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*taskFile).f.Close()
+	}
+	h.files = make(map[string]*list.Element)
+	h.lru.Init()
+	h.Unlock()
+	return h.h.Close()
+}
@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	c := NewCounterVec("test_tasks_total", "tasks", "bin")
+	c.Inc("a")
+	c.Add(2, "b")
+	h := NewHistogramVec("test_exec_seconds", "exec time", []float64{1, 10}, "bin")
+	h.Observe(0.5, "a")
+	h.Observe(5, "a")
+	NewGaugeFunc("test_depth", "depth", "queue", func() map[string]float64 {
+		return map[string]float64{"default": 3}
+	})
+
+	var buf bytes.Buffer
+	if err := Default.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	expect := []string{
+		"# TYPE test_tasks_total counter\n",
+		`test_tasks_total{bin="a"} 1` + "\n",
+		`test_tasks_total{bin="b"} 2` + "\n",
+		"# TYPE test_exec_seconds histogram\n",
+		`test_exec_seconds_bucket{bin="a",le="1"} 1` + "\n",
+		`test_exec_seconds_bucket{bin="a",le="10"} 2` + "\n",
+		`test_exec_seconds_bucket{bin="a",le="+Inf"} 2` + "\n",
+		`test_exec_seconds_sum{bin="a"} 5.5` + "\n",
+		`test_exec_seconds_count{bin="a"} 2` + "\n",
+		`test_depth{queue="default"} 3` + "\n",
+	}
+	for _, line := range expect {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+}
@@ -26,6 +26,10 @@ type Timer struct {
 	time uint32
 	tick time.Duration
 	quit chan struct{}
+	//还未到期的节点数
+	pending int
+
+	stopOnce sync.Once
 }
 
 type Node struct {
@@ -34,6 +38,12 @@ type Node struct {
 	arg    interface{}
 }
 
+//Drain取出的还未到期的节点参数及其剩余时间
+type Waiting struct {
+	Arg   interface{}
+	Delay time.Duration
+}
+
 func (n *Node) String() string {
 	return fmt.Sprintf("Node:expire,%d", n.expire)
 }
@@ -83,10 +93,17 @@ func (t *Timer) NewTimer(d time.Duration, fn interface{}, arg interface{}) *Node
 	n.expire = uint32(d/t.tick) + t.time
 	t.Lock()
 	t.addNode(n)
+	t.pending++
 	t.Unlock()
 	return n
 }
 
+func (t *Timer) Pending() int {
+	t.Lock()
+	defer t.Unlock()
+	return t.pending
+}
+
 func (t *Timer) String() string {
 	return fmt.Sprintf("Timer:time:%d, tick:%s", t.time, t.tick)
 }
@@ -146,6 +163,7 @@ func (t *Timer) execute() {
 	idx := t.time & TIME_NEAR_MASK
 	vec := t.near[idx]
 	if vec.Len() > 0 {
+		t.pending -= vec.Len()
 		front := vec.Front()
 		vec.Init()
 		t.Unlock()
@@ -178,5 +196,36 @@ func (t *Timer) Start() {
 }
 
 func (t *Timer) Stop() {
-	close(t.quit)
+	t.stopOnce.Do(func() {
+		close(t.quit)
+	})
+}
+
+//取出所有还未到期的节点，这些节点之后不会再被触发，已到期正在执行的节点不受影响。
+//在Stop之后调用，用于退出前把等待中的任务保存下来
+func (t *Timer) Drain() []Waiting {
+	t.Lock()
+	defer t.Unlock()
+	var waiting []Waiting
+	drain := func(vec *list.List) {
+		for e := vec.Front(); e != nil; e = e.Next() {
+			node := e.Value.(*Node)
+			var delay time.Duration
+			if t.time < node.expire {
+				delay = time.Duration(node.expire-t.time) * t.tick
+			}
+			waiting = append(waiting, Waiting{Arg: node.arg, Delay: delay})
+		}
+		vec.Init()
+	}
+	for i := 0; i < TIME_NEAR; i++ {
+		drain(t.near[i])
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < TIME_LEVEL; j++ {
+			drain(t.t[i][j])
+		}
+	}
+	t.pending = 0
+	return waiting
 }
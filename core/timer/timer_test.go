@@ -35,4 +35,37 @@ func TestTimer(t *testing.T) {
 	if sum != N {
 		t.Errorf("sum=%d,fail", sum)
 	}
+	if n := timer.Pending(); n != 0 {
+		t.Errorf("pending=%d,fail", n)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	timer := New(time.Millisecond * 10)
+	var fired int32
+	fn := func(arg interface{}) {
+		atomic.AddInt32(&fired, 1)
+	}
+	timer.NewTimer(time.Second, fn, 1)
+	timer.NewTimer(time.Minute*10, fn, 2)
+	timer.Stop()
+	timer.Stop()
+
+	waiting := timer.Drain()
+	if len(waiting) != 2 {
+		t.Fatalf("waiting=%d,fail", len(waiting))
+	}
+	delays := map[interface{}]time.Duration{}
+	for _, w := range waiting {
+		delays[w.Arg] = w.Delay
+	}
+	if delays[1] != time.Second || delays[2] != time.Minute*10 {
+		t.Errorf("delays=%v,fail", delays)
+	}
+	if n := timer.Pending(); n != 0 {
+		t.Errorf("pending=%d,fail", n)
+	}
+	if len(timer.Drain()) != 0 || atomic.LoadInt32(&fired) != 0 {
+		t.Errorf("drain twice,fail")
+	}
 }
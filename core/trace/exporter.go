@@ -0,0 +1,220 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//导出方式
+const (
+	ExporterFile = "file"
+	ExporterOTLP = "otlp"
+)
+
+//kind为空时返回nil，不记录span。file方式endpoint为文件路径，
+//otlp方式endpoint为OTLP/HTTP的地址，如 http://127.0.0.1:4318/v1/traces
+func NewExporter(kind string, endpoint string) (Exporter, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case ExporterFile:
+		return NewFileExporter(endpoint)
+	case ExporterOTLP:
+		return NewOTLPExporter(endpoint)
+	}
+	return nil, fmt.Errorf("invalid trace exporter %q", kind)
+}
+
+//每行一个json格式的span
+type FileExporter struct {
+	sync.Mutex
+	f *os.File
+}
+
+type fileSpan struct {
+	Service  string            `json:"service"`
+	TraceId  string            `json:"trace_id"`
+	SpanId   string            `json:"span_id"`
+	ParentId string            `json:"parent_span_id,omitempty"`
+	Name     string            `json:"name"`
+	Kind     int               `json:"kind"`
+	Start    int64             `json:"start"` //单位为纳秒
+	End      int64             `json:"end"`
+	Attrs    map[string]string `json:"attributes,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("trace file is empty")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{f: f}, nil
+}
+
+func (e *FileExporter) Export(service string, spans []*Span) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range spans {
+		fs := &fileSpan{
+			Service: service,
+			TraceId: hex.EncodeToString(s.Context.TraceId[:]),
+			SpanId:  hex.EncodeToString(s.Context.SpanId[:]),
+			Name:    s.Name,
+			Kind:    s.Kind,
+			Start:   s.Start.UnixNano(),
+			End:     s.End.UnixNano(),
+			Error:   s.Error,
+		}
+		if s.ParentId != [8]byte{} {
+			fs.ParentId = hex.EncodeToString(s.ParentId[:])
+		}
+		if len(s.Attrs) != 0 {
+			fs.Attrs = make(map[string]string, len(s.Attrs))
+			for _, a := range s.Attrs {
+				fs.Attrs[a.Key] = a.Value
+			}
+		}
+		if err := enc.Encode(fs); err != nil {
+			return err
+		}
+	}
+	e.Lock()
+	defer e.Unlock()
+	_, err := e.f.Write(buf.Bytes())
+	return err
+}
+
+func (e *FileExporter) Close() error {
+	return e.f.Close()
+}
+
+//OTLP/HTTP的json编码
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` //1成功，2出错
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId      string     `json:"traceId"`
+	SpanId       string     `json:"spanId"`
+	ParentSpanId string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpAttr `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			Spans []*otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func NewOTLPExporter(endpoint string) (*OTLPExporter, error) {
+	if len(endpoint) == 0 {
+		return nil, fmt.Errorf("trace endpoint is empty")
+	}
+	return &OTLPExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: time.Second * 5},
+	}, nil
+}
+
+func (e *OTLPExporter) Export(service string, spans []*Span) error {
+	var req otlpRequest
+	req.ResourceSpans = make([]struct {
+		Resource struct {
+			Attributes []otlpAttr `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			Spans []*otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	}, 1)
+	rs := &req.ResourceSpans[0]
+	rs.Resource.Attributes = []otlpAttr{{"service.name", otlpValue{service}}}
+	rs.ScopeSpans = make([]struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []*otlpSpan `json:"spans"`
+	}, 1)
+	ss := &rs.ScopeSpans[0]
+	ss.Scope.Name = "kingtask"
+	for _, s := range spans {
+		sp := &otlpSpan{
+			TraceId: hex.EncodeToString(s.Context.TraceId[:]),
+			SpanId:  hex.EncodeToString(s.Context.SpanId[:]),
+			Name:    s.Name,
+			Kind:    s.Kind,
+			Start:   strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.End.UnixNano(), 10),
+			Status:  otlpStatus{Code: 1},
+		}
+		if s.ParentId != [8]byte{} {
+			sp.ParentSpanId = hex.EncodeToString(s.ParentId[:])
+		}
+		for _, a := range s.Attrs {
+			sp.Attributes = append(sp.Attributes, otlpAttr{a.Key, otlpValue{a.Value}})
+		}
+		if len(s.Error) != 0 {
+			sp.Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		ss.Spans = append(ss.Spans, sp)
+	}
+
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+		return fmt.Errorf("otlp endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) Close() error {
+	return nil
+}
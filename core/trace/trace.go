@@ -0,0 +1,256 @@
+//W3C trace context的传递和span的记录。没有配置导出方式时只传递traceparent，不记录span
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flike/golog"
+)
+
+//span的类型，与OTLP中的取值一致
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+	KindProducer = 4
+	KindConsumer = 5
+)
+
+//子进程环境变量中的trace context
+const EnvTraceparent = "TRACEPARENT"
+
+const (
+	flagSampled = 0x01
+	//批量导出的span数和间隔
+	exportBatch    = 100
+	exportInterval = time.Second
+	queueSize      = 4096
+)
+
+type SpanContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+	Flags   byte
+}
+
+//解析traceparent，格式为 00-<trace-id>-<parent-id>-<flags>，无效时返回false
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	//版本00只有4个部分，更高的版本允许在后面追加
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceId[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanId[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, false
+	}
+	return sc, true
+}
+
+//trace id和span id都不能全为0
+func (c SpanContext) IsValid() bool {
+	return c.TraceId != [16]byte{} && c.SpanId != [8]byte{}
+}
+
+func (c SpanContext) Sampled() bool {
+	return c.Flags&flagSampled != 0
+}
+
+func (c SpanContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(c.TraceId[:]) + "-" +
+		hex.EncodeToString(c.SpanId[:]) + "-" + hex.EncodeToString([]byte{c.Flags})
+}
+
+type Attr struct {
+	Key   string
+	Value string
+}
+
+type Span struct {
+	tracer   *Tracer
+	Context  SpanContext
+	ParentId [8]byte //为0时是根span
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	Attrs    []Attr
+	Error    string
+	ended    bool
+}
+
+func (s *Span) SetAttr(key, value string) {
+	s.Attrs = append(s.Attrs, Attr{key, value})
+}
+
+//err为空时不改变状态
+func (s *Span) SetError(err error) {
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+func (s *Span) Traceparent() string {
+	return s.Context.Traceparent()
+}
+
+//结束span并交给导出，重复调用只导出一次
+func (s *Span) Finish() {
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.tracer.export(s)
+}
+
+//将span导出到文件或者OTLP接收端
+type Exporter interface {
+	Export(service string, spans []*Span) error
+	Close() error
+}
+
+type Tracer struct {
+	service  string
+	exporter Exporter
+	spans    chan *Span
+	wg       sync.WaitGroup
+	once     sync.Once
+	closed   chan struct{}
+}
+
+//exporter为空时不记录span，只传递trace context
+func NewTracer(service string, exporter Exporter) *Tracer {
+	t := &Tracer{
+		service:  service,
+		exporter: exporter,
+		closed:   make(chan struct{}),
+	}
+	if exporter != nil {
+		t.spans = make(chan *Span, queueSize)
+		t.wg.Add(1)
+		go t.run()
+	}
+	return t
+}
+
+//开始一个span，parent为上游的traceparent，为空或者无效时开始新的trace
+func (t *Tracer) Start(name string, kind int, parent string) *Span {
+	s := &Span{
+		tracer: t,
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+	}
+	if pc, ok := ParseTraceparent(parent); ok {
+		s.Context.TraceId = pc.TraceId
+		s.Context.Flags = pc.Flags
+		s.ParentId = pc.SpanId
+	} else {
+		randomId(s.Context.TraceId[:])
+		s.Context.Flags = flagSampled
+	}
+	randomId(s.Context.SpanId[:])
+	return s
+}
+
+func randomId(b []byte) {
+	for {
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		for _, c := range b {
+			if c != 0 {
+				return
+			}
+		}
+	}
+}
+
+//导出队列满时丢弃span，不阻塞任务的处理
+func (t *Tracer) export(s *Span) {
+	if t == nil || t.exporter == nil || !s.Context.Sampled() {
+		return
+	}
+	select {
+	case <-t.closed:
+	case t.spans <- s:
+	default:
+		golog.Warn("Tracer", "export", "span queue is full, drop span", 0, "name", s.Name)
+	}
+}
+
+func (t *Tracer) run() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(t.service, batch); err != nil {
+			golog.Error("Tracer", "run", "export spans error", 0,
+				"count", len(batch),
+				"err", err.Error())
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if exportBatch <= len(batch) {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.closed:
+			//导出剩余的span
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+//导出剩余的span后关闭导出
+func (t *Tracer) Close() error {
+	if t == nil || t.exporter == nil {
+		return nil
+	}
+	var err error
+	t.once.Do(func() {
+		close(t.closed)
+		t.wg.Wait()
+		err = t.exporter.Close()
+	})
+	return err
+}
@@ -0,0 +1,161 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(tp)
+	if !ok || !sc.Sampled() || sc.Traceparent() != tp {
+		t.Fatalf("parse %s: %v %+v", tp, ok, sc)
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-ab",
+	}
+	for _, s := range invalid {
+		if _, ok := ParseTraceparent(s); ok {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+type memExporter struct {
+	spans []*Span
+}
+
+func (e *memExporter) Export(service string, spans []*Span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memExporter) Close() error {
+	return nil
+}
+
+func TestSpanParent(t *testing.T) {
+	exporter := new(memExporter)
+	tracer := NewTracer("test", exporter)
+	root := tracer.Start("root", KindProducer, "")
+	child := tracer.Start("child", KindConsumer, root.Traceparent())
+	if child.Context.TraceId != root.Context.TraceId {
+		t.Fatal("child should share the trace id")
+	}
+	if child.ParentId != root.Context.SpanId || root.ParentId != [8]byte{} {
+		t.Fatal("parent span id mismatch")
+	}
+	child.SetError(errors.New("exit status 1"))
+	child.Finish()
+	child.Finish()
+	root.Finish()
+	tracer.Close()
+	if len(exporter.spans) != 2 || exporter.spans[0].Error != "exit status 1" {
+		t.Fatalf("exported %d spans", len(exporter.spans))
+	}
+
+	//未采样的span不导出
+	exporter = new(memExporter)
+	tracer = NewTracer("test", exporter)
+	tracer.Start("skip", KindInternal, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00").Finish()
+	tracer.Close()
+	if len(exporter.spans) != 0 {
+		t.Fatal("unsampled span exported")
+	}
+
+	//没有导出时只传递trace context
+	var nilTracer *Tracer
+	s := nilTracer.Start("noop", KindInternal, "")
+	s.Finish()
+	if !s.Context.IsValid() || nilTracer.Close() != nil {
+		t.Fatal("nil tracer")
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+
+	exporter, err := NewExporter(ExporterFile, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer("kingtask-test", exporter)
+	s := tracer.Start("kingtask.execute", KindInternal, "")
+	s.SetAttr("uuid", "abc")
+	s.Finish()
+	tracer.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("no span written")
+	}
+	var fs fileSpan
+	if err := json.Unmarshal(scanner.Bytes(), &fs); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Service != "kingtask-test" || fs.Name != "kingtask.execute" ||
+		fs.Attrs["uuid"] != "abc" || len(fs.TraceId) != 32 || len(fs.ParentId) != 0 {
+		t.Fatalf("bad span %+v", fs)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer server.Close()
+
+	exporter, err := NewExporter(ExporterOTLP, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer("kingtask-test", exporter)
+	s := tracer.Start("kingtask.enqueue", KindProducer, "")
+	s.SetError(errors.New("queue is full"))
+	s.Finish()
+	tracer.Close()
+
+	var req otlpRequest
+	if err := json.Unmarshal(<-bodies, &req); err != nil {
+		t.Fatal(err)
+	}
+	rs := req.ResourceSpans[0]
+	if rs.Resource.Attributes[0].Value.StringValue != "kingtask-test" {
+		t.Fatalf("bad resource %+v", rs.Resource)
+	}
+	sp := rs.ScopeSpans[0].Spans[0]
+	if sp.Name != "kingtask.enqueue" || sp.Kind != KindProducer || sp.Status.Code != 2 ||
+		sp.TraceId != s.Traceparent()[3:35] {
+		t.Fatalf("bad span %+v", sp)
+	}
+
+	if _, err := NewExporter("zipkin", ""); err == nil {
+		t.Fatal("unknown exporter should fail")
+	}
+}
@@ -0,0 +1,1652 @@
+//基于本地目录的任务存储，适用于broker和worker部署在同一台机器上、没有redis的场景。
+//所有状态变更以追加方式写入预写日志(WAL)并fsync，进程重启后通过重放日志恢复；
+//日志定期压缩成一条快照记录。多个进程通过文件锁串行化对日志的访问。
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/flike/golog"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+const (
+	walFileName      = "task.wal"
+	walTmpFileName   = "task.wal.tmp"
+	lockFileName     = "task.lock"
+	recordHeaderSize = 8
+	maxRecordSize    = 64 * 1024 * 1024
+)
+
+const (
+	opAddRequest = "add_request"
+	opAddOnce    = "add_request_once"
+	opPopRequest = "pop_request"
+	opSetResult  = "set_result"
+	opPopFail    = "pop_fail"
+	opRequeue    = "requeue"
+	opAcquire    = "acquire_slot"
+	opRelease    = "release_slot"
+	opDefer      = "defer_request"
+	opTakeToken  = "take_token"
+	opDelRequest = "del_request"
+	opSetFlow    = "set_workflow"
+	opAckNotify  = "ack_notify"
+	opCallback   = "set_callback"
+	opProgress   = "set_progress"
+	opAppendLog  = "append_log"
+	opSetState   = "set_state"
+	opRetry      = "retry_request"
+	opSchedule   = "schedule_request"
+	opHeartbeat  = "heartbeat"
+	opSnapshot   = "snapshot"
+)
+
+type walRecord struct {
+	Op       string               `json:"op"`
+	Uuid     string               `json:"uuid,omitempty"`
+	Uuids    []string             `json:"uuids,omitempty"`
+	Key      string               `json:"key,omitempty"`
+	Tokens   float64              `json:"tokens,omitempty"`
+	Ts       int64                `json:"ts,omitempty"`
+	Request  *task.TaskRequest    `json:"request,omitempty"`
+	Result   *task.TaskResult     `json:"result,omitempty"`
+	Workflow *task.Workflow       `json:"workflow,omitempty"`
+	Callback *task.CallbackStatus `json:"callback,omitempty"`
+	Progress *task.Progress       `json:"progress,omitempty"`
+	Worker   *task.WorkerInfo     `json:"worker,omitempty"`
+	Logs     []*task.LogLine      `json:"logs,omitempty"`
+	Limit    int                  `json:"limit,omitempty"`
+	ExpireAt int64                `json:"expire_at,omitempty"`
+	Snapshot *fileSnapshot        `json:"snapshot,omitempty"`
+	At       int64                `json:"at,omitempty"`
+}
+
+type fileResult struct {
+	Result   *task.TaskResult `json:"result"`
+	ExpireAt int64            `json:"expire_at"` //过期时间，单位纳秒
+}
+
+type fileRunning struct {
+	Request  *task.TaskRequest `json:"request"`
+	Deadline int64             `json:"deadline"` //租约到期时间，单位纳秒
+}
+
+type fileIdempotency struct {
+	Key      string `json:"key"`
+	Uuid     string `json:"uuid"`
+	ExpireAt int64  `json:"expire_at"`
+}
+
+type fileSlot struct {
+	Key      string `json:"key"`
+	Holder   string `json:"holder"`
+	ExpireAt int64  `json:"expire_at"`
+}
+
+type fileBucket struct {
+	Key      string  `json:"key"`
+	Tokens   float64 `json:"tokens"`
+	Ts       int64   `json:"ts"`
+	ExpireAt int64   `json:"expire_at"`
+}
+
+type fileWorkflow struct {
+	Workflow *task.Workflow `json:"workflow"`
+	ExpireAt int64          `json:"expire_at"` //为0时不过期
+}
+
+type fileCallback struct {
+	Status   *task.CallbackStatus `json:"status"`
+	ExpireAt int64                `json:"expire_at"`
+}
+
+type fileProgress struct {
+	Progress *task.Progress `json:"progress"`
+	ExpireAt int64          `json:"expire_at"`
+}
+
+type fileStatus struct {
+	Status   *task.TaskStatus `json:"status"`
+	ExpireAt int64            `json:"expire_at"` //为0时不过期
+}
+
+type fileLog struct {
+	Uuid     string          `json:"uuid"`
+	Seq      int64           `json:"seq"` //已分配的最大序号
+	Lines    []*task.LogLine `json:"lines"`
+	ExpireAt int64           `json:"expire_at"`
+}
+
+//需要broker处理的已结束任务，按完成顺序排列
+type fileNotify struct {
+	uuids map[string]bool
+	list  []string
+}
+
+type fileSnapshot struct {
+	Requests    []*task.TaskRequest `json:"requests"`
+	Running     []*fileRunning      `json:"running"`
+	Results     []*fileResult       `json:"results"`
+	FailUuids   []string            `json:"fail_uuids"`
+	Idempotency []*fileIdempotency  `json:"idempotency"`
+	Slots       []*fileSlot         `json:"slots"`
+	Buckets     []*fileBucket       `json:"buckets"`
+	Workflows   []*fileWorkflow     `json:"workflows"`
+	Notify      map[string][]string `json:"notify"`
+	Callbacks   []*fileCallback     `json:"callbacks"`
+	Progress    []*fileProgress     `json:"progress"`
+	Logs        []*fileLog          `json:"logs"`
+	Statuses    []*fileStatus       `json:"statuses"`
+	Workers     []*workerEntry      `json:"workers"`
+}
+
+//写日志文件，测试中替换以模拟写入过程中出错
+var writeWal = func(f *os.File, buf []byte) (int, error) {
+	return f.Write(buf)
+}
+
+type FileStore struct {
+	sync.Mutex
+	dir      string
+	walPath  string
+	wal      *os.File
+	lockFile *os.File
+	offset   int64 //已经重放的日志长度
+	closed   bool
+	quit     chan struct{}
+
+	//待执行队列，queues中可能残留已被取走的uuid，以requests为准
+	requests map[string]*task.TaskRequest
+	queues   map[string][]string
+	running  map[string]*fileRunning
+	results  map[string]*fileResult
+	fails    map[string]bool
+	failList []string
+	idems    map[string]*fileIdempotency
+	slots    map[string]map[string]int64 //并发键 -> 持有者 -> 租约到期时间
+	buckets  map[string]*fileBucket
+	flows    map[string]*fileWorkflow
+	notify   map[string]*fileNotify
+	callback map[string]*fileCallback
+	progress map[string]*fileProgress
+	logs     map[string]*fileLog
+	status   map[string]*fileStatus
+	//任务状态的索引，与redis中的索引名相同：state:<状态>、bin:<可执行文件>、queue:<队列>
+	index   map[string]map[string]bool
+	workers map[string]*workerEntry
+
+	watchers map[*fileWatcher]bool
+}
+
+func NewFileStore(dir string, compactInterval time.Duration) (*FileStore, error) {
+	if len(dir) == 0 {
+		return nil, errors.ErrInvalidArgument
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(FileStore)
+	s.dir = dir
+	s.walPath = path.Join(dir, walFileName)
+	s.quit = make(chan struct{})
+	s.watchers = make(map[*fileWatcher]bool)
+	s.reset()
+
+	s.lockFile, err = os.OpenFile(path.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = s.openWal()
+	if err != nil {
+		s.lockFile.Close()
+		return nil, err
+	}
+	//加载已有日志，同时截断崩溃时残留的不完整记录
+	err = s.withLock(func() error {
+		return s.catchUp()
+	})
+	if err != nil {
+		s.wal.Close()
+		s.lockFile.Close()
+		return nil, err
+	}
+
+	if 0 < compactInterval {
+		go s.compactLoop(compactInterval)
+	}
+	return s, nil
+}
+
+func (s *FileStore) AddRequest(r *task.TaskRequest) error {
+	return s.update(func() (*walRecord, error) {
+		return &walRecord{Op: opAddRequest, Request: r, Ts: time.Now().UnixNano()}, nil
+	})
+}
+
+func (s *FileStore) RetryRequest(r *task.TaskRequest) error {
+	return s.update(func() (*walRecord, error) {
+		return &walRecord{Op: opRetry, Request: r, Ts: time.Now().UnixNano()}, nil
+	})
+}
+
+func (s *FileStore) QueueDepths() (map[string]int64, error) {
+	depths := map[string]int64{config.DefaultQueue: 0}
+	err := s.update(func() (*walRecord, error) {
+		for _, r := range s.requests {
+			depths[queueName(r)]++
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return depths, nil
+}
+
+func (s *FileStore) Heartbeat(w *task.WorkerInfo, ttl time.Duration) error {
+	return s.update(func() (*walRecord, error) {
+		return &walRecord{
+			Op:       opHeartbeat,
+			Worker:   w,
+			ExpireAt: time.Now().Add(ttl).UnixNano(),
+		}, nil
+	})
+}
+
+func (s *FileStore) ListWorkers() ([]*task.WorkerInfo, error) {
+	var workers []*task.WorkerInfo
+	err := s.update(func() (*walRecord, error) {
+		now := time.Now().UnixNano()
+		for _, r := range s.workers {
+			if now < r.ExpireAt {
+				workers = append(workers, r.Worker)
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(workerList(workers))
+	return workers, nil
+}
+
+func (s *FileStore) PopRequest(queues []string, lease time.Duration) (*task.TaskRequest, error) {
+	var req *task.TaskRequest
+	err := s.update(func() (*walRecord, error) {
+		for _, queue := range queues {
+			list := s.queues[queue]
+			for len(list) != 0 {
+				uuid := list[0]
+				if r, ok := s.requests[uuid]; ok && queueName(r) == queue {
+					req = r
+					s.queues[queue] = list
+					now := time.Now()
+					return &walRecord{
+						Op:       opPopRequest,
+						Uuid:     uuid,
+						Ts:       now.UnixNano(),
+						ExpireAt: now.Add(lease).UnixNano(),
+					}, nil
+				}
+				list = list[1:]
+			}
+			s.queues[queue] = list
+		}
+		return nil, errors.ErrKeyNotExist
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (s *FileStore) SetResult(r *task.TaskResult, keepTime time.Duration) error {
+	return s.update(func() (*walRecord, error) {
+		now := time.Now()
+		return &walRecord{
+			Op:       opSetResult,
+			Result:   r,
+			Ts:       now.UnixNano(),
+			ExpireAt: now.Add(keepTime).UnixNano(),
+		}, nil
+	})
+}
+
+func (s *FileStore) GetResult(uuid string) (*task.TaskResult, error) {
+	var result *task.TaskResult
+	err := s.update(func() (*walRecord, error) {
+		r, ok := s.results[uuid]
+		if !ok || r.expired(time.Now()) {
+			return nil, errors.ErrKeyNotExist
+		}
+		result = r.Result
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *FileStore) PopFailResult() (*task.TaskResult, error) {
+	var result *task.TaskResult
+	err := s.update(func() (*walRecord, error) {
+		now := time.Now()
+		for len(s.failList) != 0 {
+			uuid := s.failList[0]
+			if !s.fails[uuid] {
+				s.failList = s.failList[1:]
+				continue
+			}
+			r, ok := s.results[uuid]
+			//结果已经过期，跳过
+			if !ok || r.expired(now) {
+				delete(s.fails, uuid)
+				s.failList = s.failList[1:]
+				continue
+			}
+			result = r.Result
+			rec := &walRecord{Op: opPopFail, Uuid: uuid}
+			//下一次重试在同一条记录中写入执行中队列，broker崩溃也不会丢失
+			if next, at, ok := nextRetry(&r.Result.TaskRequest, now); ok {
+				rec.Request = next
+				rec.ExpireAt = at.UnixNano()
+			}
+			return rec, nil
+		}
+		return nil, errors.ErrKeyNotExist
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *FileStore) RequeueExpired() (int, error) {
+	var uuids []string
+	err := s.update(func() (*walRecord, error) {
+		now := time.Now().UnixNano()
+		for uuid, r := range s.running {
+			if r.Deadline <= now {
+				uuids = append(uuids, uuid)
+			}
+		}
+		if len(uuids) == 0 {
+			return nil, nil
+		}
+		return &walRecord{Op: opRequeue, Uuids: uuids, Ts: now}, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(uuids), nil
+}
+
+func (s *FileStore) ScheduleRequest(r *task.TaskRequest, at time.Time) error {
+	return s.update(func() (*walRecord, error) {
+		return &walRecord{
+			Op:       opSchedule,
+			Request:  r,
+			Ts:       time.Now().UnixNano(),
+			ExpireAt: at.UnixNano(),
+		}, nil
+	})
+}
+
+func (s *FileStore) AddRequestOnce(r *task.TaskRequest, window time.Duration, at time.Time) (string, error) {
+	ret := r.Uuid
+	err := s.update(func() (*walRecord, error) {
+		now := time.Now().UnixNano()
+		if idem, ok := s.idems[r.IdempotencyKey]; ok && now < idem.ExpireAt {
+			ret = idem.Uuid
+			return nil, nil
+		}
+		return &walRecord{
+			Op:       opAddOnce,
+			Request:  r,
+			Key:      r.IdempotencyKey,
+			Ts:       now,
+			ExpireAt: now + int64(window),
+			At:       at.UnixNano(),
+		}, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return ret, nil
+}
+
+func (s *FileStore) GetIdempotencyKey(key string) (string, error) {
+	var uuid string
+	err := s.update(func() (*walRecord, error) {
+		idem, ok := s.idems[key]
+		if !ok || idem.ExpireAt <= time.Now().UnixNano() {
+			return nil, errors.ErrKeyNotExist
+		}
+		uuid = idem.Uuid
+		return nil, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return uuid, nil
+}
+
+func (s *FileStore) AcquireSlot(key string, holder string, limit int, lease time.Duration) (bool, error) {
+	acquired := false
+	err := s.update(func() (*walRecord, error) {
+		now := time.Now().UnixNano()
+		count := 0
+		for h, expireAt := range s.slots[key] {
+			if h != holder && now < expireAt {
+				count++
+			}
+		}
+		if limit <= count {
+			return nil, nil
+		}
+		acquired = true
+		return &walRecord{
+			Op:       opAcquire,
+			Key:      key,
+			Uuid:     holder,
+			ExpireAt: now + int64(lease),
+		}, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return acquired, nil
+}
+
+func (s *FileStore) ReleaseSlot(key string, holder string) error {
+	return s.update(func() (*walRecord, error) {
+		if _, ok := s.slots[key][holder]; !ok {
+			return nil, nil
+		}
+		return &walRecord{Op: opRelease, Key: key, Uuid: holder}, nil
+	})
+}
+
+func (s *FileStore) DeferRequest(uuid string, delay time.Duration) error {
+	return s.update(func() (*walRecord, error) {
+		if _, ok := s.running[uuid]; !ok {
+			return nil, nil
+		}
+		now := time.Now()
+		return &walRecord{
+			Op:       opDefer,
+			Uuid:     uuid,
+			Ts:       now.UnixNano(),
+			ExpireAt: now.Add(delay).UnixNano(),
+		}, nil
+	})
+}
+
+func (s *FileStore) TakeToken(key string, limit int, period time.Duration) (time.Duration, error) {
+	var wait time.Duration
+	err := s.update(func() (*walRecord, error) {
+		now := time.Now().UnixNano()
+		capacity := float64(limit)
+		tokens := capacity
+		if b, ok := s.buckets[key]; ok && now < b.ExpireAt {
+			tokens = b.Tokens + float64(now-b.Ts)*capacity/float64(period)
+			if capacity < tokens {
+				tokens = capacity
+			}
+		}
+		if tokens < 1 {
+			wait = time.Duration((1 - tokens) * float64(period) / capacity)
+			return nil, nil
+		}
+		return &walRecord{
+			Op:       opTakeToken,
+			Key:      key,
+			Tokens:   tokens - 1,
+			Ts:       now,
+			ExpireAt: now + int64(period)*2,
+		}, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return wait, nil
+}
+
+func (s *FileStore) ReturnToken(key string, limit int, period time.Duration) error {
+	return s.update(func() (*walRecord, error) {
+		now := time.Now().UnixNano()
+		b, ok := s.buckets[key]
+		//桶已过期时令牌是满的
+		if !ok || b.ExpireAt <= now {
+			return nil, nil
+		}
+		capacity := float64(limit)
+		tokens := b.Tokens + float64(now-b.Ts)*capacity/float64(period) + 1
+		if capacity < tokens {
+			tokens = capacity
+		}
+		return &walRecord{
+			Op:       opTakeToken,
+			Key:      key,
+			Tokens:   tokens,
+			Ts:       now,
+			ExpireAt: now + int64(period)*2,
+		}, nil
+	})
+}
+
+func (s *FileStore) DelRequest(uuid string) (bool, error) {
+	deleted := false
+	err := s.update(func() (*walRecord, error) {
+		if _, ok := s.requests[uuid]; !ok {
+			return nil, nil
+		}
+		deleted = true
+		return &walRecord{Op: opDelRequest, Uuid: uuid, Ts: time.Now().UnixNano()}, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+func (s *FileStore) SetState(r *task.TaskRequest, state string) error {
+	return s.update(func() (*walRecord, error) {
+		return &walRecord{
+			Op:      opSetState,
+			Key:     state,
+			Request: r,
+			Ts:      time.Now().UnixNano(),
+		}, nil
+	})
+}
+
+//过期的状态只从内存中删除，重放日志后仍然是过期的，压缩时不再写入快照
+func (s *FileStore) PruneStatus(limit int) (int, error) {
+	n := 0
+	err := s.update(func() (*walRecord, error) {
+		now := time.Now()
+		for uuid, r := range s.status {
+			if limit <= n {
+				break
+			}
+			if r.expired(now) {
+				s.unindexStatus(r.Status)
+				delete(s.status, uuid)
+				n++
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *FileStore) GetStatus(uuid string) (*task.TaskStatus, error) {
+	var st task.TaskStatus
+	err := s.update(func() (*walRecord, error) {
+		r, ok := s.status[uuid]
+		if !ok || r.expired(time.Now()) {
+			return nil, errors.ErrKeyNotExist
+		}
+		//复制一份，避免调用者修改存储中的历史
+		st = *r.Status
+		st.History = append([]*task.StateChange(nil), r.Status.History...)
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	st.CheckExpired(time.Now().UnixNano() / int64(time.Millisecond))
+	return &st, nil
+}
+
+func (s *FileStore) ListTasks(q *task.TaskQuery) ([]*task.TaskStatus, string, error) {
+	var cursor *listCursor
+	if len(q.Cursor) != 0 {
+		var err error
+		cursor, err = parseListCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	limit := queryLimit(q)
+	var tasks []*task.TaskStatus
+	err := s.update(func() (*walRecord, error) {
+		now := time.Now()
+		index := queryIndex(q)
+		var uuids map[string]bool
+		if index != "all" {
+			uuids = s.index[index]
+		}
+		add := func(r *fileStatus) {
+			if r.expired(now) {
+				return
+			}
+			//复制一份，列表中不返回状态变更历史
+			st := *r.Status
+			st.History = nil
+			st.CheckExpired(now.UnixNano() / int64(time.Millisecond))
+			if matchQuery(q, &st) && (cursor == nil || cursor.before(statusCursor(&st))) {
+				tasks = append(tasks, &st)
+			}
+		}
+		if index == "all" {
+			for _, r := range s.status {
+				add(r)
+			}
+		}
+		for uuid := range uuids {
+			if r, ok := s.status[uuid]; ok {
+				add(r)
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Sort(statusList(tasks))
+	next := ""
+	if limit < len(tasks) {
+		tasks = tasks[:limit]
+		next = statusCursor(tasks[limit-1]).String()
+	}
+	return tasks, next, nil
+}
+
+func (s *FileStore) SetWorkflow(wf *task.Workflow, keepTime time.Duration) error {
+	return s.update(func() (*walRecord, error) {
+		rec := &walRecord{Op: opSetFlow, Workflow: wf}
+		if 0 < keepTime {
+			rec.ExpireAt = time.Now().Add(keepTime).UnixNano()
+		}
+		return rec, nil
+	})
+}
+
+func (s *FileStore) GetWorkflow(uuid string) (*task.Workflow, error) {
+	var wf *task.Workflow
+	err := s.update(func() (*walRecord, error) {
+		r, ok := s.flows[uuid]
+		if !ok || r.expired(time.Now()) {
+			return nil, errors.ErrKeyNotExist
+		}
+		wf = r.Workflow
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+func (s *FileStore) RunningWorkflows() ([]string, error) {
+	var uuids []string
+	err := s.update(func() (*walRecord, error) {
+		for uuid, r := range s.flows {
+			if r.ExpireAt == 0 {
+				uuids = append(uuids, uuid)
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return uuids, nil
+}
+
+func (s *FileStore) NextNotify(kind string, count int) ([]*task.TaskResult, error) {
+	var results []*task.TaskResult
+	err := s.update(func() (*walRecord, error) {
+		n, ok := s.notify[kind]
+		if !ok {
+			return nil, errors.ErrKeyNotExist
+		}
+		now := time.Now()
+		for _, uuid := range n.list {
+			if len(results) == count {
+				break
+			}
+			if r, ok := s.results[uuid]; ok && !r.expired(now) {
+				results = append(results, r.Result)
+			}
+		}
+		if len(results) == 0 {
+			return nil, errors.ErrKeyNotExist
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *FileStore) AckNotify(kind string, uuid string) error {
+	return s.update(func() (*walRecord, error) {
+		if n, ok := s.notify[kind]; !ok || !n.uuids[uuid] {
+			return nil, nil
+		}
+		return &walRecord{Op: opAckNotify, Key: kind, Uuid: uuid}, nil
+	})
+}
+
+func (s *FileStore) SetCallback(st *task.CallbackStatus, keepTime time.Duration) error {
+	return s.update(func() (*walRecord, error) {
+		return &walRecord{
+			Op:       opCallback,
+			Callback: st,
+			ExpireAt: time.Now().Add(keepTime).UnixNano(),
+		}, nil
+	})
+}
+
+func (s *FileStore) GetCallback(uuid string) (*task.CallbackStatus, error) {
+	var st *task.CallbackStatus
+	err := s.update(func() (*walRecord, error) {
+		r, ok := s.callback[uuid]
+		if !ok || r.ExpireAt <= time.Now().UnixNano() {
+			return nil, errors.ErrKeyNotExist
+		}
+		st = r.Status
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *FileStore) SetProgress(p *task.Progress, keepTime time.Duration) error {
+	return s.update(func() (*walRecord, error) {
+		return &walRecord{
+			Op:       opProgress,
+			Progress: p,
+			ExpireAt: time.Now().Add(keepTime).UnixNano(),
+		}, nil
+	})
+}
+
+func (s *FileStore) GetProgress(uuid string) (*task.Progress, error) {
+	var p *task.Progress
+	err := s.update(func() (*walRecord, error) {
+		r, ok := s.progress[uuid]
+		if !ok || r.ExpireAt <= time.Now().UnixNano() {
+			return nil, errors.ErrKeyNotExist
+		}
+		p = r.Progress
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *FileStore) AppendLogs(uuid string, lines []*task.LogLine, maxLines int, keepTime time.Duration) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	return s.update(func() (*walRecord, error) {
+		return &walRecord{
+			Op:       opAppendLog,
+			Uuid:     uuid,
+			Logs:     lines,
+			Limit:    maxLines,
+			ExpireAt: time.Now().Add(keepTime).UnixNano(),
+		}, nil
+	})
+}
+
+func (s *FileStore) GetLogs(uuid string, from int64, count int) ([]*task.LogLine, int64, error) {
+	var lines []*task.LogLine
+	next := from
+	err := s.update(func() (*walRecord, error) {
+		l, ok := s.logs[uuid]
+		if !ok || l.ExpireAt <= time.Now().UnixNano() {
+			return nil, nil
+		}
+		for _, line := range l.Lines {
+			if count <= len(lines) {
+				break
+			}
+			if from <= line.Seq {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) != 0 {
+			next = lines[len(lines)-1].Seq + 1
+		} else if len(l.Lines) != 0 && next < l.Lines[0].Seq {
+			next = l.Lines[0].Seq
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return lines, next, nil
+}
+
+//其它进程写入的结果在重放日志时通知，定期同步日志以便及时发现
+func (s *FileStore) WatchResults() (ResultWatcher, error) {
+	w := &fileWatcher{
+		store: s,
+		uuids: make(chan string, 1024),
+		quit:  make(chan struct{}),
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil, errors.ErrStoreClosed
+	}
+	s.watchers[w] = true
+	go w.run()
+	return w, nil
+}
+
+//将当前状态写成一条快照记录替换原日志，过期的结果被丢弃
+func (s *FileStore) Compact() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return errors.ErrStoreClosed
+	}
+
+	return s.withLock(func() error {
+		err := s.catchUp()
+		if err != nil {
+			return err
+		}
+		buf, err := encodeRecord(&walRecord{Op: opSnapshot, Snapshot: s.snapshot()})
+		if err != nil {
+			return err
+		}
+
+		tmpPath := path.Join(s.dir, walTmpFileName)
+		tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(buf)
+		if err == nil {
+			err = tmp.Sync()
+		}
+		tmp.Close()
+		if err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		err = os.Rename(tmpPath, s.walPath)
+		if err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		err = syncDir(s.dir)
+		if err != nil {
+			return err
+		}
+
+		s.wal.Close()
+		err = s.openWal()
+		if err != nil {
+			return err
+		}
+		s.offset = int64(len(buf))
+		return nil
+	})
+}
+
+func (s *FileStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.quit)
+	for w := range s.watchers {
+		close(w.uuids)
+	}
+	s.watchers = nil
+	s.lockFile.Close()
+	return s.wal.Close()
+}
+
+func (s *FileStore) compactLoop(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			err := s.Compact()
+			if err != nil && err != errors.ErrStoreClosed {
+				golog.Error("FileStore", "compactLoop", err.Error(), 0, "dir", s.dir)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+//在进程锁和文件锁的保护下同步日志，fn根据最新状态生成需要追加的记录
+func (s *FileStore) update(fn func() (*walRecord, error)) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return errors.ErrStoreClosed
+	}
+
+	return s.withLock(func() error {
+		err := s.catchUp()
+		if err != nil {
+			return err
+		}
+		rec, err := fn()
+		if err != nil || rec == nil {
+			return err
+		}
+		return s.appendRecord(rec)
+	})
+}
+
+func (s *FileStore) withLock(fn func() error) error {
+	err := lockFile(s.lockFile)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(s.lockFile)
+	return fn()
+}
+
+func (s *FileStore) openWal() error {
+	var err error
+	s.wal, err = os.OpenFile(s.walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	return err
+}
+
+//重放其它进程追加的日志，调用时必须持有文件锁
+func (s *FileStore) catchUp() error {
+	fi, err := os.Stat(s.walPath)
+	if err != nil {
+		return err
+	}
+	cur, err := s.wal.Stat()
+	if err != nil {
+		return err
+	}
+	//日志已被其它进程压缩替换，重新加载
+	if !os.SameFile(fi, cur) {
+		s.wal.Close()
+		err = s.openWal()
+		if err != nil {
+			return err
+		}
+		s.reset()
+		s.offset = 0
+	}
+	if fi.Size() == s.offset {
+		return nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(s.wal, s.offset, fi.Size()-s.offset))
+	for {
+		rec, n, err := decodeRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		//持有文件锁时没有其它进程在写，不完整的记录是写入过程中进程崩溃留下的
+		if err == io.ErrUnexpectedEOF || err == errors.ErrCorruptedLog {
+			golog.Warn("FileStore", "catchUp", "truncate broken record", 0,
+				"path", s.walPath,
+				"offset", s.offset,
+				"size", fi.Size(),
+			)
+			return s.truncate()
+		}
+		if err != nil {
+			return err
+		}
+		s.apply(rec)
+		s.offset += n
+	}
+}
+
+func (s *FileStore) appendRecord(rec *walRecord) error {
+	buf, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	_, err = writeWal(s.wal, buf)
+	if err == nil {
+		err = s.wal.Sync()
+	}
+	if err != nil {
+		//写入失败时回滚，避免留下不完整的记录
+		s.truncate()
+		return err
+	}
+	s.apply(rec)
+	s.offset += int64(len(buf))
+	return nil
+}
+
+func (s *FileStore) truncate() error {
+	err := s.wal.Truncate(s.offset)
+	if err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+func (s *FileStore) reset() {
+	s.requests = make(map[string]*task.TaskRequest)
+	s.queues = make(map[string][]string)
+	s.running = make(map[string]*fileRunning)
+	s.results = make(map[string]*fileResult)
+	s.fails = make(map[string]bool)
+	s.failList = nil
+	s.idems = make(map[string]*fileIdempotency)
+	s.slots = make(map[string]map[string]int64)
+	s.buckets = make(map[string]*fileBucket)
+	s.flows = make(map[string]*fileWorkflow)
+	s.notify = make(map[string]*fileNotify)
+	s.callback = make(map[string]*fileCallback)
+	s.progress = make(map[string]*fileProgress)
+	s.logs = make(map[string]*fileLog)
+	s.status = make(map[string]*fileStatus)
+	s.index = make(map[string]map[string]bool)
+	s.workers = make(map[string]*workerEntry)
+}
+
+//记录任务的状态变更，ts单位为纳秒，r不为空时更新任务的基本信息
+func (s *FileStore) setState(uuid string, r *task.TaskRequest, state string, ts int64) *task.TaskStatus {
+	ms := ts / int64(time.Millisecond)
+	fs, ok := s.status[uuid]
+	if !ok {
+		fs = &fileStatus{Status: &task.TaskStatus{Uuid: uuid, SubmitTime: ms}}
+		s.status[uuid] = fs
+	}
+	st := fs.Status
+	s.unindexStatus(st)
+	if r != nil {
+		st.BinName = r.BinName
+		st.Queue = r.Queue
+		st.Workflow = r.Workflow
+		st.Attempt = r.Index
+	}
+	st.State = state
+	st.UpdateTime = ms
+	st.ResultExpireAt = 0
+	st.History = append(st.History, &task.StateChange{State: state, Time: ms})
+	if maxStateHistory < len(st.History) {
+		st.History = append([]*task.StateChange(nil), st.History[len(st.History)-maxStateHistory:]...)
+	}
+	fs.ExpireAt = 0
+	if task.IsFinalState(state) {
+		fs.ExpireAt = ts + int64(statusKeep)
+	}
+	s.indexStatus(st)
+	return st
+}
+
+func statusIndexes(st *task.TaskStatus) []string {
+	queue := st.Queue
+	if len(queue) == 0 {
+		queue = config.DefaultQueue
+	}
+	return []string{"state:" + st.State, "bin:" + st.BinName, "queue:" + queue}
+}
+
+func (s *FileStore) indexStatus(st *task.TaskStatus) {
+	for _, name := range statusIndexes(st) {
+		uuids, ok := s.index[name]
+		if !ok {
+			uuids = make(map[string]bool)
+			s.index[name] = uuids
+		}
+		uuids[st.Uuid] = true
+	}
+}
+
+func (s *FileStore) unindexStatus(st *task.TaskStatus) {
+	for _, name := range statusIndexes(st) {
+		delete(s.index[name], st.Uuid)
+		if len(s.index[name]) == 0 {
+			delete(s.index, name)
+		}
+	}
+}
+
+func (s *FileStore) apply(rec *walRecord) {
+	switch rec.Op {
+	case opAddRequest:
+		if rec.Request == nil {
+			return
+		}
+		s.pushRequest(rec.Request)
+		s.setState(rec.Request.Uuid, rec.Request, task.StateQueued, rec.Ts)
+	case opAddOnce:
+		if rec.Request == nil {
+			return
+		}
+		s.idems[rec.Key] = &fileIdempotency{
+			Key:      rec.Key,
+			Uuid:     rec.Request.Uuid,
+			ExpireAt: rec.ExpireAt,
+		}
+		if rec.Ts < rec.At {
+			s.running[rec.Request.Uuid] = &fileRunning{
+				Request:  rec.Request,
+				Deadline: rec.At,
+			}
+			s.setState(rec.Request.Uuid, rec.Request, task.StateScheduled, rec.Ts)
+		} else {
+			s.pushRequest(rec.Request)
+			s.setState(rec.Request.Uuid, rec.Request, task.StateQueued, rec.Ts)
+		}
+	case opPopRequest:
+		r, ok := s.requests[rec.Uuid]
+		if !ok {
+			return
+		}
+		delete(s.requests, rec.Uuid)
+		queue := queueName(r)
+		if list := s.queues[queue]; len(list) != 0 && list[0] == rec.Uuid {
+			s.queues[queue] = list[1:]
+		}
+		s.running[rec.Uuid] = &fileRunning{
+			Request:  r,
+			Deadline: rec.ExpireAt,
+		}
+		s.setState(rec.Uuid, nil, task.StateRunning, rec.Ts)
+	case opSetResult:
+		if rec.Result == nil {
+			return
+		}
+		st := s.setState(rec.Result.Uuid, &rec.Result.TaskRequest, rec.Result.State(), rec.Ts)
+		st.ResultExpireAt = rec.ExpireAt / int64(time.Millisecond)
+		s.results[rec.Result.Uuid] = &fileResult{
+			Result:   rec.Result,
+			ExpireAt: rec.ExpireAt,
+		}
+		if rec.Result.IsSuccess == int64(0) {
+			s.addFail(rec.Result.Uuid)
+		}
+		for _, kind := range notifyKinds(rec.Result) {
+			s.addNotify(kind, rec.Result.Uuid)
+		}
+		for w := range s.watchers {
+			select {
+			case w.uuids <- rec.Result.Uuid:
+			default:
+			}
+		}
+		//任务结束，被重新放回队列的同一任务也一并删除
+		delete(s.running, rec.Result.Uuid)
+		delete(s.requests, rec.Result.Uuid)
+	case opPopFail:
+		delete(s.fails, rec.Uuid)
+		if len(s.failList) != 0 && s.failList[0] == rec.Uuid {
+			s.failList = s.failList[1:]
+		}
+		//还会重试的任务删除结果，到重试时间后放回待执行队列
+		if r, ok := s.results[rec.Uuid]; ok && r.Result.HasRetry() {
+			delete(s.results, rec.Uuid)
+			if rec.Request != nil {
+				s.running[rec.Uuid] = &fileRunning{
+					Request:  rec.Request,
+					Deadline: rec.ExpireAt,
+				}
+			}
+		}
+	case opRequeue:
+		for _, uuid := range rec.Uuids {
+			r, ok := s.running[uuid]
+			if !ok {
+				continue
+			}
+			delete(s.running, uuid)
+			//等待期间已被取消或者所属工作流已结束的任务直接丢弃
+			if fs, ok := s.status[uuid]; ok && task.IsFinalState(fs.Status.State) {
+				continue
+			}
+			s.pushRequest(r.Request)
+			s.setState(uuid, nil, task.StateQueued, rec.Ts)
+		}
+	case opAcquire:
+		s.addSlot(rec.Key, rec.Uuid, rec.ExpireAt)
+	case opRelease:
+		delete(s.slots[rec.Key], rec.Uuid)
+		if len(s.slots[rec.Key]) == 0 {
+			delete(s.slots, rec.Key)
+		}
+	case opDefer:
+		if r, ok := s.running[rec.Uuid]; ok {
+			r.Deadline = rec.ExpireAt
+			s.setState(rec.Uuid, nil, task.StateQueued, rec.Ts)
+		}
+	case opSchedule:
+		if rec.Request == nil {
+			return
+		}
+		s.running[rec.Request.Uuid] = &fileRunning{
+			Request:  rec.Request,
+			Deadline: rec.ExpireAt,
+		}
+	case opTakeToken:
+		s.buckets[rec.Key] = &fileBucket{
+			Key:      rec.Key,
+			Tokens:   rec.Tokens,
+			Ts:       rec.Ts,
+			ExpireAt: rec.ExpireAt,
+		}
+	case opDelRequest:
+		if _, ok := s.requests[rec.Uuid]; ok {
+			delete(s.requests, rec.Uuid)
+			s.setState(rec.Uuid, nil, task.StateCancelled, rec.Ts)
+		}
+	case opRetry:
+		if rec.Request == nil {
+			return
+		}
+		delete(s.results, rec.Request.Uuid)
+		delete(s.fails, rec.Request.Uuid)
+		s.pushRequest(rec.Request)
+		s.setState(rec.Request.Uuid, rec.Request, task.StateQueued, rec.Ts)
+	case opHeartbeat:
+		if rec.Worker == nil {
+			return
+		}
+		s.workers[rec.Worker.Id] = &workerEntry{Worker: rec.Worker, ExpireAt: rec.ExpireAt}
+	case opSetState:
+		if rec.Request == nil {
+			return
+		}
+		s.setState(rec.Request.Uuid, rec.Request, rec.Key, rec.Ts)
+	case opSetFlow:
+		if rec.Workflow == nil {
+			return
+		}
+		s.flows[rec.Workflow.Uuid] = &fileWorkflow{
+			Workflow: rec.Workflow,
+			ExpireAt: rec.ExpireAt,
+		}
+	case opAckNotify:
+		n, ok := s.notify[rec.Key]
+		if !ok {
+			return
+		}
+		delete(n.uuids, rec.Uuid)
+		for i, uuid := range n.list {
+			if uuid == rec.Uuid {
+				n.list = append(n.list[:i:i], n.list[i+1:]...)
+				break
+			}
+		}
+	case opCallback:
+		if rec.Callback == nil {
+			return
+		}
+		s.callback[rec.Callback.Uuid] = &fileCallback{
+			Status:   rec.Callback,
+			ExpireAt: rec.ExpireAt,
+		}
+	case opProgress:
+		if rec.Progress == nil {
+			return
+		}
+		s.progress[rec.Progress.Uuid] = &fileProgress{
+			Progress: rec.Progress,
+			ExpireAt: rec.ExpireAt,
+		}
+	case opAppendLog:
+		l, ok := s.logs[rec.Uuid]
+		if !ok {
+			l = &fileLog{Uuid: rec.Uuid}
+			s.logs[rec.Uuid] = l
+		}
+		for _, line := range rec.Logs {
+			l.Seq++
+			line.Seq = l.Seq
+			l.Lines = append(l.Lines, line)
+		}
+		if 0 < rec.Limit && rec.Limit < len(l.Lines) {
+			l.Lines = append([]*task.LogLine(nil), l.Lines[len(l.Lines)-rec.Limit:]...)
+		}
+		l.ExpireAt = rec.ExpireAt
+	case opSnapshot:
+		s.reset()
+		if rec.Snapshot == nil {
+			return
+		}
+		for _, r := range rec.Snapshot.Requests {
+			s.pushRequest(r)
+		}
+		for _, r := range rec.Snapshot.Running {
+			s.running[r.Request.Uuid] = r
+		}
+		for _, r := range rec.Snapshot.Results {
+			s.results[r.Result.Uuid] = r
+		}
+		for _, uuid := range rec.Snapshot.FailUuids {
+			s.addFail(uuid)
+		}
+		for _, r := range rec.Snapshot.Idempotency {
+			s.idems[r.Key] = r
+		}
+		for _, r := range rec.Snapshot.Slots {
+			s.addSlot(r.Key, r.Holder, r.ExpireAt)
+		}
+		for _, r := range rec.Snapshot.Buckets {
+			s.buckets[r.Key] = r
+		}
+		for _, r := range rec.Snapshot.Workflows {
+			s.flows[r.Workflow.Uuid] = r
+		}
+		for kind, uuids := range rec.Snapshot.Notify {
+			for _, uuid := range uuids {
+				s.addNotify(kind, uuid)
+			}
+		}
+		for _, r := range rec.Snapshot.Callbacks {
+			s.callback[r.Status.Uuid] = r
+		}
+		for _, r := range rec.Snapshot.Progress {
+			s.progress[r.Progress.Uuid] = r
+		}
+		for _, r := range rec.Snapshot.Logs {
+			s.logs[r.Uuid] = r
+		}
+		for _, r := range rec.Snapshot.Statuses {
+			s.status[r.Status.Uuid] = r
+			s.indexStatus(r.Status)
+		}
+		for _, r := range rec.Snapshot.Workers {
+			s.workers[r.Worker.Id] = r
+		}
+	default:
+		golog.Warn("FileStore", "apply", "unknown op", 0, "op", rec.Op)
+	}
+}
+
+func (s *FileStore) pushRequest(r *task.TaskRequest) {
+	if _, ok := s.requests[r.Uuid]; !ok {
+		queue := queueName(r)
+		s.queues[queue] = append(s.queues[queue], r.Uuid)
+	}
+	s.requests[r.Uuid] = r
+}
+
+func (s *FileStore) addSlot(key string, holder string, expireAt int64) {
+	holders, ok := s.slots[key]
+	if !ok {
+		holders = make(map[string]int64)
+		s.slots[key] = holders
+	}
+	holders[holder] = expireAt
+}
+
+func (s *FileStore) addFail(uuid string) {
+	if !s.fails[uuid] {
+		s.fails[uuid] = true
+		s.failList = append(s.failList, uuid)
+	}
+}
+
+func (s *FileStore) addNotify(kind string, uuid string) {
+	n, ok := s.notify[kind]
+	if !ok {
+		n = &fileNotify{uuids: make(map[string]bool)}
+		s.notify[kind] = n
+	}
+	if !n.uuids[uuid] {
+		n.uuids[uuid] = true
+		n.list = append(n.list, uuid)
+	}
+}
+
+func (s *FileStore) snapshot() *fileSnapshot {
+	now := time.Now()
+	snap := new(fileSnapshot)
+
+	for name, list := range s.queues {
+		queue := make([]string, 0, len(list))
+		for _, uuid := range list {
+			if r, ok := s.requests[uuid]; ok && queueName(r) == name {
+				snap.Requests = append(snap.Requests, r)
+				queue = append(queue, uuid)
+			}
+		}
+		if len(queue) == 0 {
+			delete(s.queues, name)
+			continue
+		}
+		s.queues[name] = queue
+	}
+	for _, r := range s.running {
+		snap.Running = append(snap.Running, r)
+	}
+	for uuid, r := range s.results {
+		if r.expired(now) {
+			delete(s.results, uuid)
+			continue
+		}
+		snap.Results = append(snap.Results, r)
+	}
+	failList := make([]string, 0, len(s.fails))
+	for _, uuid := range s.failList {
+		if s.fails[uuid] {
+			snap.FailUuids = append(snap.FailUuids, uuid)
+			failList = append(failList, uuid)
+		}
+	}
+	s.failList = failList
+	for key, r := range s.idems {
+		if r.ExpireAt <= now.UnixNano() {
+			delete(s.idems, key)
+			continue
+		}
+		snap.Idempotency = append(snap.Idempotency, r)
+	}
+	for key, holders := range s.slots {
+		for holder, expireAt := range holders {
+			if expireAt <= now.UnixNano() {
+				delete(holders, holder)
+				continue
+			}
+			snap.Slots = append(snap.Slots, &fileSlot{
+				Key:      key,
+				Holder:   holder,
+				ExpireAt: expireAt,
+			})
+		}
+		if len(holders) == 0 {
+			delete(s.slots, key)
+		}
+	}
+	for key, b := range s.buckets {
+		if b.ExpireAt <= now.UnixNano() {
+			delete(s.buckets, key)
+			continue
+		}
+		snap.Buckets = append(snap.Buckets, b)
+	}
+	for uuid, r := range s.flows {
+		if r.expired(now) {
+			delete(s.flows, uuid)
+			continue
+		}
+		snap.Workflows = append(snap.Workflows, r)
+	}
+	snap.Notify = make(map[string][]string, len(s.notify))
+	for kind, n := range s.notify {
+		if len(n.list) != 0 {
+			snap.Notify[kind] = n.list
+		}
+	}
+	for uuid, r := range s.callback {
+		if r.ExpireAt <= now.UnixNano() {
+			delete(s.callback, uuid)
+			continue
+		}
+		snap.Callbacks = append(snap.Callbacks, r)
+	}
+	for uuid, r := range s.progress {
+		if r.ExpireAt <= now.UnixNano() {
+			delete(s.progress, uuid)
+			continue
+		}
+		snap.Progress = append(snap.Progress, r)
+	}
+	for uuid, r := range s.logs {
+		if r.ExpireAt <= now.UnixNano() {
+			delete(s.logs, uuid)
+			continue
+		}
+		snap.Logs = append(snap.Logs, r)
+	}
+	for uuid, r := range s.status {
+		if r.expired(now) {
+			s.unindexStatus(r.Status)
+			delete(s.status, uuid)
+			continue
+		}
+		snap.Statuses = append(snap.Statuses, r)
+	}
+	for id, r := range s.workers {
+		if r.ExpireAt <= now.UnixNano() {
+			delete(s.workers, id)
+			continue
+		}
+		snap.Workers = append(snap.Workers, r)
+	}
+	return snap
+}
+
+func (r *fileStatus) expired(now time.Time) bool {
+	return r.ExpireAt != 0 && r.ExpireAt <= now.UnixNano()
+}
+
+func (r *fileResult) expired(now time.Time) bool {
+	return r.ExpireAt <= now.UnixNano()
+}
+
+func (r *fileWorkflow) expired(now time.Time) bool {
+	return r.ExpireAt != 0 && r.ExpireAt <= now.UnixNano()
+}
+
+//记录格式：4字节长度 + 4字节crc32 + json内容
+func encodeRecord(rec *walRecord) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[recordHeaderSize:], data)
+	return buf, nil
+}
+
+func decodeRecord(r io.Reader) (*walRecord, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if maxRecordSize < size {
+		return nil, 0, errors.ErrCorruptedLog
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errors.ErrCorruptedLog
+	}
+	rec := new(walRecord)
+	err = json.Unmarshal(data, rec)
+	if err != nil {
+		return nil, 0, errors.ErrCorruptedLog
+	}
+	return rec, int64(n) + int64(size), nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+const watchInterval = time.Millisecond * 200
+
+type fileWatcher struct {
+	store *FileStore
+	uuids chan string
+	quit  chan struct{}
+}
+
+func (w *fileWatcher) Uuids() <-chan string {
+	return w.uuids
+}
+
+func (w *fileWatcher) Close() error {
+	s := w.store
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.watchers[w]; ok {
+		delete(s.watchers, w)
+		close(w.uuids)
+		close(w.quit)
+	}
+	return nil
+}
+
+func (w *fileWatcher) run() {
+	tick := time.NewTicker(watchInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			err := w.store.update(func() (*walRecord, error) {
+				return nil, nil
+			})
+			if err == errors.ErrStoreClosed {
+				return
+			}
+		case <-w.quit:
+			return
+		case <-w.store.quit:
+			return
+		}
+	}
+}
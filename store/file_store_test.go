@@ -0,0 +1,254 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+const helperDirEnv = "KINGTASK_FILE_STORE_HELPER_DIR"
+
+func newRequest(t *testing.T, args string) *task.TaskRequest {
+	r, err := task.NewTaskRequest("example", []string{args}, 0, []int{5, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kingtask_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1 := newRequest(t, "1")
+	r2 := newRequest(t, "2")
+	s.AddRequest(r1)
+	s.AddRequest(r2)
+	req, err := s.PopRequest(defaultQueues, time.Minute)
+	if err != nil || req.Uuid != r1.Uuid {
+		t.Fatalf("pop request:%v,%v", req, err)
+	}
+	result := &task.TaskResult{TaskRequest: *r1, IsSuccess: 0, Result: "fail"}
+	err = s.SetResult(result, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	req, err = s.PopRequest(defaultQueues, time.Minute)
+	if err != nil || req.Uuid != r2.Uuid {
+		t.Fatalf("pop request after reopen:%v,%v", req, err)
+	}
+	_, err = s.PopRequest(defaultQueues, time.Minute)
+	if err != errors.ErrKeyNotExist {
+		t.Fatalf("queue should be empty, err=%v", err)
+	}
+	ret, err := s.GetResult(r1.Uuid)
+	if err != nil || ret.Result != "fail" {
+		t.Fatalf("get result after reopen:%v,%v", ret, err)
+	}
+	ret, err = s.PopFailResult()
+	if err != nil || ret.Uuid != r1.Uuid {
+		t.Fatalf("pop fail result after reopen:%v,%v", ret, err)
+	}
+}
+
+func TestFileStoreCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s1, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	s2, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	r := newRequest(t, "1")
+	s1.AddRequest(r)
+	s1.SetResult(&task.TaskResult{TaskRequest: *newRequest(t, "3"), IsSuccess: 1}, time.Nanosecond)
+	s1.SetResult(&task.TaskResult{TaskRequest: *newRequest(t, "2"), IsSuccess: 1}, time.Hour)
+	err = s1.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s1.results) != 1 {
+		t.Fatalf("expired result not compacted, results=%d", len(s1.results))
+	}
+	//s2需要发现日志已被替换
+	req, err := s2.PopRequest(defaultQueues, time.Minute)
+	if err != nil || req.Uuid != r.Uuid {
+		t.Fatalf("pop request after compact:%v,%v", req, err)
+	}
+	_, err = s1.PopRequest(defaultQueues, time.Minute)
+	if err != errors.ErrKeyNotExist {
+		t.Fatalf("request popped twice, err=%v", err)
+	}
+}
+
+func TestFileStoreTornWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRequest(t, "1")
+	s.AddRequest(r)
+	s.Close()
+
+	//模拟写入一半时进程崩溃
+	buf, err := encodeRecord(&walRecord{Op: opAddRequest, Request: newRequest(t, "2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path.Join(dir, walFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(buf[:len(buf)/2])
+	f.Close()
+
+	s, err = NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	r3 := newRequest(t, "3")
+	err = s.AddRequest(r3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{r.Uuid, r3.Uuid} {
+		req, err := s.PopRequest(defaultQueues, time.Minute)
+		if err != nil || req.Uuid != expect {
+			t.Fatalf("pop request:%v,%v, expect %s", req, err, expect)
+		}
+	}
+	_, err = s.PopRequest(defaultQueues, time.Minute)
+	if err != errors.ErrKeyNotExist {
+		t.Fatalf("torn record should be dropped, err=%v", err)
+	}
+}
+
+//被测试进程kill掉的子进程，不断写入任务并在写入成功后输出uuid
+func TestFileStoreHelperProcess(t *testing.T) {
+	dir := os.Getenv(helperDirEnv)
+	if len(dir) == 0 {
+		return
+	}
+	s, err := NewFileStore(dir, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for i := 0; ; i++ {
+		r := newRequest(t, fmt.Sprint(i))
+		if err := s.AddRequest(r); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(r.Uuid)
+		if i%50 == 49 {
+			if err := s.Compact(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+func TestFileStoreCrashRecovery(t *testing.T) {
+	for round := 0; round < 5; round++ {
+		dir := tempDir(t)
+		crashRecoveryRound(t, dir, 100+round*37)
+		os.RemoveAll(dir)
+	}
+}
+
+func crashRecoveryRound(t *testing.T, dir string, killAfter int) {
+	cmd := exec.Command(os.Args[0], "-test.run=TestFileStoreHelperProcess")
+	cmd.Env = append(os.Environ(), helperDirEnv+"="+dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acked := make([]string, 0, killAfter)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		acked = append(acked, scanner.Text())
+		if len(acked) == killAfter {
+			cmd.Process.Kill()
+			break
+		}
+	}
+	cmd.Wait()
+	if len(acked) != killAfter {
+		t.Fatalf("helper exited early, acked=%d", len(acked))
+	}
+
+	s, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	popped := make(map[string]bool)
+	for {
+		req, err := s.PopRequest(defaultQueues, time.Minute)
+		if err == errors.ErrKeyNotExist {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if popped[req.Uuid] {
+			t.Fatalf("request %s popped twice", req.Uuid)
+		}
+		popped[req.Uuid] = true
+	}
+	//已确认的任务都不能丢失，未确认的任务可能存在
+	for _, uuid := range acked {
+		if !popped[uuid] {
+			t.Fatalf("acked request %s lost", uuid)
+		}
+	}
+	err = s.AddRequest(newRequest(t, "after crash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
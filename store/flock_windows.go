@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package store
+
+import (
+	"os"
+
+	"github.com/flike/kingtask/core/errors"
+)
+
+var errFlockNotSupported = errors.NewError("file store is not supported on windows")
+
+func lockFile(f *os.File) error {
+	return errFlockNotSupported
+}
+
+func unlockFile(f *os.File) error {
+	return errFlockNotSupported
+}
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+)
+
+//redis连接参数，由StoreConfig解析得到
+type redisOptions struct {
+	user         string
+	password     string
+	tlsConfig    *tls.Config
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	poolSize     int
+	poolTimeout  time.Duration
+	idleTimeout  time.Duration
+}
+
+func newRedisOptions(cfg *config.StoreConfig) (*redisOptions, error) {
+	var err error
+
+	opt := new(redisOptions)
+	opt.user = cfg.RedisUser
+	opt.password, err = cfg.LoadRedisPassword()
+	if err != nil {
+		return nil, err
+	}
+	if len(opt.user) != 0 && len(opt.password) == 0 {
+		return nil, errors.NewError("redis_user requires a redis password")
+	}
+	if cfg.RedisTLS {
+		opt.tlsConfig, err = newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	opt.dialTimeout = time.Millisecond * time.Duration(cfg.RedisDialTimeout)
+	opt.readTimeout = time.Millisecond * time.Duration(cfg.RedisReadTimeout)
+	opt.writeTimeout = time.Millisecond * time.Duration(cfg.RedisWriteTimeout)
+	opt.poolSize = cfg.RedisPoolSize
+	opt.poolTimeout = time.Millisecond * time.Duration(cfg.RedisPoolTimeout)
+	opt.idleTimeout = time.Millisecond * time.Duration(cfg.RedisIdleTimeout)
+	return opt, nil
+}
+
+//自定义拨号只有单机模式支持，cluster和sentinel客户端不能替换拨号函数
+func (opt *redisOptions) needDialer() bool {
+	return opt.tlsConfig != nil || len(opt.user) != 0
+}
+
+//需要TLS或ACL用户名时返回自定义的拨号函数，否则返回nil
+func (opt *redisOptions) dialer(addr string) func() (net.Conn, error) {
+	if !opt.needDialer() {
+		return nil
+	}
+	return func() (net.Conn, error) {
+		var cn net.Conn
+		var err error
+
+		d := &net.Dialer{Timeout: opt.dialTimeout}
+		if opt.tlsConfig != nil {
+			cn, err = tls.DialWithDialer(d, "tcp", addr, opt.tlsConfig)
+		} else {
+			cn, err = d.Dial("tcp", addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(opt.user) != 0 {
+			err = authConn(cn, opt.user, opt.password, opt.dialTimeout)
+			if err != nil {
+				cn.Close()
+				return nil, err
+			}
+		}
+		return cn, nil
+	}
+}
+
+//redis客户端只支持单参数的AUTH，ACL用户名需要在拨号时自行认证
+func (opt *redisOptions) clientPassword() string {
+	if len(opt.user) != 0 {
+		return ""
+	}
+	return opt.password
+}
+
+func authConn(cn net.Conn, user, password string, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = time.Second * 5
+	}
+	cn.SetDeadline(time.Now().Add(timeout))
+	defer cn.SetDeadline(time.Time{})
+
+	cmd := fmt.Sprintf("*3\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+		len(user), user, len(password), password)
+	_, err := cn.Write([]byte(cmd))
+	if err != nil {
+		return err
+	}
+	//逐字节读取，避免读走后续命令的数据
+	reply := make([]byte, 0, 64)
+	b := make([]byte, 1)
+	for {
+		_, err = cn.Read(b)
+		if err != nil {
+			return err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		reply = append(reply, b[0])
+	}
+	line := strings.TrimRight(string(reply), "\r")
+	if strings.HasPrefix(line, "-") {
+		return errors.NewError(line[1:])
+	}
+	return nil
+}
+
+func newTLSConfig(cfg *config.StoreConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.RedisTLSServerName,
+		InsecureSkipVerify: cfg.RedisTLSSkipVerify,
+	}
+	if len(cfg.RedisTLSCA) != 0 {
+		data, err := ioutil.ReadFile(cfg.RedisTLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.NewError("no certificate found in " + cfg.RedisTLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(cfg.RedisTLSCert) != 0 || len(cfg.RedisTLSKey) != 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.RedisTLSCert, cfg.RedisTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	//未指定ServerName时使用地址中的主机名校验证书
+	if len(tlsConfig.ServerName) == 0 && len(cfg.RedisAddr) != 0 {
+		host := strings.SplitN(cfg.RedisAddr, "/", 2)[0]
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			tlsConfig.ServerName = h
+		}
+	}
+	return tlsConfig, nil
+}
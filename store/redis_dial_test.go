@@ -0,0 +1,39 @@
+package store
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func fakeAuthServer(t *testing.T, reply string) net.Conn {
+	server, client := net.Pipe()
+	go func() {
+		r := bufio.NewReader(server)
+		//*3 $4 AUTH $n user $n password，共7行
+		for i := 0; i < 7; i++ {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+		}
+		server.Write([]byte(reply))
+	}()
+	return client
+}
+
+func TestAuthConn(t *testing.T) {
+	cn := fakeAuthServer(t, "+OK\r\n")
+	err := authConn(cn, "kingtask", "secret", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.Close()
+
+	cn = fakeAuthServer(t, "-WRONGPASS invalid username-password pair\r\n")
+	err = authConn(cn, "kingtask", "bad", time.Second)
+	if err == nil || err.Error() != "WRONGPASS invalid username-password pair" {
+		t.Fatalf("unexpected err:%v", err)
+	}
+	cn.Close()
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+//任务在redis hash中的字段。新增字段追加在末尾，旧数据中不存在的字段按空值处理
+var requestFields = []string{
+	"uuid",
+	"bin_name",
+	"args",
+	"start_time",
+	"time_interval",
+	"index",
+	"concurrency_key",
+	"concurrency_limit",
+	"queue",
+	"workflow",
+	"stdin",
+	"callback_url",
+	"traceparent",
+}
+
+//结果hash中的字段，在任务字段之后追加执行结果
+var resultFields = append(append([]string{}, requestFields...),
+	"is_success",
+	"result",
+)
+
+func requestPairs(r *task.TaskRequest) []string {
+	return []string{
+		"uuid", r.Uuid,
+		"bin_name", r.BinName,
+		"args", r.Args,
+		"start_time", strconv.FormatInt(r.StartTime, 10),
+		"time_interval", r.TimeInterval,
+		"index", strconv.Itoa(r.Index),
+		"concurrency_key", r.ConcurrencyKey,
+		"concurrency_limit", strconv.Itoa(r.ConcurrencyLimit),
+		"queue", r.Queue,
+		"workflow", r.Workflow,
+		"stdin", r.Stdin,
+		"callback_url", r.CallbackUrl,
+		"traceparent", r.Traceparent,
+	}
+}
+
+func resultPairs(r *task.TaskResult) []string {
+	return append(requestPairs(&r.TaskRequest),
+		"is_success", strconv.Itoa(int(r.IsSuccess)),
+		"result", r.Result,
+	)
+}
+
+//将HMGET返回的值按字段名整理，key不存在时返回ErrKeyNotExist
+func fieldMap(fields []string, vals []interface{}) (map[string]string, error) {
+	if len(vals) != len(fields) {
+		return nil, errors.ErrInvalidArgument
+	}
+	m := make(map[string]string, len(fields))
+	for i, field := range fields {
+		if v, ok := vals[i].(string); ok {
+			m[field] = v
+		}
+	}
+	if len(m["uuid"]) == 0 {
+		return nil, errors.ErrKeyNotExist
+	}
+	return m, nil
+}
+
+func atoi64(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func parseTaskRequest(vals []interface{}) (*task.TaskRequest, error) {
+	m, err := fieldMap(requestFields, vals)
+	if err != nil {
+		return nil, err
+	}
+	return requestFromMap(m)
+}
+
+func requestFromMap(m map[string]string) (*task.TaskRequest, error) {
+	req := new(task.TaskRequest)
+	req.Uuid = m["uuid"]
+	req.BinName = m["bin_name"]
+	req.Args = m["args"]
+	startTime, err := atoi64(m["start_time"])
+	if err != nil {
+		return nil, err
+	}
+	req.StartTime = startTime
+	req.TimeInterval = m["time_interval"]
+	index, err := atoi64(m["index"])
+	if err != nil {
+		return nil, err
+	}
+	req.Index = int(index)
+	req.ConcurrencyKey = m["concurrency_key"]
+	limit, err := atoi64(m["concurrency_limit"])
+	if err != nil {
+		return nil, err
+	}
+	req.ConcurrencyLimit = int(limit)
+	req.Queue = m["queue"]
+	req.Workflow = m["workflow"]
+	req.Stdin = m["stdin"]
+	req.CallbackUrl = m["callback_url"]
+	req.Traceparent = m["traceparent"]
+	return req, nil
+}
+
+func parseTaskResult(vals []interface{}) (*task.TaskResult, error) {
+	m, err := fieldMap(resultFields, vals)
+	if err != nil {
+		return nil, err
+	}
+	req, err := requestFromMap(m)
+	if err != nil {
+		return nil, err
+	}
+	result := new(task.TaskResult)
+	result.TaskRequest = *req
+	result.IsSuccess, err = atoi64(m["is_success"])
+	if err != nil {
+		return nil, err
+	}
+	result.Result = m["result"]
+	return result, nil
+}
+
+//状态hash中的字段
+var statusFields = []string{
+	"uuid",
+	"bin_name",
+	"queue",
+	"workflow",
+	"state",
+	"attempt",
+	"submit_time",
+	"update_time",
+	"result_expire_at",
+}
+
+func statusPairs(r *task.TaskRequest) []string {
+	return []string{
+		"bin_name", r.BinName,
+		"queue", r.Queue,
+		"workflow", r.Workflow,
+		"attempt", strconv.Itoa(r.Index),
+	}
+}
+
+func parseTaskStatus(vals []interface{}) (*task.TaskStatus, error) {
+	m, err := fieldMap(statusFields, vals)
+	if err != nil {
+		return nil, err
+	}
+	st := &task.TaskStatus{
+		Uuid:     m["uuid"],
+		BinName:  m["bin_name"],
+		Queue:    m["queue"],
+		Workflow: m["workflow"],
+		State:    m["state"],
+	}
+	attempt, err := atoi64(m["attempt"])
+	if err != nil {
+		return nil, err
+	}
+	st.Attempt = int(attempt)
+	if st.SubmitTime, err = atoi64(m["submit_time"]); err != nil {
+		return nil, err
+	}
+	if st.UpdateTime, err = atoi64(m["update_time"]); err != nil {
+		return nil, err
+	}
+	if st.ResultExpireAt, err = atoi64(m["result_expire_at"]); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+//历史中的每项为 "状态 时间(毫秒)"
+func parseStateHistory(entries []string) ([]*task.StateChange, error) {
+	history := make([]*task.StateChange, 0, len(entries))
+	for _, entry := range entries {
+		fields := strings.SplitN(entry, " ", 2)
+		if len(fields) != 2 {
+			return nil, errors.ErrInvalidArgument
+		}
+		ts, err := atoi64(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, &task.StateChange{State: fields[0], Time: ts})
+	}
+	return history, nil
+}
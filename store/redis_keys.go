@@ -0,0 +1,131 @@
+package store
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/flike/kingtask/config"
+)
+
+//redis中的key布局。单机模式沿用原有的key名；集群模式下任务按uuid分到多个分片，
+//每个分片的key带有相同的hash tag，保证同一任务涉及的多个key落在同一个slot上，
+//同时待执行队列分散到多个slot，避免单个slot成为瓶颈。
+type redisKeys struct {
+	shards int
+	tagged bool
+}
+
+func newRedisKeys(shards int, tagged bool) *redisKeys {
+	if shards <= 0 {
+		shards = 1
+	}
+	return &redisKeys{
+		shards: shards,
+		tagged: tagged,
+	}
+}
+
+func (k *redisKeys) shard(uuid string) int {
+	return int(crc32.ChecksumIEEE([]byte(uuid)) % uint32(k.shards))
+}
+
+func (k *redisKeys) prefix(shard int) string {
+	if !k.tagged {
+		return ""
+	}
+	return fmt.Sprintf("{kingtask%d}", shard)
+}
+
+//默认队列沿用原有的key名，其它队列在后面加上队列名
+func (k *redisKeys) requestSet(queue string, shard int) string {
+	return k.prefix(shard) + queueSetName(queue)
+}
+
+func queueSetName(queue string) string {
+	if len(queue) == 0 || queue == config.DefaultQueue {
+		return config.RequestUuidSet
+	}
+	return config.RequestUuidSet + ":" + queue
+}
+
+//分片中出现过的队列名
+func (k *redisKeys) queueNames(shard int) string {
+	return k.prefix(shard) + "queues"
+}
+
+//所有worker的心跳放在第一个分片
+func (k *redisKeys) workers() string {
+	return k.prefix(0) + "workers"
+}
+
+func (k *redisKeys) runningSet(shard int) string {
+	return k.prefix(shard) + config.RunningUuidSet
+}
+
+func (k *redisKeys) failSet(shard int) string {
+	return k.prefix(shard) + config.FailResultUuidSet
+}
+
+func (k *redisKeys) notifySet(kind string, shard int) string {
+	return k.prefix(shard) + kind + "_result_set"
+}
+
+func (k *redisKeys) workflowKey(uuid string) string {
+	return fmt.Sprintf("%sw_%s", k.prefix(k.shard(uuid)), uuid)
+}
+
+//分片中还未结束的工作流
+func (k *redisKeys) runningWorkflows(shard int) string {
+	return k.prefix(shard) + "running_workflows"
+}
+
+func (k *redisKeys) callbackKey(uuid string) string {
+	return fmt.Sprintf("%scb_%s", k.prefix(k.shard(uuid)), uuid)
+}
+
+func (k *redisKeys) progressKey(uuid string) string {
+	return fmt.Sprintf("%sp_%s", k.prefix(k.shard(uuid)), uuid)
+}
+
+//任务日志和已分配的日志序号
+func (k *redisKeys) logKey(uuid string) string {
+	return fmt.Sprintf("%slg_%s", k.prefix(k.shard(uuid)), uuid)
+}
+
+func (k *redisKeys) logSeqKey(uuid string) string {
+	return fmt.Sprintf("%slgn_%s", k.prefix(k.shard(uuid)), uuid)
+}
+
+//任务状态和状态变更历史
+func (k *redisKeys) statusKey(uuid string) string {
+	return fmt.Sprintf("%ss_%s", k.prefix(k.shard(uuid)), uuid)
+}
+
+func (k *redisKeys) statusHistoryKey(uuid string) string {
+	return fmt.Sprintf("%ssh_%s", k.prefix(k.shard(uuid)), uuid)
+}
+
+//任务状态的索引，name为all、state:<状态>、bin:<可执行文件>或queue:<队列>
+func (k *redisKeys) indexKey(name string, shard int) string {
+	return k.prefix(shard) + "idx_" + name
+}
+
+func (k *redisKeys) taskKey(uuid string) string {
+	return fmt.Sprintf("%st_%s", k.prefix(k.shard(uuid)), uuid)
+}
+
+func (k *redisKeys) idempotencyKey(key string) string {
+	return fmt.Sprintf("%si_%s", k.prefix(k.shard(key)), key)
+}
+
+func (k *redisKeys) slotKey(key string) string {
+	return fmt.Sprintf("%sc_%s", k.prefix(k.shard(key)), key)
+}
+
+func (k *redisKeys) rateKey(key string) string {
+	return fmt.Sprintf("%sl_%s", k.prefix(k.shard(key)), key)
+}
+
+func (k *redisKeys) resultKey(uuid string) string {
+	return fmt.Sprintf("%sr_%s", k.prefix(k.shard(uuid)), uuid)
+}
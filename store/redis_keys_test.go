@@ -0,0 +1,44 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+func hashTag(key string) string {
+	s := strings.IndexByte(key, '{')
+	if s < 0 {
+		return key
+	}
+	e := strings.IndexByte(key[s+1:], '}')
+	if e <= 0 {
+		return key
+	}
+	return key[s+1 : s+1+e]
+}
+
+func TestRedisKeysSlot(t *testing.T) {
+	k := newRedisKeys(16, true)
+	for _, uuid := range []string{"a", "0f8fad5b-d9cb-469f-a165-70867728950e", "7c9e6679"} {
+		shard := k.shard(uuid)
+		tag := hashTag(k.requestSet("", shard))
+		keys := []string{
+			k.requestSet("mail", shard),
+			k.runningSet(shard),
+			k.failSet(shard),
+			k.taskKey(uuid),
+			k.resultKey(uuid),
+		}
+		for _, key := range keys {
+			if hashTag(key) != tag {
+				t.Errorf("key %s not in the same slot as %s", key, k.requestSet("", shard))
+			}
+		}
+	}
+
+	k = newRedisKeys(1, false)
+	if k.taskKey("a") != "t_a" || k.resultKey("a") != "r_a" ||
+		k.requestSet("default", 0) != "request_uuid_set" || k.failSet(0) != "fail_result_uuid_set" {
+		t.Errorf("standalone keys changed")
+	}
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"strings"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+
+	"github.com/flike/kingtask/core/metrics"
+)
+
+var redisErrors = metrics.NewCounterVec("kingtask_redis_errors_total",
+	"Redis commands that returned an error.", "command")
+
+//统计每个命令返回的错误，key不存在和脚本未加载不算错误
+type countingClient struct {
+	redisClient
+}
+
+func countError(command string, err error) {
+	if err == nil || err == redis.Nil || strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		return
+	}
+	redisErrors.Inc(command)
+}
+
+//订阅通知需要底层的redis.Client
+func rawClient(c redisClient) redisClient {
+	if cc, ok := c.(*countingClient); ok {
+		return cc.redisClient
+	}
+	return c
+}
+
+func (c *countingClient) Ping() *redis.StatusCmd {
+	cmd := c.redisClient.Ping()
+	countError("ping", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) Del(keys ...string) *redis.IntCmd {
+	cmd := c.redisClient.Del(keys...)
+	countError("del", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) Expire(key string, expiration time.Duration) *redis.BoolCmd {
+	cmd := c.redisClient.Expire(key, expiration)
+	countError("expire", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) Get(key string) *redis.StringCmd {
+	cmd := c.redisClient.Get(key)
+	countError("get", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	cmd := c.redisClient.Set(key, value, expiration)
+	countError("set", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) HMGet(key string, fields ...string) *redis.SliceCmd {
+	cmd := c.redisClient.HMGet(key, fields...)
+	countError("hmget", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) HMSet(key, field, value string, pairs ...string) *redis.StatusCmd {
+	cmd := c.redisClient.HMSet(key, field, value, pairs...)
+	countError("hmset", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) HSet(key, field, value string) *redis.BoolCmd {
+	cmd := c.redisClient.HSet(key, field, value)
+	countError("hset", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) HDel(key string, fields ...string) *redis.IntCmd {
+	cmd := c.redisClient.HDel(key, fields...)
+	countError("hdel", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) HGetAllMap(key string) *redis.StringStringMapCmd {
+	cmd := c.redisClient.HGetAllMap(key)
+	countError("hgetall", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) LRange(key string, start, stop int64) *redis.StringSliceCmd {
+	cmd := c.redisClient.LRange(key, start, stop)
+	countError("lrange", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) SAdd(key string, members ...string) *redis.IntCmd {
+	cmd := c.redisClient.SAdd(key, members...)
+	countError("sadd", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) SCard(key string) *redis.IntCmd {
+	cmd := c.redisClient.SCard(key)
+	countError("scard", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) SMembers(key string) *redis.StringSliceCmd {
+	cmd := c.redisClient.SMembers(key)
+	countError("smembers", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) SPop(key string) *redis.StringCmd {
+	cmd := c.redisClient.SPop(key)
+	countError("spop", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) SRandMemberN(key string, count int64) *redis.StringSliceCmd {
+	cmd := c.redisClient.SRandMemberN(key, count)
+	countError("srandmember", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) SRem(key string, members ...string) *redis.IntCmd {
+	cmd := c.redisClient.SRem(key, members...)
+	countError("srem", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) ZRem(key string, members ...string) *redis.IntCmd {
+	cmd := c.redisClient.ZRem(key, members...)
+	countError("zrem", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) Eval(script string, keys []string, args []string) *redis.Cmd {
+	cmd := c.redisClient.Eval(script, keys, args)
+	countError("eval", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) EvalSha(sha1 string, keys []string, args []string) *redis.Cmd {
+	cmd := c.redisClient.EvalSha(sha1, keys, args)
+	countError("evalsha", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) ScriptExists(scripts ...string) *redis.BoolSliceCmd {
+	cmd := c.redisClient.ScriptExists(scripts...)
+	countError("script", cmd.Err())
+	return cmd
+}
+
+func (c *countingClient) ScriptLoad(script string) *redis.StringCmd {
+	cmd := c.redisClient.ScriptLoad(script)
+	countError("script", cmd.Err())
+	return cmd
+}
@@ -0,0 +1,439 @@
+package store
+
+import (
+	redis "gopkg.in/redis.v3"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/task"
+)
+
+//任务状态的变更通过lua脚本在redis中原子执行，避免进程在多条命令之间崩溃时
+//留下孤立的任务或丢失uuid。脚本中用到的key都带有相同的hash tag，在cluster模式下
+//位于同一个slot。SPOP是非确定性命令，需要开启按效果复制才能在其后执行写命令。
+
+//任务状态保存在s_前缀的hash中，状态变更历史保存在sh_前缀的列表中，每项为 "状态 时间(毫秒)"，
+//与任务状态的变更在同一个脚本中记录，历史只保留最近100项(maxStateHistory)。
+//任务结束后状态保存keep毫秒，未结束时不过期。
+//同时维护按状态、可执行文件和队列划分的索引(idx_前缀的有序集合)，分值为提交时间。
+//结束的任务记录在idx_expire中，分值为到期时间，所在的索引记录在idx_expire_fields中，
+//状态key过期后由pruneStatusScript从索引中删除；没有及时删除时残留在索引中的uuid在查询时删除。
+const setStateLua = `
+local function index_fields(prefix, uuid, key)
+	local f = redis.call('HMGET', key, 'bin_name', 'queue', 'submit_time')
+	local queue = f[2]
+	if not queue or queue == '' then
+		queue = '` + config.DefaultQueue + `'
+	end
+	redis.call('ZADD', prefix .. 'idx_bin:' .. (f[1] or ''), f[3], uuid)
+	redis.call('ZADD', prefix .. 'idx_queue:' .. queue, f[3], uuid)
+end
+
+local function set_fields(prefix, uuid, key, src)
+	local f = redis.call('HMGET', src, 'bin_name', 'queue', 'workflow', 'index')
+	redis.call('HMSET', key, 'bin_name', f[1] or '', 'queue', f[2] or '',
+		'workflow', f[3] or '', 'attempt', f[4] or '0')
+	index_fields(prefix, uuid, key)
+end
+
+local function set_state(prefix, uuid, state, now, keep)
+	local key = prefix .. 's_' .. uuid
+	local history = prefix .. 'sh_' .. uuid
+	local old = redis.call('HGET', key, 'state')
+	if old then
+		redis.call('ZREM', prefix .. 'idx_state:' .. old, uuid)
+	end
+	redis.call('HSETNX', key, 'submit_time', now)
+	redis.call('HMSET', key, 'uuid', uuid, 'state', state, 'update_time', now, 'result_expire_at', 0)
+	local submit = redis.call('HGET', key, 'submit_time')
+	redis.call('ZADD', prefix .. 'idx_state:' .. state, submit, uuid)
+	redis.call('ZADD', prefix .. 'idx_all', submit, uuid)
+	redis.call('RPUSH', history, state .. ' ' .. now)
+	redis.call('LTRIM', history, -100, -1)
+	if keep ~= '' then
+		local f = redis.call('HMGET', key, 'bin_name', 'queue')
+		redis.call('ZADD', prefix .. 'idx_expire', tonumber(now) + tonumber(keep), uuid)
+		redis.call('HSET', prefix .. 'idx_expire_fields', uuid, cjson.encode({state, f[1] or '', f[2] or ''}))
+		redis.call('PEXPIRE', key, keep)
+		redis.call('PEXPIRE', history, keep)
+	else
+		redis.call('ZREM', prefix .. 'idx_expire', uuid)
+		redis.call('HDEL', prefix .. 'idx_expire_fields', uuid)
+		redis.call('PERSIST', key)
+		redis.call('PERSIST', history)
+	end
+	return key
+end
+`
+
+//KEYS: 任务key，待执行队列，需要删除的旧结果(可选)
+//ARGV: key前缀，当前时间(毫秒)，uuid，队列名，任务字段
+var addRequestScript = redis.NewScript(setStateLua + `
+if KEYS[3] then
+	redis.call('DEL', KEYS[3])
+end
+redis.call('HMSET', KEYS[1], unpack(ARGV, 5))
+redis.call('SADD', KEYS[2], ARGV[3])
+redis.call('SADD', ARGV[1] .. 'queues', ARGV[4])
+local key = set_state(ARGV[1], ARGV[3], 'queued', ARGV[2], '')
+set_fields(ARGV[1], ARGV[3], key, KEYS[1])
+return 1
+`)
+
+//写入任务并绑定幂等键，键已绑定时不写入任务，返回已有的uuid。入队时间晚于当前时间的任务
+//放入执行中队列，到期后由requeueScript放回待执行队列
+//KEYS: 任务key，待执行队列，执行中队列，幂等键；
+//ARGV: key前缀，当前时间(毫秒)，uuid，队列名，幂等键有效时间(毫秒)，入队时间(毫秒)，任务字段
+var addRequestOnceScript = redis.NewScript(setStateLua + `
+local uuid = redis.call('GET', KEYS[4])
+if uuid then
+	return uuid
+end
+redis.call('SET', KEYS[4], ARGV[3], 'PX', ARGV[5])
+redis.call('HMSET', KEYS[1], unpack(ARGV, 7))
+redis.call('SADD', ARGV[1] .. 'queues', ARGV[4])
+local state = '` + task.StateQueued + `'
+if tonumber(ARGV[2]) < tonumber(ARGV[6]) then
+	redis.call('ZADD', KEYS[3], ARGV[6], ARGV[3])
+	state = '` + task.StateScheduled + `'
+else
+	redis.call('SADD', KEYS[2], ARGV[3])
+end
+local key = set_state(ARGV[1], ARGV[3], state, ARGV[2], '')
+set_fields(ARGV[1], ARGV[3], key, KEYS[1])
+return ARGV[3]
+`)
+
+//记录由broker决定的状态变更
+//ARGV: key前缀，uuid，状态，当前时间(毫秒)，状态保存时间(毫秒，未结束时为空)，状态字段
+var setStateScript = redis.NewScript(setStateLua + `
+local key = set_state(ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5])
+if 6 <= #ARGV then
+	redis.call('HMSET', key, unpack(ARGV, 6))
+	index_fields(ARGV[1], ARGV[2], key)
+end
+return 1
+`)
+
+//取出一个任务放入执行中队列，任务key保留到结果写入后再删除，
+//worker崩溃时由broker把租约过期的任务放回待执行队列。
+//KEYS: 待执行队列，执行中队列；ARGV: key前缀，租约到期时间(毫秒)，当前时间(毫秒)，任务字段(第一个为uuid)
+var popRequestScript = redis.NewScript(setStateLua + `
+redis.replicate_commands()
+while true do
+	local uuid = redis.call('SPOP', KEYS[1])
+	if not uuid then
+		return false
+	end
+	local vals = redis.call('HMGET', ARGV[1] .. 't_' .. uuid, unpack(ARGV, 4))
+	if vals[1] then
+		redis.call('ZADD', KEYS[2], ARGV[2], uuid)
+		set_state(ARGV[1], uuid, 'running', ARGV[3], '')
+		return vals
+	end
+end
+`)
+
+//写入结果，同时结束执行中的任务，任务结束时放入需要broker处理的通知队列
+//KEYS: 结果key，失败队列，执行中队列，任务key，通知队列...；
+//ARGV: uuid，保存时间(毫秒)，是否成功，结果通知频道，key前缀，当前时间(毫秒)，状态，
+//状态保存时间(毫秒，未结束时为空)，结果过期时间(毫秒)，结果字段
+var setResultScript = redis.NewScript(setStateLua + `
+redis.call('HMSET', KEYS[1], unpack(ARGV, 10))
+local key = set_state(ARGV[5], ARGV[1], ARGV[7], ARGV[6], ARGV[8])
+set_fields(ARGV[5], ARGV[1], key, KEYS[1])
+redis.call('HSET', key, 'result_expire_at', ARGV[9])
+if ARGV[3] == '0' then
+	redis.call('SADD', KEYS[2], ARGV[1])
+end
+for i = 5, #KEYS do
+	redis.call('SADD', KEYS[i], ARGV[1])
+end
+redis.call('PUBLISH', ARGV[4], ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('DEL', KEYS[4])
+return 1
+`)
+
+//取出一个失败的结果，已过期的结果直接跳过。还会重试的任务同时删除结果，并把下一次重试
+//写入任务key和执行中队列，分值为重试时间，到期后由requeueScript放回待执行队列。
+//重试的计算与nextRetry一致
+//KEYS: 失败队列，执行中队列；ARGV: key前缀，当前时间(毫秒)，默认队列名，任务字段数，
+//结果字段(第一个为uuid，前面的为任务字段)
+var popFailResultScript = redis.NewScript(`
+redis.replicate_commands()
+local n = tonumber(ARGV[4])
+while true do
+	local uuid = redis.call('SPOP', KEYS[1])
+	if not uuid then
+		return false
+	end
+	local key = ARGV[1] .. 'r_' .. uuid
+	local vals = redis.call('HMGET', key, unpack(ARGV, 5))
+	if vals[1] then
+		local f = redis.call('HMGET', key, 'time_interval', 'index', 'queue')
+		local steps = {}
+		if f[1] and f[1] ~= '' then
+			for step in string.gmatch(f[1] .. ' ', '([^ ]*) ') do
+				table.insert(steps, step)
+			end
+		end
+		local index = (tonumber(f[2]) or 0) + 1
+		if index < #steps then
+			local at = tonumber(ARGV[2]) + (tonumber(steps[index + 1]) or 0) * 1000
+			local fields = {}
+			for i = 1, n do
+				local name, v = ARGV[4 + i], vals[i] or ''
+				if name == 'index' then
+					v = tostring(index)
+				elseif name == 'start_time' then
+					v = tostring(math.floor(at / 1000))
+				end
+				table.insert(fields, name)
+				table.insert(fields, v)
+			end
+			redis.call('HMSET', ARGV[1] .. 't_' .. uuid, unpack(fields))
+			redis.call('ZADD', KEYS[2], at, uuid)
+			local queue = f[3]
+			if not queue or queue == '' then
+				queue = ARGV[3]
+			end
+			redis.call('SADD', ARGV[1] .. 'queues', queue)
+			redis.call('DEL', key)
+		end
+		return vals
+	end
+end
+`)
+
+//并发名额保存在有序集合中，分值为租约到期时间，获取名额时先清理过期的持有者
+//KEYS: 并发键；ARGV: 持有者，名额数，当前时间(毫秒)，租约到期时间(毫秒)
+var acquireSlotScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[3])
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) or
+	redis.call('ZCARD', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[1], ARGV[4], ARGV[1])
+	local last = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+	redis.call('PEXPIREAT', KEYS[1], last[2])
+	return 1
+end
+return 0
+`)
+
+//KEYS: 执行中队列；ARGV: uuid，放回时间(毫秒)，key前缀，当前时间(毫秒)
+var deferRequestScript = redis.NewScript(setStateLua + `
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+	set_state(ARGV[3], ARGV[1], 'queued', ARGV[4], '')
+end
+return 1
+`)
+
+//写入任务并放入执行中队列，分值为到期时间，到期后由requeueScript放回待执行队列
+//KEYS: 任务key，执行中队列；ARGV: key前缀，到期时间(毫秒)，uuid，队列名，任务字段
+var scheduleRequestScript = redis.NewScript(`
+redis.call('HMSET', KEYS[1], unpack(ARGV, 5))
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+redis.call('SADD', ARGV[1] .. 'queues', ARGV[4])
+return 1
+`)
+
+//保存工作流并维护未结束工作流的集合，保存时间为0表示工作流还未结束
+//KEYS: 工作流key，未结束工作流集合；ARGV: uuid，工作流，保存时间(毫秒)
+var setWorkflowScript = redis.NewScript(`
+if tonumber(ARGV[3]) == 0 then
+	redis.call('SET', KEYS[1], ARGV[2])
+	redis.call('SADD', KEYS[2], ARGV[1])
+else
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+	redis.call('SREM', KEYS[2], ARGV[1])
+end
+return 1
+`)
+
+//删除还未被取出的任务，待执行队列中残留的uuid在取出时跳过
+//KEYS: 执行中队列，任务key；ARGV: uuid，key前缀，当前时间(毫秒)，状态保存时间(毫秒)
+var delRequestScript = redis.NewScript(setStateLua + `
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+if redis.call('DEL', KEYS[2]) == 0 then
+	return 0
+end
+set_state(ARGV[2], ARGV[1], 'cancelled', ARGV[3], ARGV[4])
+return 1
+`)
+
+//把租约过期的任务放回其所属队列，已结束的任务直接丢弃，等待期间被取消或者所属工作流
+//已结束的任务同时删除任务key
+//KEYS: 执行中队列；ARGV: 当前时间(毫秒)，key前缀，待执行队列名，默认队列名
+var requeueScript = redis.NewScript(setStateLua + `
+local uuids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local count = 0
+for _, uuid in ipairs(uuids) do
+	redis.call('ZREM', KEYS[1], uuid)
+	local key = ARGV[2] .. 't_' .. uuid
+	local state = redis.call('HGET', ARGV[2] .. 's_' .. uuid, 'state')
+	if state == '` + task.StateCancelled + `' or state == '` + task.StateFailed + `' or
+		state == '` + task.StateDead + `' or state == '` + task.StateSucceeded + `' then
+		redis.call('DEL', key)
+	elseif redis.call('EXISTS', key) == 1 then
+		local queue = redis.call('HGET', key, 'queue')
+		local set = ARGV[2] .. ARGV[3]
+		if queue and queue ~= '' and queue ~= ARGV[4] then
+			set = set .. ':' .. queue
+		end
+		redis.call('SADD', set, uuid)
+		set_state(ARGV[2], uuid, 'queued', ARGV[1], '')
+		count = count + 1
+	end
+end
+return count
+`)
+
+//令牌桶，使用redis服务器时间保证各个worker一致
+//KEYS: 令牌桶；ARGV: 容量，补满的时间(毫秒)
+var takeTokenScript = redis.NewScript(`
+redis.replicate_commands()
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or capacity
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + (now - ts) * capacity / period)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * period / capacity)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], period * 2)
+return wait
+`)
+
+//归还一个令牌，key不存在时令牌是满的
+//KEYS: 令牌桶；ARGV: 容量，补充周期(毫秒)
+var returnTokenScript = redis.NewScript(`
+redis.replicate_commands()
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+if not bucket[1] then
+	return 0
+end
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + (now - ts) * capacity / period + 1)
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], period * 2)
+return 1
+`)
+
+//日志保存为 "序号 json" 格式的列表，只保留最后的若干行
+//KEYS: 日志列表，日志序号；ARGV: 行数上限，保存时间(毫秒)，日志行...
+var appendLogScript = redis.NewScript(`
+local n = tonumber(redis.call('GET', KEYS[2]) or '0')
+for i = 3, #ARGV do
+	n = n + 1
+	redis.call('RPUSH', KEYS[1], n .. ' ' .. ARGV[i])
+end
+redis.call('SET', KEYS[2], n, 'PX', ARGV[2])
+redis.call('LTRIM', KEYS[1], -tonumber(ARGV[1]), -1)
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return n
+`)
+
+//返回下次读取的起始序号和日志行
+//KEYS: 日志列表，日志序号；ARGV: 起始序号，行数
+var getLogsScript = redis.NewScript(`
+local n = tonumber(redis.call('GET', KEYS[2]) or '0')
+local first = n - redis.call('LLEN', KEYS[1]) + 1
+local from = math.max(tonumber(ARGV[1]), first)
+if n < from then
+	return {from}
+end
+local start = from - first
+local lines = redis.call('LRANGE', KEYS[1], start, start + tonumber(ARGV[2]) - 1)
+local ret = {from + #lines}
+for _, line in ipairs(lines) do
+	table.insert(ret, line)
+end
+return ret
+`)
+
+//从索引中删除状态已经过期的任务，返回删除的数量
+//KEYS: 到期索引；ARGV: key前缀，当前时间(毫秒)，最多删除的数量，默认队列名
+var pruneStatusScript = redis.NewScript(`
+local prefix = ARGV[1]
+local fields = prefix .. 'idx_expire_fields'
+local uuids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[2], 'LIMIT', 0, ARGV[3])
+for _, uuid in ipairs(uuids) do
+	local f = redis.call('HGET', fields, uuid)
+	if f then
+		f = cjson.decode(f)
+		local queue = f[3]
+		if queue == '' then
+			queue = ARGV[4]
+		end
+		redis.call('ZREM', prefix .. 'idx_state:' .. f[1], uuid)
+		redis.call('ZREM', prefix .. 'idx_bin:' .. f[2], uuid)
+		redis.call('ZREM', prefix .. 'idx_queue:' .. queue, uuid)
+	end
+	redis.call('ZREM', prefix .. 'idx_all', uuid)
+	redis.call('ZREM', KEYS[1], uuid)
+	redis.call('HDEL', fields, uuid)
+end
+return #uuids
+`)
+
+//按提交时间从新到旧扫描一个分片的索引，返回满足条件的任务状态。找到limit个任务或者
+//扫描的uuid达到上限时停止，返回停止的位置(提交时间，uuid)，扫描完时位置为空
+//KEYS: 索引；ARGV: key前缀，提交时间上限，提交时间下限，游标uuid(提交时间等于上限时只返回
+//更小的uuid)，数量，状态，可执行文件，队列，默认队列名，状态字段
+var listTasksScript = redis.NewScript(`
+local prefix, max, min, cursor = ARGV[1], ARGV[2], ARGV[3], ARGV[4]
+local limit = tonumber(ARGV[5])
+local ret = {'', ''}
+local found, scanned, offset = 0, 0, 0
+while true do
+	local page = redis.call('ZREVRANGEBYSCORE', KEYS[1], max, min, 'LIMIT', offset, 100)
+	if #page == 0 then
+		return ret
+	end
+	offset = offset + #page
+	for _, uuid in ipairs(page) do
+		scanned = scanned + 1
+		local key = prefix .. 's_' .. uuid
+		local f = redis.call('HMGET', key, 'state', 'bin_name', 'queue', 'submit_time')
+		if not f[1] then
+			redis.call('ZREM', KEYS[1], uuid)
+			offset = offset - 1
+		else
+			local queue = f[3]
+			if queue == '' then
+				queue = ARGV[9]
+			end
+			if (cursor == '' or tonumber(f[4]) < tonumber(max) or uuid < cursor) and
+				(ARGV[6] == '' or ARGV[6] == f[1]) and
+				(ARGV[7] == '' or ARGV[7] == f[2]) and
+				(ARGV[8] == '' or ARGV[8] == queue) then
+				local vals = redis.call('HMGET', key, unpack(ARGV, 10))
+				for i = 1, #vals do
+					table.insert(ret, vals[i] or '')
+				end
+				found = found + 1
+			end
+			if limit <= found or 1000 <= scanned then
+				ret[1] = f[4]
+				ret[2] = uuid
+				return ret
+			end
+		end
+	end
+end
+`)
@@ -0,0 +1,931 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flike/golog"
+	"github.com/pborman/uuid"
+	redis "gopkg.in/redis.v3"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+//redis.Client和redis.ClusterClient共有的命令
+type redisClient interface {
+	Ping() *redis.StatusCmd
+	Del(keys ...string) *redis.IntCmd
+	Expire(key string, expiration time.Duration) *redis.BoolCmd
+	Get(key string) *redis.StringCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	HMGet(key string, fields ...string) *redis.SliceCmd
+	HMSet(key, field, value string, pairs ...string) *redis.StatusCmd
+	HSet(key, field, value string) *redis.BoolCmd
+	HDel(key string, fields ...string) *redis.IntCmd
+	HGetAllMap(key string) *redis.StringStringMapCmd
+	LRange(key string, start, stop int64) *redis.StringSliceCmd
+	SAdd(key string, members ...string) *redis.IntCmd
+	SCard(key string) *redis.IntCmd
+	SMembers(key string) *redis.StringSliceCmd
+	SPop(key string) *redis.StringCmd
+	SRandMemberN(key string, count int64) *redis.StringSliceCmd
+	SRem(key string, members ...string) *redis.IntCmd
+	ZRem(key string, members ...string) *redis.IntCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args []string) *redis.Cmd
+	ScriptExists(scripts ...string) *redis.BoolSliceCmd
+	ScriptLoad(script string) *redis.StringCmd
+	Close() error
+}
+
+type RedisStore struct {
+	redisAddr   string
+	redisDB     int
+	redisClient redisClient
+	keys        *redisKeys
+	next        uint32 //轮询待执行队列分片的起始位置
+
+	//cluster模式下订阅通知时单独连接的节点，PUBLISH会广播到集群中所有节点
+	clusterAddrs []string
+	pubsubOpt    *redis.Options
+
+	sync.Mutex
+	watchers map[*redisWatcher]bool
+}
+
+func NewRedisStore(cfg *config.StoreConfig) (*RedisStore, error) {
+	var err error
+
+	s := new(RedisStore)
+	vec := strings.SplitN(cfg.RedisAddr, "/", 2)
+	if len(vec) == 2 {
+		s.redisAddr = vec[0]
+		s.redisDB, err = strconv.Atoi(vec[1])
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s.redisAddr = vec[0]
+		s.redisDB = config.DefaultRedisDB
+	}
+
+	opt, err := newRedisOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.keys = newRedisKeys(1, false)
+	//配置了cluster时key带hash tag，并将任务分散到多个分片
+	if len(cfg.ClusterAddrs) != 0 {
+		if opt.needDialer() {
+			return nil, errors.NewError("redis cluster does not support tls or acl user")
+		}
+		shards := cfg.RedisShards
+		if shards == 0 {
+			shards = config.DefaultRedisShards
+		}
+		s.keys = newRedisKeys(shards, true)
+		s.redisAddr = strings.Join(cfg.ClusterAddrs, ",")
+		s.clusterAddrs = cfg.ClusterAddrs
+		s.pubsubOpt = &redis.Options{
+			Password:     opt.password,
+			DialTimeout:  opt.dialTimeout,
+			ReadTimeout:  opt.readTimeout,
+			WriteTimeout: opt.writeTimeout,
+			PoolSize:     1,
+		}
+		s.redisClient = redis.NewClusterClient(
+			&redis.ClusterOptions{
+				Addrs:        cfg.ClusterAddrs,
+				Password:     opt.password,
+				DialTimeout:  opt.dialTimeout,
+				ReadTimeout:  opt.readTimeout,
+				WriteTimeout: opt.writeTimeout,
+				PoolSize:     opt.poolSize,
+				PoolTimeout:  opt.poolTimeout,
+				IdleTimeout:  opt.idleTimeout,
+			},
+		)
+	} else if len(cfg.SentinelMaster) != 0 {
+		//配置了sentinel时通过sentinel获取master地址，master切换后自动重连
+		if len(cfg.SentinelAddrs) == 0 {
+			return nil, errors.ErrInvalidArgument
+		}
+		if opt.needDialer() {
+			return nil, errors.NewError("redis sentinel does not support tls or acl user")
+		}
+		s.redisAddr = cfg.SentinelMaster
+		s.redisClient = redis.NewFailoverClient(
+			&redis.FailoverOptions{
+				MasterName:    cfg.SentinelMaster,
+				SentinelAddrs: cfg.SentinelAddrs,
+				Password:      opt.password,
+				DB:            int64(s.redisDB),
+				DialTimeout:   opt.dialTimeout,
+				ReadTimeout:   opt.readTimeout,
+				WriteTimeout:  opt.writeTimeout,
+				PoolSize:      opt.poolSize,
+				PoolTimeout:   opt.poolTimeout,
+				IdleTimeout:   opt.idleTimeout,
+			},
+		)
+	} else {
+		s.redisClient = redis.NewClient(
+			&redis.Options{
+				Addr:         s.redisAddr,
+				Dialer:       opt.dialer(s.redisAddr),
+				Password:     opt.clientPassword(),
+				DB:           int64(s.redisDB),
+				DialTimeout:  opt.dialTimeout,
+				ReadTimeout:  opt.readTimeout,
+				WriteTimeout: opt.writeTimeout,
+				PoolSize:     opt.poolSize,
+				PoolTimeout:  opt.poolTimeout,
+				IdleTimeout:  opt.idleTimeout,
+			},
+		)
+	}
+	s.redisClient = &countingClient{s.redisClient}
+	s.watchers = make(map[*redisWatcher]bool)
+	_, err = s.redisClient.Ping().Result()
+	if err != nil {
+		golog.Error("RedisStore", "NewRedisStore", "ping redis fail", 0,
+			"addr", s.redisAddr,
+			"err", err.Error(),
+		)
+		s.redisClient.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *RedisStore) AddRequest(r *task.TaskRequest) error {
+	return s.addRequest(r, false)
+}
+
+func (s *RedisStore) RetryRequest(r *task.TaskRequest) error {
+	return s.addRequest(r, true)
+}
+
+func (s *RedisStore) addRequest(r *task.TaskRequest, delResult bool) error {
+	shard := s.keys.shard(r.Uuid)
+	key := s.keys.taskKey(r.Uuid)
+	set := s.keys.requestSet(queueName(r), shard)
+	keys := []string{key, set}
+	if delResult {
+		keys = append(keys, s.keys.resultKey(r.Uuid))
+	}
+	args := append([]string{
+		s.keys.prefix(shard),
+		strconv.FormatInt(unixMilli(time.Now()), 10),
+		r.Uuid,
+		queueName(r),
+	}, requestPairs(r)...)
+	err := addRequestScript.Run(s.redisClient, keys, args).Err()
+	if err != nil {
+		golog.Error("RedisStore", "AddRequest", "add request error", 0,
+			r.LogFields(
+				"set", set,
+				"err", err.Error())...)
+		return err
+	}
+
+	return nil
+}
+
+//按队列顺序依次轮询各个分片，所有分片都为空时返回ErrKeyNotExist
+func (s *RedisStore) PopRequest(queues []string, lease time.Duration) (*task.TaskRequest, error) {
+	start := int(atomic.AddUint32(&s.next, 1))
+	for _, queue := range queues {
+		for i := 0; i < s.keys.shards; i++ {
+			shard := (start + i) % s.keys.shards
+			req, err := s.popRequest(queue, shard, lease)
+			if err == errors.ErrKeyNotExist {
+				continue
+			}
+			return req, err
+		}
+	}
+	return nil, errors.ErrKeyNotExist
+}
+
+func (s *RedisStore) popRequest(queue string, shard int, lease time.Duration) (*task.TaskRequest, error) {
+	keys := []string{s.keys.requestSet(queue, shard), s.keys.runningSet(shard)}
+	now := time.Now()
+	args := append([]string{
+		s.keys.prefix(shard),
+		strconv.FormatInt(unixMilli(now.Add(lease)), 10),
+		strconv.FormatInt(unixMilli(now), 10),
+	}, requestFields...)
+	request, err := popRequestScript.Run(s.redisClient, keys, args).Result()
+	//没有请求
+	if err == redis.Nil {
+		return nil, errors.ErrKeyNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	vals, ok := request.([]interface{})
+	if !ok {
+		return nil, errors.ErrInvalidArgument
+	}
+	return parseTaskRequest(vals)
+}
+
+func (s *RedisStore) SetResult(result *task.TaskResult, keepTime time.Duration) error {
+	shard := s.keys.shard(result.Uuid)
+	keys := []string{
+		s.keys.resultKey(result.Uuid),
+		s.keys.failSet(shard),
+		s.keys.runningSet(shard),
+		s.keys.taskKey(result.Uuid),
+	}
+	for _, kind := range notifyKinds(result) {
+		keys = append(keys, s.keys.notifySet(kind, shard))
+	}
+	isSuccess := strconv.Itoa(int(result.IsSuccess))
+	now := time.Now()
+	state := result.State()
+	args := append([]string{result.Uuid,
+		strconv.FormatInt(int64(keepTime/time.Millisecond), 10),
+		isSuccess,
+		config.ResultChannel,
+		s.keys.prefix(shard),
+		strconv.FormatInt(unixMilli(now), 10),
+		state,
+		statusKeepTime(state),
+		strconv.FormatInt(unixMilli(now.Add(keepTime)), 10),
+	}, resultPairs(result)...)
+	return setResultScript.Run(s.redisClient, keys, args).Err()
+}
+
+func (s *RedisStore) GetResult(uuid string) (*task.TaskResult, error) {
+	key := s.keys.resultKey(uuid)
+	results, err := s.redisClient.HMGet(key, resultFields...).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseTaskResult(results)
+}
+
+func (s *RedisStore) PopFailResult() (*task.TaskResult, error) {
+	start := int(atomic.AddUint32(&s.next, 1))
+	for i := 0; i < s.keys.shards; i++ {
+		shard := (start + i) % s.keys.shards
+		keys := []string{s.keys.failSet(shard), s.keys.runningSet(shard)}
+		args := append([]string{
+			s.keys.prefix(shard),
+			strconv.FormatInt(unixMilli(time.Now()), 10),
+			config.DefaultQueue,
+			strconv.Itoa(len(requestFields)),
+		}, resultFields...)
+		result, err := popFailResultScript.Run(s.redisClient, keys, args).Result()
+		//没有结果
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		vals, ok := result.([]interface{})
+		if !ok {
+			return nil, errors.ErrInvalidArgument
+		}
+		return parseTaskResult(vals)
+	}
+	return nil, errors.ErrKeyNotExist
+}
+
+func (s *RedisStore) RequeueExpired() (int, error) {
+	count := 0
+	now := strconv.FormatInt(unixMilli(time.Now()), 10)
+	for shard := 0; shard < s.keys.shards; shard++ {
+		keys := []string{s.keys.runningSet(shard)}
+		args := []string{now, s.keys.prefix(shard), config.RequestUuidSet, config.DefaultQueue}
+		n, err := requeueScript.Run(s.redisClient, keys, args).Result()
+		if err != nil {
+			return count, err
+		}
+		if v, ok := n.(int64); ok {
+			count += int(v)
+		}
+	}
+	return count, nil
+}
+
+func (s *RedisStore) ScheduleRequest(r *task.TaskRequest, at time.Time) error {
+	shard := s.keys.shard(r.Uuid)
+	keys := []string{s.keys.taskKey(r.Uuid), s.keys.runningSet(shard)}
+	args := append([]string{
+		s.keys.prefix(shard),
+		strconv.FormatInt(unixMilli(at), 10),
+		r.Uuid,
+		queueName(r),
+	}, requestPairs(r)...)
+	err := scheduleRequestScript.Run(s.redisClient, keys, args).Err()
+	if err != nil {
+		golog.Error("RedisStore", "ScheduleRequest", "schedule request error", 0,
+			r.LogFields("err", err.Error())...)
+		return err
+	}
+	return nil
+}
+
+func (s *RedisStore) AddRequestOnce(r *task.TaskRequest, window time.Duration, at time.Time) (string, error) {
+	//脚本中的key要位于同一个slot，集群模式下换成与幂等键同一分片的uuid
+	shard := s.keys.shard(r.IdempotencyKey)
+	for s.keys.shard(r.Uuid) != shard {
+		r.Uuid = uuid.New()
+	}
+	keys := []string{
+		s.keys.taskKey(r.Uuid),
+		s.keys.requestSet(queueName(r), shard),
+		s.keys.runningSet(shard),
+		s.keys.idempotencyKey(r.IdempotencyKey),
+	}
+	now := time.Now()
+	args := append([]string{
+		s.keys.prefix(shard),
+		strconv.FormatInt(unixMilli(now), 10),
+		r.Uuid,
+		queueName(r),
+		strconv.FormatInt(int64(window/time.Millisecond), 10),
+		strconv.FormatInt(unixMilli(at), 10),
+	}, requestPairs(r)...)
+	ret, err := addRequestOnceScript.Run(s.redisClient, keys, args).Result()
+	if err != nil {
+		golog.Error("RedisStore", "AddRequestOnce", "add request error", 0,
+			r.LogFields(
+				"idempotency_key", r.IdempotencyKey,
+				"err", err.Error())...)
+		return "", err
+	}
+	old, ok := ret.(string)
+	if !ok {
+		return "", errors.ErrInvalidArgument
+	}
+	return old, nil
+}
+
+func (s *RedisStore) GetIdempotencyKey(key string) (string, error) {
+	ret, err := s.redisClient.Get(s.keys.idempotencyKey(key)).Result()
+	if err == redis.Nil {
+		return "", errors.ErrKeyNotExist
+	}
+	if err != nil {
+		return "", err
+	}
+	return ret, nil
+}
+
+func (s *RedisStore) AcquireSlot(key string, holder string, limit int, lease time.Duration) (bool, error) {
+	now := time.Now()
+	keys := []string{s.keys.slotKey(key)}
+	args := []string{
+		holder,
+		strconv.Itoa(limit),
+		strconv.FormatInt(unixMilli(now), 10),
+		strconv.FormatInt(unixMilli(now.Add(lease)), 10),
+	}
+	ret, err := acquireSlotScript.Run(s.redisClient, keys, args).Result()
+	if err != nil {
+		return false, err
+	}
+	return ret == int64(1), nil
+}
+
+func (s *RedisStore) ReleaseSlot(key string, holder string) error {
+	return s.redisClient.ZRem(s.keys.slotKey(key), holder).Err()
+}
+
+func (s *RedisStore) DeferRequest(uuid string, delay time.Duration) error {
+	shard := s.keys.shard(uuid)
+	now := time.Now()
+	keys := []string{s.keys.runningSet(shard)}
+	args := []string{
+		uuid,
+		strconv.FormatInt(unixMilli(now.Add(delay)), 10),
+		s.keys.prefix(shard),
+		strconv.FormatInt(unixMilli(now), 10),
+	}
+	return deferRequestScript.Run(s.redisClient, keys, args).Err()
+}
+
+func (s *RedisStore) TakeToken(key string, limit int, period time.Duration) (time.Duration, error) {
+	keys := []string{s.keys.rateKey(key)}
+	args := []string{strconv.Itoa(limit), strconv.FormatInt(int64(period/time.Millisecond), 10)}
+	ret, err := takeTokenScript.Run(s.redisClient, keys, args).Result()
+	if err != nil {
+		return 0, err
+	}
+	wait, ok := ret.(int64)
+	if !ok {
+		return 0, errors.ErrInvalidArgument
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+func (s *RedisStore) ReturnToken(key string, limit int, period time.Duration) error {
+	keys := []string{s.keys.rateKey(key)}
+	args := []string{strconv.Itoa(limit), strconv.FormatInt(int64(period/time.Millisecond), 10)}
+	return returnTokenScript.Run(s.redisClient, keys, args).Err()
+}
+
+func (s *RedisStore) DelRequest(uuid string) (bool, error) {
+	shard := s.keys.shard(uuid)
+	keys := []string{s.keys.runningSet(shard), s.keys.taskKey(uuid)}
+	args := []string{
+		uuid,
+		s.keys.prefix(shard),
+		strconv.FormatInt(unixMilli(time.Now()), 10),
+		statusKeepTime(task.StateCancelled),
+	}
+	ret, err := delRequestScript.Run(s.redisClient, keys, args).Result()
+	if err != nil {
+		return false, err
+	}
+	return ret == int64(1), nil
+}
+
+//待执行队列中可能残留已被删除的任务，结果是近似值
+func (s *RedisStore) QueueDepths() (map[string]int64, error) {
+	depths := map[string]int64{config.DefaultQueue: 0}
+	for shard := 0; shard < s.keys.shards; shard++ {
+		queues, err := s.redisClient.SMembers(s.keys.queueNames(shard)).Result()
+		if err != nil {
+			return nil, err
+		}
+		queues = append(queues, config.DefaultQueue)
+		seen := make(map[string]bool, len(queues))
+		for _, queue := range queues {
+			if seen[queue] {
+				continue
+			}
+			seen[queue] = true
+			n, err := s.redisClient.SCard(s.keys.requestSet(queue, shard)).Result()
+			if err != nil {
+				return nil, err
+			}
+			depths[queue] += n
+		}
+	}
+	return depths, nil
+}
+
+func (s *RedisStore) Heartbeat(w *task.WorkerInfo, ttl time.Duration) error {
+	buf, err := json.Marshal(&workerEntry{
+		Worker:   w,
+		ExpireAt: time.Now().Add(ttl).UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+	return s.redisClient.HSet(s.keys.workers(), w.Id, string(buf)).Err()
+}
+
+//顺便删除已经过期的心跳
+func (s *RedisStore) ListWorkers() ([]*task.WorkerInfo, error) {
+	vals, err := s.redisClient.HGetAllMap(s.keys.workers()).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixNano()
+	var workers []*task.WorkerInfo
+	var expired []string
+	for id, val := range vals {
+		entry := new(workerEntry)
+		if err := json.Unmarshal([]byte(val), entry); err != nil || entry.Worker == nil ||
+			entry.ExpireAt <= now {
+			expired = append(expired, id)
+			continue
+		}
+		workers = append(workers, entry.Worker)
+	}
+	if len(expired) != 0 {
+		s.redisClient.HDel(s.keys.workers(), expired...)
+	}
+	sort.Sort(workerList(workers))
+	return workers, nil
+}
+
+func (s *RedisStore) SetState(r *task.TaskRequest, state string) error {
+	shard := s.keys.shard(r.Uuid)
+	args := append([]string{
+		s.keys.prefix(shard),
+		r.Uuid,
+		state,
+		strconv.FormatInt(unixMilli(time.Now()), 10),
+		statusKeepTime(state),
+	}, statusPairs(r)...)
+	return setStateScript.Run(s.redisClient, []string{s.keys.statusKey(r.Uuid)}, args).Err()
+}
+
+func (s *RedisStore) GetStatus(uuid string) (*task.TaskStatus, error) {
+	vals, err := s.redisClient.HMGet(s.keys.statusKey(uuid), statusFields...).Result()
+	if err != nil {
+		return nil, err
+	}
+	st, err := parseTaskStatus(vals)
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.redisClient.LRange(s.keys.statusHistoryKey(uuid), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	st.History, err = parseStateHistory(history)
+	if err != nil {
+		return nil, err
+	}
+	st.CheckExpired(unixMilli(time.Now()))
+	return st, nil
+}
+
+func (s *RedisStore) PruneStatus(limit int) (int, error) {
+	total := 0
+	now := strconv.FormatInt(unixMilli(time.Now()), 10)
+	for shard := 0; shard < s.keys.shards; shard++ {
+		keys := []string{s.keys.indexKey("expire", shard)}
+		args := []string{s.keys.prefix(shard), now, strconv.Itoa(limit), config.DefaultQueue}
+		n, err := pruneStatusScript.Run(s.redisClient, keys, args).Result()
+		if err != nil {
+			return total, err
+		}
+		if v, ok := n.(int64); ok {
+			total += int(v)
+		}
+	}
+	return total, nil
+}
+
+//每个分片返回按顺序排列的一段任务，合并后只保留所有分片都已经扫描过的部分，
+//下一页从最后一个任务或者最早停止扫描的位置继续
+func (s *RedisStore) ListTasks(q *task.TaskQuery) ([]*task.TaskStatus, string, error) {
+	limit := queryLimit(q)
+	max, min, cursor := "+inf", "-inf", ""
+	if q.Until != 0 {
+		max = strconv.FormatInt(q.Until, 10)
+	}
+	if q.Since != 0 {
+		min = strconv.FormatInt(q.Since, 10)
+	}
+	if len(q.Cursor) != 0 {
+		c, err := parseListCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if q.Until == 0 || c.submit <= q.Until {
+			max, cursor = strconv.FormatInt(c.submit, 10), c.uuid
+		}
+	}
+	state := q.State
+	if state == task.StateExpired {
+		state = ""
+	}
+
+	var candidates []*task.TaskStatus
+	var stop *listCursor
+	index := queryIndex(q)
+	for shard := 0; shard < s.keys.shards; shard++ {
+		keys := []string{s.keys.indexKey(index, shard)}
+		args := append([]string{
+			s.keys.prefix(shard), max, min, cursor, strconv.Itoa(limit),
+			state, q.BinName, q.Queue, config.DefaultQueue,
+		}, statusFields...)
+		ret, err := listTasksScript.Run(s.redisClient, keys, args).Result()
+		if err != nil {
+			return nil, "", err
+		}
+		vals, ok := ret.([]interface{})
+		if !ok || len(vals) < 2 {
+			return nil, "", errors.ErrInvalidArgument
+		}
+		if submit, _ := vals[0].(string); len(submit) != 0 {
+			uuid, _ := vals[1].(string)
+			c, err := parseListCursor(submit + ":" + uuid)
+			if err != nil {
+				return nil, "", err
+			}
+			if stop == nil || c.before(stop) {
+				stop = c
+			}
+		}
+		for i := 2; i+len(statusFields) <= len(vals); i += len(statusFields) {
+			st, err := parseTaskStatus(vals[i : i+len(statusFields)])
+			if err != nil {
+				return nil, "", err
+			}
+			candidates = append(candidates, st)
+		}
+	}
+
+	sort.Sort(statusList(candidates))
+	if stop != nil {
+		n := 0
+		for n < len(candidates) && !stop.before(statusCursor(candidates[n])) {
+			n++
+		}
+		candidates = candidates[:n]
+	}
+	next := ""
+	if limit <= len(candidates) {
+		candidates = candidates[:limit]
+		next = statusCursor(candidates[limit-1]).String()
+	} else if stop != nil {
+		next = stop.String()
+	}
+
+	now := unixMilli(time.Now())
+	tasks := make([]*task.TaskStatus, 0, len(candidates))
+	for _, st := range candidates {
+		st.CheckExpired(now)
+		if matchQuery(q, st) {
+			tasks = append(tasks, st)
+		}
+	}
+	return tasks, next, nil
+}
+
+func (s *RedisStore) SetWorkflow(wf *task.Workflow, keepTime time.Duration) error {
+	data, err := json.Marshal(wf)
+	if err != nil {
+		return err
+	}
+	keys := []string{
+		s.keys.workflowKey(wf.Uuid),
+		s.keys.runningWorkflows(s.keys.shard(wf.Uuid)),
+	}
+	args := []string{
+		wf.Uuid,
+		string(data),
+		strconv.FormatInt(int64(keepTime/time.Millisecond), 10),
+	}
+	return setWorkflowScript.Run(s.redisClient, keys, args).Err()
+}
+
+func (s *RedisStore) RunningWorkflows() ([]string, error) {
+	var uuids []string
+	for shard := 0; shard < s.keys.shards; shard++ {
+		members, err := s.redisClient.SMembers(s.keys.runningWorkflows(shard)).Result()
+		if err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, members...)
+	}
+	return uuids, nil
+}
+
+func (s *RedisStore) GetWorkflow(uuid string) (*task.Workflow, error) {
+	data, err := s.redisClient.Get(s.keys.workflowKey(uuid)).Result()
+	if err == redis.Nil {
+		return nil, errors.ErrKeyNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	wf := new(task.Workflow)
+	err = json.Unmarshal([]byte(data), wf)
+	if err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+//从随机的分片开始查看结果，结果已过期时直接删除
+func (s *RedisStore) NextNotify(kind string, count int) ([]*task.TaskResult, error) {
+	var results []*task.TaskResult
+	start := int(atomic.AddUint32(&s.next, 1))
+	for i := 0; i < s.keys.shards && len(results) < count; i++ {
+		set := s.keys.notifySet(kind, (start+i)%s.keys.shards)
+		uuids, err := s.redisClient.SRandMemberN(set, int64(count-len(results))).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, uuid := range uuids {
+			result, err := s.GetResult(uuid)
+			if err == errors.ErrKeyNotExist {
+				s.redisClient.SRem(set, uuid)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, result)
+		}
+	}
+	if len(results) == 0 {
+		return nil, errors.ErrKeyNotExist
+	}
+	return results, nil
+}
+
+func (s *RedisStore) AckNotify(kind string, uuid string) error {
+	set := s.keys.notifySet(kind, s.keys.shard(uuid))
+	return s.redisClient.SRem(set, uuid).Err()
+}
+
+func (s *RedisStore) SetCallback(st *task.CallbackStatus, keepTime time.Duration) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return s.redisClient.Set(s.keys.callbackKey(st.Uuid), string(data), keepTime).Err()
+}
+
+func (s *RedisStore) GetCallback(uuid string) (*task.CallbackStatus, error) {
+	data, err := s.redisClient.Get(s.keys.callbackKey(uuid)).Result()
+	if err == redis.Nil {
+		return nil, errors.ErrKeyNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := new(task.CallbackStatus)
+	err = json.Unmarshal([]byte(data), st)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *RedisStore) SetProgress(p *task.Progress, keepTime time.Duration) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.redisClient.Set(s.keys.progressKey(p.Uuid), string(data), keepTime).Err()
+}
+
+func (s *RedisStore) GetProgress(uuid string) (*task.Progress, error) {
+	data, err := s.redisClient.Get(s.keys.progressKey(uuid)).Result()
+	if err == redis.Nil {
+		return nil, errors.ErrKeyNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := new(task.Progress)
+	err = json.Unmarshal([]byte(data), p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *RedisStore) AppendLogs(uuid string, lines []*task.LogLine, maxLines int, keepTime time.Duration) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	args := []string{
+		strconv.Itoa(maxLines),
+		strconv.FormatInt(int64(keepTime/time.Millisecond), 10),
+	}
+	for _, line := range lines {
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		args = append(args, string(data))
+	}
+	keys := []string{s.keys.logKey(uuid), s.keys.logSeqKey(uuid)}
+	return appendLogScript.Run(s.redisClient, keys, args).Err()
+}
+
+func (s *RedisStore) GetLogs(uuid string, from int64, count int) ([]*task.LogLine, int64, error) {
+	keys := []string{s.keys.logKey(uuid), s.keys.logSeqKey(uuid)}
+	args := []string{strconv.FormatInt(from, 10), strconv.Itoa(count)}
+	ret, err := getLogsScript.Run(s.redisClient, keys, args).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	vals, ok := ret.([]interface{})
+	if !ok || len(vals) == 0 {
+		return nil, 0, errors.ErrInvalidArgument
+	}
+	next, ok := vals[0].(int64)
+	if !ok {
+		return nil, 0, errors.ErrInvalidArgument
+	}
+	lines := make([]*task.LogLine, 0, len(vals)-1)
+	for _, v := range vals[1:] {
+		entry, _ := v.(string)
+		sep := strings.IndexByte(entry, ' ')
+		if sep < 0 {
+			return nil, 0, errors.ErrInvalidArgument
+		}
+		line := new(task.LogLine)
+		err = json.Unmarshal([]byte(entry[sep+1:]), line)
+		if err != nil {
+			return nil, 0, err
+		}
+		line.Seq, err = strconv.ParseInt(entry[:sep], 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, next, nil
+}
+
+func (s *RedisStore) WatchResults() (ResultWatcher, error) {
+	w := &redisWatcher{
+		store: s,
+		uuids: make(chan string, 1024),
+		quit:  make(chan struct{}),
+	}
+	if client, ok := rawClient(s.redisClient).(*redis.Client); ok {
+		w.pubsub = client.PubSub()
+	} else {
+		//依次尝试集群中的节点
+		opt := *s.pubsubOpt
+		opt.Addr = s.clusterAddrs[int(atomic.AddUint32(&s.next, 1))%len(s.clusterAddrs)]
+		w.client = redis.NewClient(&opt)
+		w.pubsub = w.client.PubSub()
+	}
+	err := w.pubsub.Subscribe(config.ResultChannel)
+	if err != nil {
+		w.close()
+		return nil, err
+	}
+
+	s.Lock()
+	s.watchers[w] = true
+	s.Unlock()
+	go w.run()
+	return w, nil
+}
+
+func (s *RedisStore) Close() error {
+	s.Lock()
+	for w := range s.watchers {
+		w.close()
+	}
+	s.watchers = nil
+	s.Unlock()
+	return s.redisClient.Close()
+}
+
+type redisWatcher struct {
+	store  *RedisStore
+	pubsub *redis.PubSub
+	client *redis.Client
+	uuids  chan string
+	quit   chan struct{}
+	once   sync.Once
+}
+
+func (w *redisWatcher) Uuids() <-chan string {
+	return w.uuids
+}
+
+func (w *redisWatcher) Close() error {
+	w.store.Lock()
+	delete(w.store.watchers, w)
+	w.store.Unlock()
+	w.close()
+	return nil
+}
+
+func (w *redisWatcher) close() {
+	w.once.Do(func() {
+		close(w.quit)
+		w.pubsub.Close()
+		if w.client != nil {
+			w.client.Close()
+		}
+	})
+}
+
+//ReceiveMessage在网络错误时自动重连，其它错误时结束订阅
+func (w *redisWatcher) run() {
+	defer close(w.uuids)
+	for {
+		msg, err := w.pubsub.ReceiveMessage()
+		if err != nil {
+			select {
+			case <-w.quit:
+			default:
+				golog.Error("RedisStore", "WatchResults", "receive message error", 0,
+					"err", err.Error())
+			}
+			return
+		}
+		select {
+		case w.uuids <- msg.Payload:
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,251 @@
+//任务存储层，broker和worker通过Store解耦。
+//每个方法都是一次原子的状态变更，进程在任意两次调用之间崩溃都不会丢失或重复任务。
+package store
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+type Store interface {
+	//写入异步任务，并放入待执行队列
+	AddRequest(r *task.TaskRequest) error
+	//按顺序从各个队列中取出一个任务放入执行中队列，租约到期前没有写入结果的任务
+	//会被RequeueExpired放回待执行队列。队列都为空时返回ErrKeyNotExist
+	PopRequest(queues []string, lease time.Duration) (*task.TaskRequest, error)
+	//保存任务结果并结束执行中的任务，失败的任务同时放入失败队列
+	SetResult(r *task.TaskResult, keepTime time.Duration) error
+	//查询任务结果，结果不存在时返回ErrKeyNotExist
+	GetResult(uuid string) (*task.TaskResult, error)
+	//从失败队列中取出一个任务结果，还会重试的任务同时删除结果，并把下一次重试写入
+	//执行中队列，到重试时间后由RequeueExpired放回待执行队列。队列为空时返回ErrKeyNotExist
+	PopFailResult() (*task.TaskResult, error)
+	//把租约过期的任务放回待执行队列，返回放回的任务数。等待期间已结束(如被取消)的任务直接丢弃
+	RequeueExpired() (int, error)
+	//写入在at时才放入待执行队列的任务，由RequeueExpired到期放回，不改变任务状态。
+	//broker退出时用于保存定时器中还在等待的任务
+	ScheduleRequest(r *task.TaskRequest, at time.Time) error
+	//写入带幂等键的任务，任务和幂等键在同一次操作中写入，键在有效期内已绑定时不写入任务，
+	//返回已有的uuid。at晚于当前时间的任务放入执行中队列，到期后由RequeueExpired放回。
+	//redis集群模式下任务要与幂等键位于同一分片，r.Uuid可能被替换为新的uuid
+	AddRequestOnce(r *task.TaskRequest, window time.Duration, at time.Time) (string, error)
+	//幂等键绑定的uuid，不存在或者已过期时返回ErrKeyNotExist
+	GetIdempotencyKey(key string) (string, error)
+	//在并发键上获取一个带租约的名额，名额已满时返回false。
+	//持有者崩溃后名额在租约到期时自动释放
+	AcquireSlot(key string, holder string, limit int, lease time.Duration) (bool, error)
+	ReleaseSlot(key string, holder string) error
+	//把执行中的任务在delay后放回待执行队列，不计入重试次数
+	DeferRequest(uuid string, delay time.Duration) error
+	//从令牌桶中取一个令牌，每period补充limit个，没有令牌时返回需要等待的时间
+	TakeToken(key string, limit int, period time.Duration) (time.Duration, error)
+	//归还TakeToken取得的令牌，令牌数不超过limit
+	ReturnToken(key string, limit int, period time.Duration) error
+	//记录由broker决定的状态变更，其它状态在任务入队、取出、写入结果时记录
+	SetState(r *task.TaskRequest, state string) error
+	GetStatus(uuid string) (*task.TaskStatus, error)
+	//删除到期的任务状态及其在查询索引中的记录，每个分片最多删除limit个，返回删除的数量
+	PruneStatus(limit int) (int, error)
+	//按条件分页查询任务，返回下一页的游标，没有更多任务时游标为空
+	ListTasks(q *task.TaskQuery) ([]*task.TaskStatus, string, error)
+	//订阅结果写入的通知
+	WatchResults() (ResultWatcher, error)
+	//删除还未被取出执行的任务，任务已在执行或不存在时返回false
+	DelRequest(uuid string) (bool, error)
+	//删除已结束任务的结果并重新放入待执行队列
+	RetryRequest(r *task.TaskRequest) error
+	//各个队列中待执行的任务数
+	QueueDepths() (map[string]int64, error)
+	//记录worker的心跳，ttl内没有再次上报的worker不再出现在ListWorkers中
+	Heartbeat(w *task.WorkerInfo, ttl time.Duration) error
+	ListWorkers() ([]*task.WorkerInfo, error)
+	//保存工作流，keepTime为0时不过期
+	SetWorkflow(wf *task.Workflow, keepTime time.Duration) error
+	//查询工作流，不存在时返回ErrKeyNotExist
+	GetWorkflow(uuid string) (*task.Workflow, error)
+	//没有保存时间(还未结束)的工作流的uuid
+	RunningWorkflows() ([]string, error)
+	//查看最多count个需要kind类通知的已结束任务的结果，处理完成后调用AckNotify删除，
+	//broker在两者之间崩溃时结果会被再次处理。没有结果时返回ErrKeyNotExist
+	NextNotify(kind string, count int) ([]*task.TaskResult, error)
+	AckNotify(kind string, uuid string) error
+	//保存回调的投递状态
+	SetCallback(st *task.CallbackStatus, keepTime time.Duration) error
+	//查询回调的投递状态，不存在时返回ErrKeyNotExist
+	GetCallback(uuid string) (*task.CallbackStatus, error)
+	//保存任务最近一次报告的进度
+	SetProgress(p *task.Progress, keepTime time.Duration) error
+	GetProgress(uuid string) (*task.Progress, error)
+	//追加任务输出，由存储分配序号，只保留最后maxLines行
+	AppendLogs(uuid string, lines []*task.LogLine, maxLines int, keepTime time.Duration) error
+	//读取序号不小于from的日志，最多count行，同时返回下次读取的起始序号
+	GetLogs(uuid string, from int64, count int) ([]*task.LogLine, int64, error)
+	Close() error
+}
+
+//结果写入的通知，只用于唤醒等待者，连接断开期间的通知会丢失
+type ResultWatcher interface {
+	//已写入结果的任务uuid，Close或者连接断开后关闭
+	Uuids() <-chan string
+	Close() error
+}
+
+//worker心跳及其过期时间，单位为纳秒
+type workerEntry struct {
+	Worker   *task.WorkerInfo `json:"worker"`
+	ExpireAt int64            `json:"expire_at"`
+}
+
+//每个任务保存的状态变更历史条数，与redis脚本中的值一致
+const maxStateHistory = 100
+
+//任务结束后状态保存的时间
+var statusKeep = time.Second * config.DefaultStatusKeepTime
+
+//任务结束后状态保存的毫秒数，未结束时为空
+func statusKeepTime(state string) string {
+	if !task.IsFinalState(state) {
+		return ""
+	}
+	return strconv.FormatInt(int64(statusKeep/time.Millisecond), 10)
+}
+
+func queueName(r *task.TaskRequest) string {
+	if len(r.Queue) == 0 {
+		return config.DefaultQueue
+	}
+	return r.Queue
+}
+
+//失败后的下一次重试及其开始时间，开始时间改为重试的时间，worker据此统计排队时间。
+//与popFailResultScript中的计算方式一致
+func nextRetry(r *task.TaskRequest, now time.Time) (*task.TaskRequest, time.Time, bool) {
+	if !r.HasRetry() {
+		return nil, now, false
+	}
+	next := new(task.TaskRequest)
+	*next = *r
+	next.Index++
+	delay, _ := strconv.Atoi(strings.Split(r.TimeInterval, " ")[next.Index])
+	at := now.Add(time.Second * time.Duration(delay))
+	next.StartTime = at.Unix()
+	return next, at, true
+}
+
+//任务结束时需要broker处理的通知：推进工作流、投递回调
+func notifyKinds(r *task.TaskResult) []string {
+	if !r.IsFinal() {
+		return nil
+	}
+	var kinds []string
+	if len(r.Workflow) != 0 {
+		kinds = append(kinds, config.NotifyWorkflow)
+	}
+	if len(r.CallbackUrl) != 0 {
+		kinds = append(kinds, config.NotifyCallback)
+	}
+	return kinds
+}
+
+func NewStore(cfg *config.StoreConfig) (Store, error) {
+	switch cfg.Store {
+	case "", config.StoreRedis:
+		return NewRedisStore(cfg)
+	case config.StoreFile:
+		interval := cfg.CompactInterval
+		if interval == 0 {
+			interval = config.DefaultCompactInterval
+		}
+		return NewFileStore(cfg.DataDir, time.Second*time.Duration(interval))
+	default:
+		return nil, errors.ErrStoreType
+	}
+}
+
+//分页游标为 "提交时间:uuid"，任务按提交时间从新到旧、uuid从大到小排列
+type listCursor struct {
+	submit int64
+	uuid   string
+}
+
+func parseListCursor(s string) (*listCursor, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, errors.ErrInvalidArgument
+	}
+	submit, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return nil, errors.ErrInvalidArgument
+	}
+	return &listCursor{submit, s[i+1:]}, nil
+}
+
+func statusCursor(st *task.TaskStatus) *listCursor {
+	return &listCursor{st.SubmitTime, st.Uuid}
+}
+
+func (c *listCursor) String() string {
+	return strconv.FormatInt(c.submit, 10) + ":" + c.uuid
+}
+
+//c排在o之前
+func (c *listCursor) before(o *listCursor) bool {
+	return o.submit < c.submit || (c.submit == o.submit && o.uuid < c.uuid)
+}
+
+//查询使用的索引：优先按状态，其次按可执行文件、队列，都没有时使用全部任务的索引。
+//expired状态是查询时计算的，没有对应的索引
+func queryIndex(q *task.TaskQuery) string {
+	switch {
+	case len(q.State) != 0 && q.State != task.StateExpired:
+		return "state:" + q.State
+	case len(q.BinName) != 0:
+		return "bin:" + q.BinName
+	case len(q.Queue) != 0:
+		return "queue:" + q.Queue
+	}
+	return "all"
+}
+
+func queryLimit(q *task.TaskQuery) int {
+	if q.Limit <= 0 {
+		return config.DefaultListLimit
+	}
+	if config.MaxListLimit < q.Limit {
+		return config.MaxListLimit
+	}
+	return q.Limit
+}
+
+//st已经计算过expired状态
+func matchQuery(q *task.TaskQuery, st *task.TaskStatus) bool {
+	queue := st.Queue
+	if len(queue) == 0 {
+		queue = config.DefaultQueue
+	}
+	return (len(q.State) == 0 || q.State == st.State) &&
+		(len(q.BinName) == 0 || q.BinName == st.BinName) &&
+		(len(q.Queue) == 0 || q.Queue == queue) &&
+		(q.Since == 0 || q.Since <= st.SubmitTime) &&
+		(q.Until == 0 || st.SubmitTime <= q.Until)
+}
+
+//按游标的顺序排列任务状态
+type statusList []*task.TaskStatus
+
+func (l statusList) Len() int      { return len(l) }
+func (l statusList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l statusList) Less(i, j int) bool {
+	return statusCursor(l[i]).before(statusCursor(l[j]))
+}
+
+type workerList []*task.WorkerInfo
+
+func (l workerList) Len() int           { return len(l) }
+func (l workerList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l workerList) Less(i, j int) bool { return l[i].Id < l[j].Id }
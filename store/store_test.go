@@ -0,0 +1,956 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+// 设置该环境变量后同时测试redis存储，如 127.0.0.1:6379/15，测试会清空该数据库
+const testRedisEnv = "KINGTASK_TEST_REDIS"
+
+var defaultQueues = []string{config.DefaultQueue}
+
+type storeOpener func(t *testing.T) Store
+
+// 每个测试使用一个新的文件存储
+func withFileStore(t *testing.T, fn func(*testing.T, Store)) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	fn(t, s)
+}
+
+// 设置了testRedisEnv时使用清空后的redis数据库
+func withRedisStore(t *testing.T, fn func(*testing.T, Store)) {
+	addr := os.Getenv(testRedisEnv)
+	if len(addr) == 0 {
+		t.Skip("set " + testRedisEnv + " to run redis store tests")
+	}
+	s, err := NewRedisStore(&config.StoreConfig{RedisAddr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	rawClient(s.redisClient).(*redis.Client).FlushDb()
+	fn(t, s)
+}
+
+// 模拟进程在每两次存储操作之间崩溃，重新打开存储后检查任务既不丢失也不重复
+func testCrashAtEachStep(t *testing.T, open storeOpener) {
+	const lease = time.Millisecond * 200
+	steps := []string{"after_add", "after_pop", "after_set_result", "after_pop_fail"}
+
+	for _, step := range steps {
+		r, err := task.NewTaskRequest("example", []string{step}, 0, []int{5, 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := open(t)
+		crash := func(at string) {
+			if at == step {
+				s.Close()
+				s = open(t)
+			}
+		}
+
+		err = s.AddRequest(r)
+		if err != nil {
+			t.Fatalf("%s: add request:%v", step, err)
+		}
+		crash("after_add")
+
+		req, err := s.PopRequest(defaultQueues, lease)
+		if err != nil || req.Uuid != r.Uuid {
+			t.Fatalf("%s: pop request:%v,%v", step, req, err)
+		}
+		if step == "after_pop" {
+			crash("after_pop")
+			//租约未过期前不能被其它worker取走
+			if _, err = s.PopRequest(defaultQueues, lease); err != errors.ErrKeyNotExist {
+				t.Fatalf("%s: running task popped again, err=%v", step, err)
+			}
+			time.Sleep(lease)
+			count, err := s.RequeueExpired()
+			if err != nil || count != 1 {
+				t.Fatalf("%s: requeue expired:%d,%v", step, count, err)
+			}
+			req, err = s.PopRequest(defaultQueues, lease)
+			if err != nil || req.Uuid != r.Uuid {
+				t.Fatalf("%s: pop requeued request:%v,%v", step, req, err)
+			}
+		}
+
+		result := &task.TaskResult{TaskRequest: *req, IsSuccess: 0, Result: "fail"}
+		err = s.SetResult(result, time.Hour)
+		if err != nil {
+			t.Fatalf("%s: set result:%v", step, err)
+		}
+		crash("after_set_result")
+		time.Sleep(lease)
+		count, err := s.RequeueExpired()
+		if err != nil || count != 0 {
+			t.Fatalf("%s: finished task requeued:%d,%v", step, count, err)
+		}
+		if _, err = s.PopRequest(defaultQueues, lease); err != errors.ErrKeyNotExist {
+			t.Fatalf("%s: finished task popped again, err=%v", step, err)
+		}
+
+		ret, err := s.PopFailResult()
+		if err != nil || ret.Uuid != r.Uuid {
+			t.Fatalf("%s: pop fail result:%v,%v", step, ret, err)
+		}
+		crash("after_pop_fail")
+		if _, err = s.PopFailResult(); err != errors.ErrKeyNotExist {
+			t.Fatalf("%s: fail result popped twice, err=%v", step, err)
+		}
+		//还会重试的任务结果随失败队列一起删除
+		if _, err = s.GetResult(r.Uuid); err != errors.ErrKeyNotExist {
+			t.Fatalf("%s: retry result not deleted, err=%v", step, err)
+		}
+		//下一次重试保存在存储中，到重试时间后放回待执行队列
+		if count, err = s.RequeueExpired(); err != nil || count != 0 {
+			t.Fatalf("%s: retry requeued before its time:%d,%v", step, count, err)
+		}
+		time.Sleep(time.Second)
+		if count, err = s.RequeueExpired(); err != nil || count != 1 {
+			t.Fatalf("%s: retry lost:%d,%v", step, count, err)
+		}
+		req, err = s.PopRequest(defaultQueues, lease)
+		if err != nil || req.Uuid != r.Uuid || req.Index != 1 {
+			t.Fatalf("%s: pop retry:%v,%v", step, req, err)
+		}
+		result = &task.TaskResult{TaskRequest: *req, IsSuccess: 1, Result: "ok"}
+		if err = s.SetResult(result, time.Hour); err != nil {
+			t.Fatalf("%s: set retry result:%v", step, err)
+		}
+		s.Close()
+	}
+}
+
+func TestFileStoreCrashAtEachStep(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	testCrashAtEachStep(t, func(t *testing.T) Store {
+		s, err := NewFileStore(dir, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+// 写日志过程中出错时回滚，状态不变且后续写入正常
+func TestFileStoreWriteFault(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	r1 := newRequest(t, "1")
+	s.AddRequest(r1)
+
+	fault := errors.NewError("no space left on device")
+	writeWal = func(f *os.File, buf []byte) (int, error) {
+		n, _ := f.Write(buf[:len(buf)/2])
+		return n, fault
+	}
+	_, err = s.PopRequest(defaultQueues, time.Minute)
+	writeWal = func(f *os.File, buf []byte) (int, error) {
+		return f.Write(buf)
+	}
+	if err != fault {
+		t.Fatalf("expect fault, err=%v", err)
+	}
+
+	req, err := s.PopRequest(defaultQueues, time.Minute)
+	if err != nil || req.Uuid != r1.Uuid {
+		t.Fatalf("pop request after fault:%v,%v", req, err)
+	}
+	s.Close()
+	s, err = NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.PopRequest(defaultQueues, time.Minute); err != errors.ErrKeyNotExist {
+		t.Fatalf("request popped twice, err=%v", err)
+	}
+}
+
+func TestRedisStoreCrashAtEachStep(t *testing.T) {
+	addr := os.Getenv(testRedisEnv)
+	if len(addr) == 0 {
+		t.Skip("set " + testRedisEnv + " to run redis store tests")
+	}
+	cfg := &config.StoreConfig{RedisAddr: addr}
+	s, err := NewRedisStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawClient(s.redisClient).(*redis.Client).FlushDb()
+	s.Close()
+
+	testCrashAtEachStep(t, func(t *testing.T) Store {
+		s, err := NewRedisStore(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func testIdempotency(t *testing.T, s Store) {
+	const window = time.Millisecond * 300
+	r1 := newRequest(t, "idem-1")
+	r1.IdempotencyKey = "order-1"
+	uuid, err := s.AddRequestOnce(r1, window, time.Now())
+	if err != nil || uuid != r1.Uuid {
+		t.Fatalf("add request once:%s,%v", uuid, err)
+	}
+	r2 := newRequest(t, "idem-2")
+	r2.IdempotencyKey = "order-1"
+	uuid, err = s.AddRequestOnce(r2, window, time.Now())
+	if err != nil || uuid != r1.Uuid {
+		t.Fatalf("duplicate idempotency key:%s,%v", uuid, err)
+	}
+	uuid, err = s.GetIdempotencyKey("order-1")
+	if err != nil || uuid != r1.Uuid {
+		t.Fatalf("get idempotency key:%s,%v", uuid, err)
+	}
+	//重复提交的任务没有写入
+	req, err := s.PopRequest(defaultQueues, time.Hour)
+	if err != nil || req.Uuid != r1.Uuid {
+		t.Fatalf("pop request:%v,%v", req, err)
+	}
+	if _, err = s.PopRequest(defaultQueues, time.Hour); err != errors.ErrKeyNotExist {
+		t.Fatalf("duplicate request queued, err=%v", err)
+	}
+
+	//开始时间未到的任务和幂等键一起写入，到期后放回待执行队列
+	r3 := newRequest(t, "idem-3")
+	r3.IdempotencyKey = "order-2"
+	uuid, err = s.AddRequestOnce(r3, window, time.Now().Add(time.Millisecond*100))
+	if err != nil || uuid != r3.Uuid {
+		t.Fatalf("add scheduled request once:%s,%v", uuid, err)
+	}
+	st, err := s.GetStatus(r3.Uuid)
+	if err != nil || st.State != task.StateScheduled {
+		t.Fatalf("scheduled status:%v,%v", st, err)
+	}
+	if _, err = s.PopRequest(defaultQueues, time.Hour); err != errors.ErrKeyNotExist {
+		t.Fatalf("scheduled request popped before due, err=%v", err)
+	}
+	time.Sleep(time.Millisecond * 150)
+	if _, err = s.RequeueExpired(); err != nil {
+		t.Fatal(err)
+	}
+	req, err = s.PopRequest(defaultQueues, time.Hour)
+	if err != nil || req.Uuid != r3.Uuid {
+		t.Fatalf("pop scheduled request:%v,%v", req, err)
+	}
+
+	//过期后可以重新绑定
+	time.Sleep(window)
+	if _, err = s.GetIdempotencyKey("order-1"); err != errors.ErrKeyNotExist {
+		t.Fatalf("idempotency key not expired, err=%v", err)
+	}
+	r4 := newRequest(t, "idem-4")
+	r4.IdempotencyKey = "order-1"
+	uuid, err = s.AddRequestOnce(r4, window, time.Now())
+	if err != nil || uuid != r4.Uuid {
+		t.Fatalf("rebind expired idempotency key:%s,%v", uuid, err)
+	}
+}
+
+// 写入任务和幂等键的过程中崩溃时两者都不存在，客户端重试可以重新提交
+func TestFileStoreIdempotencyCrash(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1 := newRequest(t, "1")
+	r1.IdempotencyKey = "order-1"
+	fault := errors.NewError("no space left on device")
+	writeWal = func(f *os.File, buf []byte) (int, error) {
+		n, _ := f.Write(buf[:len(buf)/2])
+		return n, fault
+	}
+	_, err = s.AddRequestOnce(r1, time.Hour, time.Now())
+	writeWal = func(f *os.File, buf []byte) (int, error) {
+		return f.Write(buf)
+	}
+	if err != fault {
+		t.Fatalf("expect fault, err=%v", err)
+	}
+	s.Close()
+
+	s, err = NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetIdempotencyKey("order-1"); err != errors.ErrKeyNotExist {
+		t.Fatalf("idempotency key bound without request, err=%v", err)
+	}
+	r2 := newRequest(t, "2")
+	r2.IdempotencyKey = "order-1"
+	uuid, err := s.AddRequestOnce(r2, time.Hour, time.Now())
+	if err != nil || uuid != r2.Uuid {
+		t.Fatalf("retry after crash:%s,%v", uuid, err)
+	}
+	s.Close()
+
+	//写入后崩溃时幂等键和任务都存在
+	s, err = NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	uuid, err = s.GetIdempotencyKey("order-1")
+	if err != nil || uuid != r2.Uuid {
+		t.Fatalf("idempotency key after crash:%s,%v", uuid, err)
+	}
+	req, err := s.PopRequest(defaultQueues, time.Minute)
+	if err != nil || req.Uuid != r2.Uuid {
+		t.Fatalf("request after crash:%v,%v", req, err)
+	}
+}
+
+func testConcurrencySlot(t *testing.T, s Store) {
+	const lease = time.Millisecond * 200
+	for _, holder := range []string{"a", "b"} {
+		ok, err := s.AcquireSlot("ledger", holder, 2, lease)
+		if err != nil || !ok {
+			t.Fatalf("acquire slot %s:%v,%v", holder, ok, err)
+		}
+	}
+	if ok, _ := s.AcquireSlot("ledger", "c", 2, lease); ok {
+		t.Fatalf("slot over limit acquired")
+	}
+	//已持有名额的可以续约
+	if ok, _ := s.AcquireSlot("ledger", "a", 2, lease); !ok {
+		t.Fatalf("holder can not renew slot")
+	}
+	s.ReleaseSlot("ledger", "a")
+	if ok, _ := s.AcquireSlot("ledger", "c", 2, lease); !ok {
+		t.Fatalf("released slot not acquired")
+	}
+	//持有者崩溃后名额在租约到期时释放
+	time.Sleep(lease)
+	if ok, _ := s.AcquireSlot("ledger", "d", 1, lease); !ok {
+		t.Fatalf("expired slot not released")
+	}
+	s.ReleaseSlot("ledger", "d")
+}
+
+func testDeferRequest(t *testing.T, s Store) {
+	r, _ := task.NewTaskRequest("example", nil, 0, nil)
+	s.AddRequest(r)
+	req, err := s.PopRequest(defaultQueues, time.Hour)
+	if err != nil || req.Uuid != r.Uuid {
+		t.Fatalf("pop request:%v,%v", req, err)
+	}
+	err = s.DeferRequest(req.Uuid, time.Millisecond*100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 150)
+	count, err := s.RequeueExpired()
+	if err != nil || count != 1 {
+		t.Fatalf("deferred request not requeued:%d,%v", count, err)
+	}
+	req, err = s.PopRequest(defaultQueues, time.Hour)
+	if err != nil || req.Uuid != r.Uuid {
+		t.Fatalf("pop deferred request:%v,%v", req, err)
+	}
+}
+
+// 定时任务到期后放回待执行队列，等待期间被取消的任务不再入队
+func testScheduleRequest(t *testing.T, s Store) {
+	var reqs []*task.TaskRequest
+	for i := 0; i < 2; i++ {
+		r, err := task.NewTaskRequest("example", []string{"schedule"}, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.SetState(r, task.StateScheduled); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.ScheduleRequest(r, time.Now().Add(time.Millisecond*100)); err != nil {
+			t.Fatal(err)
+		}
+		reqs = append(reqs, r)
+	}
+	if err := s.SetState(reqs[1], task.StateCancelled); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RequeueExpired(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PopRequest(defaultQueues, time.Hour); err != errors.ErrKeyNotExist {
+		t.Fatalf("scheduled request popped before due, err %v", err)
+	}
+	time.Sleep(time.Millisecond * 150)
+	if _, err := s.RequeueExpired(); err != nil {
+		t.Fatal(err)
+	}
+	req, err := s.PopRequest(defaultQueues, time.Hour)
+	if err != nil || req.Uuid != reqs[0].Uuid {
+		t.Fatalf("pop scheduled request:%v,%v", req, err)
+	}
+	if _, err = s.PopRequest(defaultQueues, time.Hour); err != errors.ErrKeyNotExist {
+		t.Fatalf("cancelled request popped, err %v", err)
+	}
+	st, err := s.GetStatus(reqs[1].Uuid)
+	if err != nil || st.State != task.StateCancelled {
+		t.Fatalf("cancelled status:%v,%v", st, err)
+	}
+}
+
+func testQueues(t *testing.T, s Store) {
+	mail, err := task.NewTaskRequest("example", []string{"mail"}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail.Queue = "mail"
+	report, err := task.NewTaskRequest("example", []string{"report"}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*task.TaskRequest{report, mail} {
+		if err = s.AddRequest(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := s.PopRequest([]string{"mail", config.DefaultQueue}, time.Hour)
+	if err != nil || req.Uuid != mail.Uuid || req.Queue != "mail" {
+		t.Fatalf("pop mail queue: %v %v", req, err)
+	}
+	if _, err = s.PopRequest([]string{"mail"}, time.Hour); err != errors.ErrKeyNotExist {
+		t.Fatalf("mail queue should be empty, err %v", err)
+	}
+	req, err = s.PopRequest(defaultQueues, time.Hour)
+	if err != nil || req.Uuid != report.Uuid {
+		t.Fatalf("pop default queue: %v %v", req, err)
+	}
+	for _, r := range []*task.TaskRequest{mail, report} {
+		result := &task.TaskResult{TaskRequest: *r, IsSuccess: 1}
+		if err = s.SetResult(result, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testTakeToken(t *testing.T, s Store) {
+	key := fmt.Sprintf("bin:test_%d", time.Now().UnixNano())
+	for i := 0; i < 2; i++ {
+		wait, err := s.TakeToken(key, 2, time.Minute)
+		if err != nil || wait != 0 {
+			t.Fatalf("take token %d: wait %v err %v", i, wait, err)
+		}
+	}
+	wait, err := s.TakeToken(key, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || time.Minute/2 < wait {
+		t.Fatalf("expect wait in (0, 30s], got %v", wait)
+	}
+	//归还的令牌可以再次取出，但不超过容量
+	for i := 0; i < 3; i++ {
+		if err = s.ReturnToken(key, 2, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if wait, err = s.TakeToken(key, 2, time.Minute); err != nil || wait != 0 {
+			t.Fatalf("take returned token %d: wait %v err %v", i, wait, err)
+		}
+	}
+	if wait, _ = s.TakeToken(key, 2, time.Minute); wait <= 0 {
+		t.Fatalf("returned tokens exceed capacity")
+	}
+}
+
+// 工作流中的任务成功或者不再重试时通知broker，确认后不再返回
+func testWorkflowResult(t *testing.T, s Store) {
+	wf := task.NewWorkflow()
+	retry, err := task.NewTaskRequest("example", []string{"retry"}, 0, []int{1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf.AddTask("retry", retry)
+	wf.Prepare()
+	if err = s.SetWorkflow(wf, 0); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetWorkflow(wf.Uuid)
+	if err != nil || got.Tasks[0].Request.Uuid != retry.Uuid {
+		t.Fatalf("get workflow: %v %v", got, err)
+	}
+	if uuids, err := s.RunningWorkflows(); err != nil || len(uuids) != 1 || uuids[0] != wf.Uuid {
+		t.Fatalf("running workflows: %v %v", uuids, err)
+	}
+
+	if err = s.AddRequest(retry); err != nil {
+		t.Fatal(err)
+	}
+	req, err := s.PopRequest(defaultQueues, time.Hour)
+	if err != nil || req.Workflow != wf.Uuid {
+		t.Fatalf("pop workflow request: %v %v", req, err)
+	}
+	//还会重试的失败不通知
+	result := &task.TaskResult{TaskRequest: *req, IsSuccess: 0, Result: "fail"}
+	if err = s.SetResult(result, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.NextNotify(config.NotifyWorkflow, 1); err != errors.ErrKeyNotExist {
+		t.Fatalf("retrying task notified, err %v", err)
+	}
+	if _, err = s.PopFailResult(); err != nil {
+		t.Fatal(err)
+	}
+
+	result.IsSuccess = 1
+	result.Result = "ok"
+	if err = s.SetResult(result, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	rets, err := s.NextNotify(config.NotifyWorkflow, 10)
+	if err != nil || len(rets) != 1 {
+		t.Fatalf("next workflow result: %v %v", rets, err)
+	}
+	if ret := rets[0]; ret.Uuid != retry.Uuid || ret.Workflow != wf.Uuid || ret.Result != "ok" {
+		t.Fatalf("unexpected workflow result %+v", ret)
+	}
+	if _, err = s.NextNotify(config.NotifyCallback, 10); err != errors.ErrKeyNotExist {
+		t.Fatalf("task without callback notified, err %v", err)
+	}
+	if err = s.AckNotify(config.NotifyWorkflow, retry.Uuid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.NextNotify(config.NotifyWorkflow, 10); err != errors.ErrKeyNotExist {
+		t.Fatalf("acked result returned again, err %v", err)
+	}
+	//结束的工作流按保存时间过期，不再列出
+	if err = s.SetWorkflow(wf, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if uuids, err := s.RunningWorkflows(); err != nil || len(uuids) != 0 {
+		t.Fatalf("finished workflow listed: %v %v", uuids, err)
+	}
+}
+
+func testDelRequest(t *testing.T, s Store) {
+	r, err := task.NewTaskRequest("example", []string{"cancel"}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := s.DelRequest(r.Uuid)
+	if err != nil || !deleted {
+		t.Fatalf("del request: %v %v", deleted, err)
+	}
+	if _, err = s.PopRequest(defaultQueues, time.Hour); err != errors.ErrKeyNotExist {
+		t.Fatalf("deleted request popped, err %v", err)
+	}
+}
+
+func testProgress(t *testing.T, s Store) {
+	if _, err := s.GetProgress("no_progress"); err != errors.ErrKeyNotExist {
+		t.Fatalf("expect ErrKeyNotExist, got %v", err)
+	}
+	for _, percent := range []int{10, 60} {
+		p := &task.Progress{Uuid: "progress", Percent: percent, Message: "copy"}
+		if err := s.SetProgress(p, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p, err := s.GetProgress("progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Percent != 60 || p.Message != "copy" {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+}
+
+// 超过行数上限时丢弃最旧的行，序号保持连续
+func testLogs(t *testing.T, s Store) {
+	lines, next, err := s.GetLogs("no_logs", 1, 10)
+	if err != nil || len(lines) != 0 || next != 1 {
+		t.Fatalf("unexpected logs %v %d %v", lines, next, err)
+	}
+	for _, text := range []string{"a", "b", "c"} {
+		line := &task.LogLine{Stream: task.LogStdout, Text: text}
+		if err = s.AppendLogs("logs", []*task.LogLine{line}, 2, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines, next, err = s.GetLogs("logs", 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || lines[0].Seq != 2 || lines[0].Text != "b" || lines[1].Text != "c" || next != 4 {
+		t.Fatalf("unexpected logs %v %d", lines, next)
+	}
+	lines, next, err = s.GetLogs("logs", 3, 1)
+	if err != nil || len(lines) != 1 || lines[0].Text != "c" || next != 4 {
+		t.Fatalf("unexpected logs %v %d %v", lines, next, err)
+	}
+	lines, next, err = s.GetLogs("logs", next, 10)
+	if err != nil || len(lines) != 0 || next != 4 {
+		t.Fatalf("unexpected logs %v %d %v", lines, next, err)
+	}
+}
+
+func checkStates(t *testing.T, s Store, uuid string, states ...string) *task.TaskStatus {
+	st, err := s.GetStatus(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var history []string
+	for _, change := range st.History {
+		history = append(history, change.State)
+	}
+	if strings.Join(history, ",") != strings.Join(states, ",") || st.State != states[len(states)-1] {
+		t.Fatalf("expect states %v, got %s %v", states, st.State, history)
+	}
+	return st
+}
+
+// 任务的状态随入队、执行、失败重试和写入结果变化，结果过期后为expired
+func testStatus(t *testing.T, s Store) {
+	queues := []string{"status"}
+	r, err := task.NewTaskRequest("example", nil, 0, []int{5, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Queue = "status"
+	if err = s.SetState(r, task.StateScheduled); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.PopRequest(queues, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetResult(&task.TaskResult{TaskRequest: *r, IsSuccess: 0, Result: "boom"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStates(t, s, r.Uuid, task.StateScheduled, task.StateQueued, task.StateRunning, task.StateRetrying)
+
+	retry := *r
+	retry.Index++
+	if err = s.AddRequest(&retry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.PopRequest(queues, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetResult(&task.TaskResult{TaskRequest: retry, IsSuccess: 1, Result: "ok"}, time.Millisecond*50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := checkStates(t, s, r.Uuid, task.StateScheduled, task.StateQueued, task.StateRunning,
+		task.StateRetrying, task.StateQueued, task.StateRunning, task.StateSucceeded)
+	if st.Attempt != 1 || st.BinName != "example" || st.Queue != "status" || st.SubmitTime == 0 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	time.Sleep(time.Millisecond * 100)
+	checkStates(t, s, r.Uuid, task.StateScheduled, task.StateQueued, task.StateRunning,
+		task.StateRetrying, task.StateQueued, task.StateRunning, task.StateSucceeded, task.StateExpired)
+
+	cancelled, err := task.NewTaskRequest("example", nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled.Queue = "status"
+	if err = s.AddRequest(cancelled); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.DelRequest(cancelled.Uuid); err != nil {
+		t.Fatal(err)
+	}
+	checkStates(t, s, cancelled.Uuid, task.StateQueued, task.StateCancelled)
+}
+
+//索引中的任务数
+func indexSize(t *testing.T, s Store, name string) int {
+	switch s := s.(type) {
+	case *FileStore:
+		s.Lock()
+		defer s.Unlock()
+		//文件存储没有all索引，直接遍历全部状态
+		if name == "all" {
+			return len(s.status)
+		}
+		return len(s.index[name])
+	case *RedisStore:
+		n := 0
+		for shard := 0; shard < s.keys.shards; shard++ {
+			c, err := rawClient(s.redisClient).(*redis.Client).ZCard(s.keys.indexKey(name, shard)).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			n += int(c)
+		}
+		return n
+	}
+	t.Fatalf("unknown store %T", s)
+	return 0
+}
+
+// 状态到期后从索引中删除
+func testPruneStatus(t *testing.T, s Store) {
+	defer func(keep time.Duration) { statusKeep = keep }(statusKeep)
+	statusKeep = time.Millisecond * 100
+
+	var queued string
+	for i := 0; i < 3; i++ {
+		r, err := task.NewTaskRequest("prune_bin", nil, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Queue = "prune"
+		if err = s.AddRequest(r); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			queued = r.Uuid
+			continue
+		}
+		if _, err = s.DelRequest(r.Uuid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexes := []string{"all", "bin:prune_bin", "queue:prune", "state:" + task.StateCancelled}
+	sizes := []int{3, 3, 3, 2}
+	for i, name := range indexes {
+		if n := indexSize(t, s, name); n != sizes[i] {
+			t.Fatalf("index %s size %d, want %d", name, n, sizes[i])
+		}
+	}
+	if n, err := s.PruneStatus(10); err != nil || n != 0 {
+		t.Fatalf("prune unexpired status: %d, %v", n, err)
+	}
+
+	time.Sleep(time.Millisecond * 200)
+	//limit是每个分片的上限，分批删除直到删完
+	pruned := 0
+	for i := 0; i < 3; i++ {
+		n, err := s.PruneStatus(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pruned += n
+	}
+	if pruned != 2 {
+		t.Fatalf("pruned %d status, want 2", pruned)
+	}
+	sizes = []int{1, 1, 1, 0}
+	for i, name := range indexes {
+		if n := indexSize(t, s, name); n != sizes[i] {
+			t.Fatalf("index %s size %d after prune, want %d", name, n, sizes[i])
+		}
+	}
+	st, err := s.GetStatus(queued)
+	if err != nil || st.State != task.StateQueued {
+		t.Fatalf("queued task status %+v, %v", st, err)
+	}
+}
+
+// 按条件分页查询，翻页时不重复也不遗漏
+func testListTasks(t *testing.T, s Store) {
+	var failed []string
+	for i := 0; i < 7; i++ {
+		r, err := task.NewTaskRequest("list_bin", nil, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Queue = "list"
+		if err = s.AddRequest(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		r, err := s.PopRequest([]string{"list"}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := &task.TaskResult{TaskRequest: *r, IsSuccess: 0, Result: "boom"}
+		if err = s.SetResult(result, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		failed = append(failed, r.Uuid)
+	}
+
+	seen := make(map[string]bool)
+	q := &task.TaskQuery{BinName: "list_bin", State: task.StateFailed, Limit: 3}
+	for pages := 0; ; pages++ {
+		if 10 < pages {
+			t.Fatal("too many pages")
+		}
+		tasks, cursor, err := s.ListTasks(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, st := range tasks {
+			if st.State != task.StateFailed || st.BinName != "list_bin" || seen[st.Uuid] {
+				t.Fatalf("unexpected task %+v", st)
+			}
+			seen[st.Uuid] = true
+		}
+		if len(cursor) == 0 {
+			break
+		}
+		q.Cursor = cursor
+	}
+	if len(seen) != len(failed) {
+		t.Fatalf("expect %d failed tasks, got %d", len(failed), len(seen))
+	}
+
+	tasks, _, err := s.ListTasks(&task.TaskQuery{Queue: "list", State: task.StateQueued, Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 7-len(failed) {
+		t.Fatalf("expect %d queued tasks, got %d", 7-len(failed), len(tasks))
+	}
+}
+
+// 重新执行失败的任务、队列积压和worker心跳
+func testAdmin(t *testing.T, s Store) {
+	queues := []string{"admin"}
+	for i := 0; i < 2; i++ {
+		r, err := task.NewTaskRequest("example", nil, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Queue = "admin"
+		if err = s.AddRequest(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := s.PopRequest(queues, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetResult(&task.TaskResult{TaskRequest: *r, IsSuccess: 0, Result: "boom"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	depths, err := s.QueueDepths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depths["admin"] != 1 {
+		t.Fatalf("expect 1 pending task, got %v", depths)
+	}
+
+	if err = s.RetryRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetResult(r.Uuid); err != errors.ErrKeyNotExist {
+		t.Fatalf("expect result deleted, got %v", err)
+	}
+	checkStates(t, s, r.Uuid, task.StateQueued, task.StateRunning, task.StateFailed, task.StateQueued)
+	if depths, err = s.QueueDepths(); err != nil || depths["admin"] != 2 {
+		t.Fatalf("expect 2 pending tasks, got %v %v", depths, err)
+	}
+
+	err = s.Heartbeat(&task.WorkerInfo{Id: "admin-a", Queues: queues}, time.Millisecond*50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Heartbeat(&task.WorkerInfo{Id: "admin-b", Queues: queues}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := func() string {
+		workers, err := s.ListWorkers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, w := range workers {
+			if strings.HasPrefix(w.Id, "admin-") {
+				ids = append(ids, w.Id)
+			}
+		}
+		return strings.Join(ids, ",")
+	}
+	if got := ids(); got != "admin-a,admin-b" {
+		t.Fatalf("unexpected workers %s", got)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if got := ids(); got != "admin-b" {
+		t.Fatalf("unexpected workers %s", got)
+	}
+}
+
+func TestFileStoreIdempotency(t *testing.T)  { withFileStore(t, testIdempotency) }
+func TestRedisStoreIdempotency(t *testing.T) { withRedisStore(t, testIdempotency) }
+
+func TestFileStoreConcurrencySlot(t *testing.T)  { withFileStore(t, testConcurrencySlot) }
+func TestRedisStoreConcurrencySlot(t *testing.T) { withRedisStore(t, testConcurrencySlot) }
+
+func TestFileStoreDeferRequest(t *testing.T)  { withFileStore(t, testDeferRequest) }
+func TestRedisStoreDeferRequest(t *testing.T) { withRedisStore(t, testDeferRequest) }
+
+func TestFileStoreScheduleRequest(t *testing.T)  { withFileStore(t, testScheduleRequest) }
+func TestRedisStoreScheduleRequest(t *testing.T) { withRedisStore(t, testScheduleRequest) }
+
+func TestFileStoreQueues(t *testing.T)  { withFileStore(t, testQueues) }
+func TestRedisStoreQueues(t *testing.T) { withRedisStore(t, testQueues) }
+
+func TestFileStoreTakeToken(t *testing.T)  { withFileStore(t, testTakeToken) }
+func TestRedisStoreTakeToken(t *testing.T) { withRedisStore(t, testTakeToken) }
+
+func TestFileStoreWorkflowResult(t *testing.T)  { withFileStore(t, testWorkflowResult) }
+func TestRedisStoreWorkflowResult(t *testing.T) { withRedisStore(t, testWorkflowResult) }
+
+func TestFileStoreDelRequest(t *testing.T)  { withFileStore(t, testDelRequest) }
+func TestRedisStoreDelRequest(t *testing.T) { withRedisStore(t, testDelRequest) }
+
+func TestFileStoreProgress(t *testing.T)  { withFileStore(t, testProgress) }
+func TestRedisStoreProgress(t *testing.T) { withRedisStore(t, testProgress) }
+
+func TestFileStoreLogs(t *testing.T)  { withFileStore(t, testLogs) }
+func TestRedisStoreLogs(t *testing.T) { withRedisStore(t, testLogs) }
+
+func TestFileStoreStatus(t *testing.T)  { withFileStore(t, testStatus) }
+func TestRedisStoreStatus(t *testing.T) { withRedisStore(t, testStatus) }
+
+func TestFileStorePruneStatus(t *testing.T)  { withFileStore(t, testPruneStatus) }
+func TestRedisStorePruneStatus(t *testing.T) { withRedisStore(t, testPruneStatus) }
+
+func TestFileStoreListTasks(t *testing.T)  { withFileStore(t, testListTasks) }
+func TestRedisStoreListTasks(t *testing.T) { withRedisStore(t, testListTasks) }
+
+func TestFileStoreAdmin(t *testing.T)  { withFileStore(t, testAdmin) }
+func TestRedisStoreAdmin(t *testing.T) { withRedisStore(t, testAdmin) }
@@ -0,0 +1,91 @@
+package task
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+)
+
+//回调请求的http头
+const (
+	CallbackSignatureHeader = "X-Kingtask-Signature"
+	CallbackTimestampHeader = "X-Kingtask-Timestamp"
+)
+
+//任务结束后POST给回调地址的内容
+type CallbackPayload struct {
+	Uuid      string `json:"uuid"`
+	BinName   string `json:"bin_name"`
+	Args      string `json:"args"`
+	Workflow  string `json:"workflow,omitempty"`
+	IsSuccess int64  `json:"is_success"`
+	Result    string `json:"result"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+//回调的投递状态
+type CallbackStatus struct {
+	Uuid       string `json:"uuid"`
+	Url        string `json:"url"`
+	Delivered  bool   `json:"delivered"`
+	Attempts   int    `json:"attempts"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	UpdateTime int64  `json:"update_time"`
+}
+
+type CallbackReply struct {
+	Status   int             `json:"status"`
+	Message  string          `json:"message"`
+	Callback *CallbackStatus `json:"callback,omitempty"`
+}
+
+func NewCallbackPayload(r *TaskResult, timestamp int64) *CallbackPayload {
+	return &CallbackPayload{
+		Uuid:      r.Uuid,
+		BinName:   r.BinName,
+		Args:      r.Args,
+		Workflow:  r.Workflow,
+		IsSuccess: r.IsSuccess,
+		Result:    r.Result,
+		Timestamp: timestamp,
+	}
+}
+
+//签名为 sha256=hex(hmac_sha256(secret, timestamp + "." + body))
+func SignCallback(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//接收方校验回调的签名，timestamp和signature取自对应的http头
+func VerifyCallback(secret string, timestamp string, body []byte, signature string) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(SignCallback(secret, ts, body)), []byte(signature))
+}
+
+//查询任务回调的投递状态
+func (k *BrokerClient) GetCallback(t *TaskRequest) (*CallbackStatus, error) {
+	args := struct {
+		Uuid string `json:"uuid"`
+	}{t.Uuid}
+	reply := new(CallbackReply)
+	err := k.call(config.TypeGetCallback, &args, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Status == 1 {
+		return nil, errors.NewError(reply.Message)
+	}
+	return reply.Callback, nil
+}
@@ -0,0 +1,348 @@
+package task
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/backoff"
+	"github.com/flike/kingtask/core/errors"
+)
+
+const (
+	defaultClientPoolSize = 8
+	defaultDialTimeout    = time.Second * 5
+	defaultReadTimeout    = time.Second * 30
+	defaultWriteTimeout   = time.Second * 5
+	defaultClientRetries  = 3
+	defaultMinBackoff     = time.Millisecond * 100
+	defaultMaxBackoff     = time.Second * 5
+)
+
+//不改变broker状态的请求，连接断开时可以重新发送
+var readOnlyTypes = map[byte]bool{
+	config.TypeGetTaskResult: true,
+	config.TypeGetWorkflow:   true,
+	config.TypeGetCallback:   true,
+	config.TypeWaitResult:    true,
+	config.TypeGetProgress:   true,
+	config.TypeGetLogs:       true,
+	config.TypeGetStatus:     true,
+	config.TypeListTasks:     true,
+	config.TypeListWorkers:   true,
+	config.TypeQueueStats:    true,
+}
+
+type ClientOptions struct {
+	//broker地址，连接失败时依次尝试下一个地址
+	Addrs []string
+	//最多保留的空闲连接数
+	PoolSize int
+	//为0时使用默认值，小于0时不超时
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	//所有地址都连接失败或者请求可以重新发送时的最大重试次数
+	MaxRetries int
+	//重连的退避时间
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+//连接池化的broker客户端，可以被多个goroutine同时使用，
+//连接断开后自动重连，多个broker地址时连接失败切换到下一个地址
+type BrokerClient struct {
+	//第一个broker地址
+	BrokerAddr string
+
+	opt  ClientOptions
+	idle chan *clientConn
+
+	lock   sync.Mutex
+	closed bool
+	//优先连接的地址下标
+	current int
+	//地址连接失败后在downUntil之前不再优先尝试
+	downUntil []time.Time
+	backoffs  []*backoff.Backoff
+}
+
+type clientConn struct {
+	net.Conn
+	addr string
+}
+
+//brokerAddr可以是逗号分隔的多个地址
+func NewBrokerClient(brokerAddr string) (*BrokerClient, error) {
+	addrs := make([]string, 0, 1)
+	for _, addr := range strings.Split(brokerAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) != 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	return NewBrokerClientWithOptions(ClientOptions{Addrs: addrs})
+}
+
+func NewBrokerClientWithOptions(opt ClientOptions) (*BrokerClient, error) {
+	if len(opt.Addrs) == 0 {
+		return nil, errors.ErrInvalidArgument
+	}
+	if opt.PoolSize <= 0 {
+		opt.PoolSize = defaultClientPoolSize
+	}
+	if opt.DialTimeout == 0 {
+		opt.DialTimeout = defaultDialTimeout
+	}
+	if opt.ReadTimeout == 0 {
+		opt.ReadTimeout = defaultReadTimeout
+	}
+	if opt.WriteTimeout == 0 {
+		opt.WriteTimeout = defaultWriteTimeout
+	}
+	if opt.MaxRetries == 0 {
+		opt.MaxRetries = defaultClientRetries
+	}
+	if opt.MaxRetries < 0 {
+		opt.MaxRetries = 0
+	}
+	if opt.MinBackoff <= 0 {
+		opt.MinBackoff = defaultMinBackoff
+	}
+	if opt.MaxBackoff < opt.MinBackoff {
+		opt.MaxBackoff = defaultMaxBackoff
+		if opt.MaxBackoff < opt.MinBackoff {
+			opt.MaxBackoff = opt.MinBackoff
+		}
+	}
+
+	k := &BrokerClient{
+		BrokerAddr: opt.Addrs[0],
+		opt:        opt,
+		idle:       make(chan *clientConn, opt.PoolSize),
+		downUntil:  make([]time.Time, len(opt.Addrs)),
+		backoffs:   make([]*backoff.Backoff, len(opt.Addrs)),
+	}
+	for i := range k.backoffs {
+		k.backoffs[i] = backoff.New(opt.MinBackoff, opt.MaxBackoff)
+	}
+
+	//创建时检查broker是否可以连接
+	c, err := k.dial()
+	if err != nil {
+		return nil, err
+	}
+	k.put(c, nil)
+	return k, nil
+}
+
+//关闭所有空闲连接，正在使用的连接在请求结束后关闭
+func (k *BrokerClient) Close() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.closed {
+		return nil
+	}
+	k.closed = true
+
+	var err error
+	header := []byte{config.TypeCloseConn}
+	for {
+		select {
+		case c := <-k.idle:
+			c.SetWriteDeadline(deadline(k.opt.WriteTimeout))
+			if _, e := c.Write(header); e != nil && err == nil {
+				err = e
+			}
+			c.Close()
+		default:
+			return err
+		}
+	}
+}
+
+//发送一个请求并读取json格式的回复
+func (k *BrokerClient) call(msgType byte, args interface{}, reply interface{}) error {
+	return k.do(msgType, args, reply, k.opt.ReadTimeout, readOnlyTypes[msgType])
+}
+
+//retryable表示请求已经发出后连接断开时可以重新发送
+func (k *BrokerClient) do(msgType byte, args interface{}, reply interface{},
+	readTimeout time.Duration, retryable bool) error {
+	buf, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	sendBuf := make([]byte, len(buf)+1)
+	sendBuf[0] = msgType
+	copy(sendBuf[1:], buf)
+
+	for retry := 0; ; retry++ {
+		c, reused, err := k.get()
+		if err != nil {
+			return err
+		}
+		sent, err := c.roundTrip(sendBuf, reply, k.opt.WriteTimeout, readTimeout)
+		k.put(c, err)
+		if err == nil {
+			return nil
+		}
+		//broker重启后同一地址的空闲连接都已失效
+		if reused {
+			k.closeIdle(c.addr)
+		}
+		//请求已经发出时broker可能已经执行，只有没有发出或者可以重复执行的请求才重新发送
+		if sent && !retryable {
+			return err
+		}
+		if k.opt.MaxRetries <= retry {
+			return err
+		}
+	}
+}
+
+func (c *clientConn) roundTrip(req []byte, reply interface{},
+	writeTimeout, readTimeout time.Duration) (bool, error) {
+	err := c.SetWriteDeadline(deadline(writeTimeout))
+	if err != nil {
+		return false, err
+	}
+	_, err = c.Write(req)
+	if err != nil {
+		return false, err
+	}
+	err = c.SetReadDeadline(deadline(readTimeout))
+	if err != nil {
+		return true, err
+	}
+	return true, json.NewDecoder(c).Decode(reply)
+}
+
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+//优先使用空闲连接，没有时新建连接
+func (k *BrokerClient) get() (*clientConn, bool, error) {
+	select {
+	case c := <-k.idle:
+		return c, true, nil
+	default:
+	}
+	if k.isClosed() {
+		return nil, false, errors.ErrClientClosed
+	}
+	c, err := k.dial()
+	return c, false, err
+}
+
+//请求出错的连接状态未知，直接关闭
+func (k *BrokerClient) put(c *clientConn, err error) {
+	if err == nil {
+		k.lock.Lock()
+		if !k.closed {
+			select {
+			case k.idle <- c:
+				k.lock.Unlock()
+				return
+			default:
+			}
+		}
+		k.lock.Unlock()
+	}
+	c.Close()
+}
+
+func (k *BrokerClient) closeIdle(addr string) {
+	for n := len(k.idle); 0 < n; n-- {
+		select {
+		case c := <-k.idle:
+			if c.addr != addr {
+				k.put(c, nil)
+			} else {
+				c.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (k *BrokerClient) isClosed() bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.closed
+}
+
+//依次尝试各个地址，都失败后退避重试
+func (k *BrokerClient) dial() (*clientConn, error) {
+	bf := backoff.New(k.opt.MinBackoff, k.opt.MaxBackoff)
+	var lastErr error
+	for retry := 0; ; retry++ {
+		for _, i := range k.dialOrder() {
+			addr := k.opt.Addrs[i]
+			timeout := k.opt.DialTimeout
+			if timeout < 0 {
+				timeout = 0
+			}
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			if err != nil {
+				k.markDown(i)
+				lastErr = err
+				continue
+			}
+			if tc, ok := conn.(*net.TCPConn); ok {
+				tc.SetKeepAlive(true)
+			}
+			k.markUp(i)
+			return &clientConn{Conn: conn, addr: addr}, nil
+		}
+		if k.opt.MaxRetries <= retry || k.isClosed() {
+			return nil, lastErr
+		}
+		bf.Sleep()
+	}
+}
+
+//从当前地址开始，最近连接失败的地址排在最后
+func (k *BrokerClient) dialOrder() []int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	now := time.Now()
+	n := len(k.opt.Addrs)
+	order := make([]int, 0, n)
+	down := make([]int, 0, n)
+	for j := 0; j < n; j++ {
+		i := (k.current + j) % n
+		if now.Before(k.downUntil[i]) {
+			down = append(down, i)
+		} else {
+			order = append(order, i)
+		}
+	}
+	return append(order, down...)
+}
+
+func (k *BrokerClient) markUp(i int) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.current = i
+	k.downUntil[i] = time.Time{}
+	k.backoffs[i].Reset()
+}
+
+func (k *BrokerClient) markDown(i int) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.downUntil[i] = time.Now().Add(k.backoffs[i].Next())
+	if k.current == i {
+		k.current = (i + 1) % len(k.opt.Addrs)
+	}
+}
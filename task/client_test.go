@@ -0,0 +1,202 @@
+package task
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flike/kingtask/config"
+)
+
+//模拟broker：回复提交任务的uuid，每个连接处理maxRequests个请求后断开
+type fakeBroker struct {
+	l        net.Listener
+	requests int32
+
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func startFakeBroker(t *testing.T, addr string, maxRequests int) *fakeBroker {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{l: l, conns: make(map[net.Conn]struct{})}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.lock.Lock()
+			b.conns[c] = struct{}{}
+			b.lock.Unlock()
+			go b.serve(c, maxRequests)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(c net.Conn, maxRequests int) {
+	defer c.Close()
+	msgType := make([]byte, 1)
+	for i := 0; i < maxRequests; i++ {
+		if _, err := c.Read(msgType); err != nil || msgType[0] != config.TypeRequestTask {
+			return
+		}
+		//客户端收到回复后才会发送下一个请求，Decoder不会读到下一个请求
+		req := new(TaskRequest)
+		if err := json.NewDecoder(c).Decode(req); err != nil {
+			return
+		}
+		atomic.AddInt32(&b.requests, 1)
+		json.NewEncoder(c).Encode(&StatusResult{Uuid: req.Uuid + "-ok"})
+	}
+}
+
+func (b *fakeBroker) Close() {
+	b.l.Close()
+	b.lock.Lock()
+	for c := range b.conns {
+		c.Close()
+	}
+	b.lock.Unlock()
+}
+
+func deadAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestBrokerClientConcurrent(t *testing.T) {
+	b := startFakeBroker(t, "127.0.0.1:0", 3)
+	defer b.Close()
+
+	//第一个地址不可用时切换到第二个地址
+	client, err := NewBrokerClientWithOptions(ClientOptions{
+		Addrs:       []string{deadAddr(t), b.l.Addr().String()},
+		PoolSize:    4,
+		DialTimeout: time.Second,
+		ReadTimeout: time.Second * 5,
+		MinBackoff:  time.Millisecond * 10,
+		MaxBackoff:  time.Millisecond * 50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				req, _ := NewTaskRequest("echo", nil, 0, nil)
+				id := req.Uuid
+				//broker断开连接后带有幂等键的请求才会重新发送
+				req.IdempotencyKey = id
+				if err := client.Delay(req); err != nil {
+					errs <- err
+					continue
+				}
+				//回复没有串到其他请求
+				if req.Uuid != id+"-ok" {
+					t.Errorf("uuid %s, expect %s-ok", req.Uuid, id)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt32(&b.requests); n != 100 {
+		t.Errorf("broker got %d requests, expect 100", n)
+	}
+}
+
+func TestBrokerClientReconnect(t *testing.T) {
+	b := startFakeBroker(t, "127.0.0.1:0", 100)
+	addr := b.l.Addr().String()
+	client, err := NewBrokerClientWithOptions(ClientOptions{
+		Addrs:      []string{addr},
+		MinBackoff: time.Millisecond * 50,
+		MaxBackoff: time.Millisecond * 200,
+		MaxRetries: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	req, _ := NewTaskRequest("echo", nil, 0, nil)
+	if err := client.Delay(req); err != nil {
+		t.Fatal(err)
+	}
+
+	//broker停止后请求失败
+	b.Close()
+	req, _ = NewTaskRequest("echo", nil, 0, nil)
+	if err := client.Delay(req); err == nil {
+		t.Fatal("expect error when broker is down")
+	}
+
+	//broker重启后自动重连
+	b = startFakeBroker(t, addr, 100)
+	defer b.Close()
+	req, _ = NewTaskRequest("echo", nil, 0, nil)
+	id := req.Uuid
+	if err := client.Delay(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Uuid != id+"-ok" {
+		t.Errorf("uuid %s, expect %s-ok", req.Uuid, id)
+	}
+}
+
+//已经发出的请求在连接断开后不重新发送，带有幂等键的任务可以重新发送
+func TestBrokerClientNoResend(t *testing.T) {
+	b := startFakeBroker(t, "127.0.0.1:0", 1)
+	defer b.Close()
+	client, err := NewBrokerClientWithOptions(ClientOptions{
+		Addrs:      []string{b.l.Addr().String()},
+		MinBackoff: time.Millisecond * 50,
+		MaxBackoff: time.Millisecond * 200,
+		MaxRetries: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, key := range []string{"", "resend"} {
+		atomic.StoreInt32(&b.requests, 0)
+		req, _ := NewTaskRequest("echo", nil, 0, nil)
+		if err := client.Delay(req); err != nil {
+			t.Fatal(err)
+		}
+		//broker处理一个请求后关闭连接，下一个请求使用已经断开的空闲连接
+		time.Sleep(time.Millisecond * 100)
+		req, _ = NewTaskRequest("echo", nil, 0, nil)
+		req.IdempotencyKey = key
+		err := client.Delay(req)
+		if key == "" && err == nil {
+			t.Fatal("request without idempotency key is resent")
+		}
+		if n := atomic.LoadInt32(&b.requests); key != "" && (err != nil || n != 2) {
+			t.Fatalf("request with idempotency key: %v, requests %d", err, n)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package task
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+)
+
+//任务输出的一行
+type LogLine struct {
+	Seq    int64  `json:"seq"` //任务日志中的序号，从1开始
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+	Time   int64  `json:"time"`
+}
+
+//任务日志的输出流
+const (
+	LogStdout = "stdout"
+	LogStderr = "stderr"
+)
+
+type LogReply struct {
+	Status  int        `json:"status"`
+	Message string     `json:"message"`
+	Lines   []*LogLine `json:"lines,omitempty"`
+	Next    int64      `json:"next"` //下次读取的起始序号
+	Done    bool       `json:"done"` //任务已经结束，不会再有新的输出
+}
+
+//读取序号不小于from的日志，最多count行，超过保存行数上限的旧日志已被丢弃
+func (k *BrokerClient) GetLogs(uuid string, from int64, count int) (*LogReply, error) {
+	args := struct {
+		Uuid  string `json:"uuid"`
+		From  int64  `json:"from"`
+		Count int    `json:"count"`
+	}{uuid, from, count}
+	reply := new(LogReply)
+	err := k.call(config.TypeGetLogs, &args, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Status == 1 {
+		return nil, errors.NewError(reply.Message)
+	}
+	return reply, nil
+}
+
+//把任务的输出持续写入w，直到任务结束
+func (k *BrokerClient) TailLogs(uuid string, w io.Writer) error {
+	var from int64 = 1
+	for {
+		reply, err := k.GetLogs(uuid, from, config.DefaultLogBatch)
+		if err != nil {
+			return err
+		}
+		for _, line := range reply.Lines {
+			_, err = fmt.Fprintln(w, line.Text)
+			if err != nil {
+				return err
+			}
+		}
+		from = reply.Next
+		if len(reply.Lines) != 0 {
+			continue
+		}
+		if reply.Done {
+			return nil
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+}
@@ -0,0 +1,66 @@
+package task
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+)
+
+//任务在标准输出中以该前缀输出一行报告进度，如 "KINGTASK_PROGRESS 45 copying files"，
+//进度行不计入任务结果
+const ProgressPrefix = "KINGTASK_PROGRESS "
+
+//执行中任务最近一次报告的进度
+type Progress struct {
+	Uuid       string `json:"uuid"`
+	Percent    int    `json:"percent"`
+	Message    string `json:"message,omitempty"`
+	UpdateTime int64  `json:"update_time"`
+}
+
+type ProgressReply struct {
+	Status   int       `json:"status"`
+	Message  string    `json:"message"`
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+//解析进度行，百分比超出0-100时取边界值
+func ParseProgress(line string) (int, string, bool) {
+	if !strings.HasPrefix(line, ProgressPrefix) {
+		return 0, "", false
+	}
+	fields := strings.SplitN(strings.TrimSpace(line[len(ProgressPrefix):]), " ", 2)
+	percent, err := strconv.Atoi(strings.TrimSuffix(fields[0], "%"))
+	if err != nil {
+		return 0, "", false
+	}
+	if percent < 0 {
+		percent = 0
+	}
+	if 100 < percent {
+		percent = 100
+	}
+	var msg string
+	if len(fields) == 2 {
+		msg = strings.TrimSpace(fields[1])
+	}
+	return percent, msg, true
+}
+
+//查询任务最近一次报告的进度
+func (k *BrokerClient) GetProgress(uuid string) (*Progress, error) {
+	args := struct {
+		Uuid string `json:"uuid"`
+	}{uuid}
+	reply := new(ProgressReply)
+	err := k.call(config.TypeGetProgress, &args, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Status == 1 {
+		return nil, errors.NewError(reply.Message)
+	}
+	return reply.Progress, nil
+}
@@ -0,0 +1,27 @@
+package task
+
+import (
+	"testing"
+)
+
+func TestParseProgress(t *testing.T) {
+	tests := []struct {
+		line    string
+		percent int
+		msg     string
+		ok      bool
+	}{
+		{"KINGTASK_PROGRESS 45 copying files", 45, "copying files", true},
+		{"KINGTASK_PROGRESS 80%", 80, "", true},
+		{"KINGTASK_PROGRESS 120 done", 100, "done", true},
+		{"KINGTASK_PROGRESS -3", 0, "", true},
+		{"KINGTASK_PROGRESS abc", 0, "", false},
+		{"progress 45", 0, "", false},
+	}
+	for _, test := range tests {
+		percent, msg, ok := ParseProgress(test.line)
+		if percent != test.percent || msg != test.msg || ok != test.ok {
+			t.Errorf("ParseProgress(%q) = %d, %q, %v", test.line, percent, msg, ok)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package task
+
+import (
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+)
+
+//任务的生命周期状态
+const (
+	StateScheduled = "scheduled" //等待开始时间或者提交速率限制，还未入队
+	StateQueued    = "queued"    //在待执行队列中
+	StateRunning   = "running"   //worker正在执行
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"   //执行失败，没有配置重试
+	StateRetrying  = "retrying" //执行失败，等待重试
+	StateCancelled = "cancelled"
+	StateDead      = "dead"    //重试次数用完后仍然失败
+	StateExpired   = "expired" //任务已结束，结果已经过期被删除
+)
+
+//一次状态变更，时间单位为毫秒
+type StateChange struct {
+	State string `json:"state"`
+	Time  int64  `json:"time"`
+}
+
+type TaskStatus struct {
+	Uuid     string `json:"uuid"`
+	BinName  string `json:"bin_name"`
+	Queue    string `json:"queue,omitempty"`
+	Workflow string `json:"workflow,omitempty"`
+	State    string `json:"state"`
+	//第几次执行，从0开始
+	Attempt int `json:"attempt"`
+	//时间单位为毫秒
+	SubmitTime     int64          `json:"submit_time"`
+	UpdateTime     int64          `json:"update_time"`
+	ResultExpireAt int64          `json:"result_expire_at,omitempty"`
+	History        []*StateChange `json:"history,omitempty"`
+	//执行中任务最近一次报告的进度
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+type StatusReply struct {
+	Status     int         `json:"status"`
+	Message    string      `json:"message"`
+	TaskStatus *TaskStatus `json:"task_status,omitempty"`
+}
+
+//查询任务的条件，为空的条件不限制，结果按提交时间从新到旧排列
+type TaskQuery struct {
+	State   string `json:"state,omitempty"`
+	BinName string `json:"bin_name,omitempty"`
+	Queue   string `json:"queue,omitempty"`
+	//提交时间的范围，单位为毫秒
+	Since int64 `json:"since,omitempty"`
+	Until int64 `json:"until,omitempty"`
+	//上一页返回的游标，为空时从最新的任务开始
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type TaskListReply struct {
+	Status  int           `json:"status"`
+	Message string        `json:"message"`
+	Tasks   []*TaskStatus `json:"tasks,omitempty"`
+	//下一页的游标，为空时没有更多的任务
+	Cursor string `json:"cursor,omitempty"`
+}
+
+//结束状态不会再变化
+func IsFinalState(state string) bool {
+	switch state {
+	case StateSucceeded, StateFailed, StateCancelled, StateDead, StateExpired:
+		return true
+	}
+	return false
+}
+
+//写入结果后任务的状态
+func (r *TaskResult) State() string {
+	switch {
+	case r.IsSuccess == 1:
+		return StateSucceeded
+	case r.HasRetry():
+		return StateRetrying
+	case len(r.TimeInterval) == 0:
+		return StateFailed
+	}
+	return StateDead
+}
+
+//已结束任务的结果过期后状态记为expired
+func (s *TaskStatus) CheckExpired(now int64) {
+	if !IsFinalState(s.State) || s.ResultExpireAt == 0 || now < s.ResultExpireAt {
+		return
+	}
+	s.State = StateExpired
+	s.History = append(s.History, &StateChange{State: StateExpired, Time: s.ResultExpireAt})
+}
+
+//查询任务的生命周期状态和状态变更历史
+func (k *BrokerClient) GetStatus(uuid string) (*TaskStatus, error) {
+	return k.statusCall(config.TypeGetStatus, uuid)
+}
+
+//按条件分页查询任务，返回任务的状态(不含状态变更历史)和下一页的游标
+func (k *BrokerClient) ListTasks(q *TaskQuery) ([]*TaskStatus, string, error) {
+	reply := new(TaskListReply)
+	err := k.call(config.TypeListTasks, q, reply)
+	if err != nil {
+		return nil, "", err
+	}
+	if reply.Status == 1 {
+		return nil, "", errors.NewError(reply.Message)
+	}
+	return reply.Tasks, reply.Cursor, nil
+}
+
+//取消还未开始执行的任务，返回取消后的状态
+func (k *BrokerClient) CancelTask(uuid string) (*TaskStatus, error) {
+	return k.statusCall(config.TypeCancelTask, uuid)
+}
+
+//重新执行已经失败的任务，重试次数从头计算
+func (k *BrokerClient) RequeueTask(uuid string) (*TaskStatus, error) {
+	return k.statusCall(config.TypeRequeueTask, uuid)
+}
+
+func (k *BrokerClient) statusCall(msgType byte, uuid string) (*TaskStatus, error) {
+	args := struct {
+		Uuid string `json:"uuid"`
+	}{uuid}
+	reply := new(StatusReply)
+	err := k.call(msgType, &args, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Status == 1 {
+		return nil, errors.NewError(reply.Message)
+	}
+	return reply.TaskStatus, nil
+}
@@ -1,9 +1,7 @@
 package task
 
 import (
-	"encoding/json"
 	"fmt"
-	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -13,11 +11,6 @@ import (
 	"github.com/flike/kingtask/core/errors"
 )
 
-type BrokerClient struct {
-	BrokerAddr string
-	BrokerConn *net.TCPConn
-}
-
 type TaskRequest struct {
 	Uuid         string `json:"uuid"`
 	BinName      string `json:"bin_name"`
@@ -25,6 +18,22 @@ type TaskRequest struct {
 	StartTime    int64  `json:"start_time"`
 	TimeInterval string `json:"time_interval"` //空格分隔各个参数
 	Index        int    `json:"index"`
+	//幂等键，窗口期内用相同的键重复提交时broker返回已有任务的uuid，不会重复执行
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	//并发键，所有worker上同一并发键的任务同时执行的数量不超过ConcurrencyLimit，
+	//ConcurrencyLimit为0时表示互斥执行
+	ConcurrencyKey   string `json:"concurrency_key,omitempty"`
+	ConcurrencyLimit int    `json:"concurrency_limit,omitempty"`
+	//任务队列，为空时放入默认队列，worker只执行其订阅的队列中的任务
+	Queue string `json:"queue,omitempty"`
+	//所属的工作流uuid
+	Workflow string `json:"workflow,omitempty"`
+	//写入可执行文件的标准输入
+	Stdin string `json:"stdin,omitempty"`
+	//任务结束(成功或者不再重试)后broker把结果POST到该地址
+	CallbackUrl string `json:"callback_url,omitempty"`
+	//W3C trace context，broker入队后替换为入队span的traceparent
+	Traceparent string `json:"traceparent,omitempty"`
 }
 
 type TaskResult struct {
@@ -36,6 +45,7 @@ type TaskResult struct {
 type StatusResult struct {
 	Status  int    `json:"status"`
 	Message string `json:"message"`
+	Uuid    string `json:"uuid,omitempty"`
 }
 
 type Reply struct {
@@ -72,109 +82,113 @@ func NewTaskRequest(binName string, args []string, startTime int64, timeInterval
 	return taskRequest, nil
 }
 
-func NewBrokerClient(brokerAddr string) (*BrokerClient, error) {
-	if len(brokerAddr) == 0 {
-		return nil, errors.ErrInvalidArgument
-	}
-
-	tcpAddr, err := net.ResolveTCPAddr("tcp", brokerAddr)
-	if err != nil {
-		return nil, err
-	}
+//任务已经结束：执行成功或者失败后不再重试
+func (r *TaskResult) IsFinal() bool {
+	return r.IsSuccess == 1 || !r.HasRetry()
+}
 
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
-	if err != nil {
-		return nil, err
-	}
-	err = conn.SetKeepAlive(true)
-	if err != nil {
-		return nil, err
+//失败后是否还会重试，与broker重试时的计算方式一致
+func (r *TaskRequest) HasRetry() bool {
+	if len(r.TimeInterval) == 0 {
+		return false
 	}
+	return r.Index+1 < len(strings.Split(r.TimeInterval, " "))
+}
 
-	return &BrokerClient{
-		BrokerAddr: brokerAddr,
-		BrokerConn: conn,
-	}, nil
+//日志中关联任务的字段，args追加在后面
+func (r *TaskRequest) LogFields(args ...interface{}) []interface{} {
+	return append([]interface{}{
+		"uuid", r.Uuid,
+		"bin_name", r.BinName,
+		"attempt", r.Index,
+	}, args...)
 }
 
 func (k *BrokerClient) Delay(t *TaskRequest) error {
 	if t == nil {
 		return nil
 	}
-	reply := make([]byte, 512)
 	result := new(StatusResult)
-
-	ret, err := json.Marshal(t)
-	if err != nil {
-		fmt.Printf("mashal error:%s\n", err.Error())
-		return err
-	}
-	sendBuf := make([]byte, len(ret)+1)
-	sendBuf[0] = config.TypeRequestTask
-	copy(sendBuf[1:], ret)
-	_, err = k.BrokerConn.Write(sendBuf)
-	if err != nil {
-		fmt.Printf("Write error:%s\n", err.Error())
-		return err
-	}
-	readLen, err := k.BrokerConn.Read(reply)
-	if err != nil {
-		fmt.Printf("Read error:%s\n", err.Error())
-		return err
-	}
-	err = json.Unmarshal(reply[:readLen], result)
+	//带幂等键的任务重复提交不会重复执行，连接断开时可以重新发送
+	err := k.do(config.TypeRequestTask, t, result, k.opt.ReadTimeout, len(t.IdempotencyKey) != 0)
 	if err != nil {
-		fmt.Printf("Unmarshal error:%s\n", err.Error())
 		return err
 	}
 	if result.Status == 1 {
 		return errors.NewError(result.Message)
 	}
+	//幂等键已提交过，使用已有任务的uuid
+	if len(result.Uuid) != 0 {
+		t.Uuid = result.Uuid
+	}
 
 	return nil
 }
 
+//查询任务最近一次执行的结果，失败后还会重试的结果也会返回
 func (k *BrokerClient) GetResult(t *TaskRequest) (*Reply, error) {
-	reply := make([]byte, 512)
+	return k.getResult(t, false)
+}
+
+//只返回任务的最终结果：执行成功或者失败后不再重试
+func (k *BrokerClient) GetFinalResult(t *TaskRequest) (*Reply, error) {
+	return k.getResult(t, true)
+}
+
+func (k *BrokerClient) getResult(t *TaskRequest, finalOnly bool) (*Reply, error) {
 	result := new(Reply)
 	args := struct {
-		Key string `json:"key"`
+		Key       string `json:"key"`
+		FinalOnly bool   `json:"final_only,omitempty"`
 	}{}
 
 	args.Key = fmt.Sprintf("r_%s", t.Uuid)
-	buf, err := json.Marshal(args)
+	args.FinalOnly = finalOnly
+	err := k.call(config.TypeGetTaskResult, &args, result)
 	if err != nil {
 		return nil, err
 	}
-	sendBuf := make([]byte, len(buf)+1)
-	sendBuf[0] = config.TypeGetTaskResult
-	copy(sendBuf[1:], buf)
+	if result.IsResultExist == config.ResultNotExist {
+		return nil, errors.ErrResultNotReady
+	}
 
-	_, err = k.BrokerConn.Write(sendBuf)
-	if err != nil {
-		return nil, err
+	return result, nil
+}
+
+//阻塞等待任务的最终结果，超时后返回ErrResultNotReady
+func (k *BrokerClient) WaitResult(uuid string, timeout time.Duration) (*Reply, error) {
+	args := struct {
+		Uuid    string `json:"uuid"`
+		Timeout int64  `json:"timeout"`
+	}{uuid, int64(timeout / time.Millisecond)}
+	result := struct {
+		Status int `json:"status"`
+		Reply
+	}{}
+
+	//broker在超时后才回复，读超时要留出余量
+	readTimeout := k.opt.ReadTimeout
+	if 0 < readTimeout {
+		readTimeout += timeout
 	}
-	readLen, err := k.BrokerConn.Read(reply)
+	err := k.do(config.TypeWaitResult, &args, &result, readTimeout, true)
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(reply[:readLen], result)
-	if err != nil {
-		return nil, err
+	if result.Status == 1 {
+		return nil, errors.NewError(result.Result)
 	}
 	if result.IsResultExist == config.ResultNotExist {
 		return nil, errors.ErrResultNotReady
 	}
-
-	return result, nil
+	return &result.Reply, nil
 }
 
-func (k *BrokerClient) Close() error {
-	header := []byte{config.TypeCloseConn}
-	_, err := k.BrokerConn.Write(header)
+//提交任务并等待其结果
+func (k *BrokerClient) DelayAndWait(t *TaskRequest, timeout time.Duration) (*Reply, error) {
+	err := k.Delay(t)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = k.BrokerConn.Close()
-	return err
+	return k.WaitResult(t.Uuid, timeout)
 }
@@ -0,0 +1,64 @@
+package task
+
+import (
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+)
+
+//worker定期上报的心跳，超过有效时间没有上报的worker被认为已经退出
+type WorkerInfo struct {
+	Id     string   `json:"id"`
+	Host   string   `json:"host"`
+	Pid    int      `json:"pid"`
+	Queues []string `json:"queues"`
+	//正在执行的任务uuid，空闲时为空
+	Running string `json:"running,omitempty"`
+	//时间单位为毫秒
+	StartTime int64 `json:"start_time"`
+	Heartbeat int64 `json:"heartbeat"`
+}
+
+type WorkerListReply struct {
+	Status  int           `json:"status"`
+	Message string        `json:"message"`
+	Workers []*WorkerInfo `json:"workers,omitempty"`
+}
+
+//队列中待执行的任务数和消费该队列的worker数
+type QueueStats struct {
+	Queue   string `json:"queue"`
+	Pending int64  `json:"pending"`
+	Workers int    `json:"workers"`
+}
+
+type QueueStatsReply struct {
+	Status  int           `json:"status"`
+	Message string        `json:"message"`
+	Queues  []*QueueStats `json:"queues,omitempty"`
+}
+
+//查询仍在上报心跳的worker
+func (k *BrokerClient) ListWorkers() ([]*WorkerInfo, error) {
+	reply := new(WorkerListReply)
+	err := k.call(config.TypeListWorkers, struct{}{}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Status == 1 {
+		return nil, errors.NewError(reply.Message)
+	}
+	return reply.Workers, nil
+}
+
+//查询各个队列的积压情况
+func (k *BrokerClient) QueueStats() ([]*QueueStats, error) {
+	reply := new(QueueStatsReply)
+	err := k.call(config.TypeQueueStats, struct{}{}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Status == 1 {
+		return nil, errors.NewError(reply.Message)
+	}
+	return reply.Queues, nil
+}
@@ -0,0 +1,420 @@
+package task
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+)
+
+//工作流状态
+const (
+	WorkflowRunning   = "running"
+	WorkflowSucceeded = "succeeded"
+	WorkflowFailed    = "failed"
+	WorkflowCancelled = "cancelled"
+)
+
+//工作流中任务的状态
+const (
+	TaskPending   = "pending" //等待父任务完成
+	TaskQueued    = "queued"  //已放入待执行队列
+	TaskSucceeded = "succeeded"
+	TaskFailed    = "failed"
+	TaskCancelled = "cancelled"
+)
+
+//父任务的输出传给子任务的方式
+const (
+	PassOutputNone  = ""
+	PassOutputArgs  = "args"  //按空白分隔后追加到子任务参数之后
+	PassOutputStdin = "stdin" //写入子任务的标准输入，多个父任务的输出按行拼接
+	PassOutputJson  = "json"  //以json数组写入子任务的标准输入，包含每个父任务的状态和结果
+)
+
+//子任务的触发条件
+const (
+	TriggerAllSuccess = ""         //所有父任务都执行成功
+	TriggerAllDone    = "all_done" //所有父任务都已结束，不论成功与否
+)
+
+//工作流的类型，只用于展示
+const (
+	KindWorkflow = ""
+	KindChain    = "chain"
+	KindGroup    = "group"
+	KindChord    = "chord"
+)
+
+type WorkflowTask struct {
+	Name       string       `json:"name"`
+	Parents    []string     `json:"parents,omitempty"`
+	PassOutput string       `json:"pass_output,omitempty"`
+	Trigger    string       `json:"trigger,omitempty"`
+	Request    *TaskRequest `json:"request"`
+	Status     string       `json:"status"`
+	Result     string       `json:"result,omitempty"`
+}
+
+//由多个任务和任务之间的依赖组成的有向无环图，子任务在所有父任务执行成功后才入队
+type Workflow struct {
+	Uuid   string `json:"uuid"`
+	Kind   string `json:"kind,omitempty"`
+	Status string `json:"status"`
+	//为true时任务失败只取消依赖它的任务，其它任务继续执行，工作流在全部结束后才判定为失败
+	ContinueOnFailure bool            `json:"continue_on_failure,omitempty"`
+	Tasks             []*WorkflowTask `json:"tasks"`
+	CreateTime        int64           `json:"create_time"`
+	FinishTime        int64           `json:"finish_time,omitempty"`
+}
+
+//以json方式传给子任务的父任务结果
+type TaskOutput struct {
+	Name   string `json:"name"`
+	Uuid   string `json:"uuid"`
+	Status string `json:"status"`
+	Result string `json:"result"`
+}
+
+type WorkflowReply struct {
+	Status   int       `json:"status"`
+	Message  string    `json:"message"`
+	Workflow *Workflow `json:"workflow,omitempty"`
+}
+
+func NewWorkflow() *Workflow {
+	return &Workflow{
+		Uuid:   uuid.New(),
+		Status: WorkflowRunning,
+	}
+}
+
+//添加一个任务，parents为已添加的任务名
+func (wf *Workflow) AddTask(name string, r *TaskRequest, parents ...string) *WorkflowTask {
+	t := &WorkflowTask{
+		Name:    name,
+		Parents: parents,
+		Request: r,
+		Status:  TaskPending,
+	}
+	wf.Tasks = append(wf.Tasks, t)
+	return t
+}
+
+//串行执行的任务链，每个任务的输出追加到下一个任务的参数之后
+func NewChain(requests ...*TaskRequest) *Workflow {
+	wf := NewWorkflow()
+	wf.Kind = KindChain
+	prev := ""
+	for i, r := range requests {
+		name := strconv.Itoa(i)
+		if i == 0 {
+			wf.AddTask(name, r)
+		} else {
+			wf.AddTask(name, r, prev).PassOutput = PassOutputArgs
+		}
+		prev = name
+	}
+	return wf
+}
+
+//并行执行的一组任务，工作流的uuid即为组的id，成员失败不影响其它成员
+func NewGroup(requests ...*TaskRequest) *Workflow {
+	wf := NewWorkflow()
+	wf.Kind = KindGroup
+	wf.ContinueOnFailure = true
+	for i, r := range requests {
+		wf.AddTask(strconv.Itoa(i), r)
+	}
+	return wf
+}
+
+//ChordCallback为和弦中回调任务的任务名
+const ChordCallback = "callback"
+
+//一组并行任务全部结束后执行回调任务，所有成员的结果以json数组写入回调任务的标准输入
+func NewChord(callback *TaskRequest, requests ...*TaskRequest) *Workflow {
+	wf := NewGroup(requests...)
+	wf.Kind = KindChord
+	parents := make([]string, 0, len(requests))
+	for _, t := range wf.Tasks {
+		parents = append(parents, t.Name)
+	}
+	t := wf.AddTask(ChordCallback, callback, parents...)
+	t.PassOutput = PassOutputJson
+	t.Trigger = TriggerAllDone
+	return wf
+}
+
+func (wf *Workflow) Task(name string) *WorkflowTask {
+	for _, t := range wf.Tasks {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (wf *Workflow) TaskByUuid(uuid string) *WorkflowTask {
+	for _, t := range wf.Tasks {
+		if t.Request.Uuid == uuid {
+			return t
+		}
+	}
+	return nil
+}
+
+func (wf *Workflow) Children(name string) []*WorkflowTask {
+	var children []*WorkflowTask
+	for _, t := range wf.Tasks {
+		for _, p := range t.Parents {
+			if p == name {
+				children = append(children, t)
+				break
+			}
+		}
+	}
+	return children
+}
+
+//检查任务名唯一、依赖的任务存在并且没有环
+func (wf *Workflow) Validate() error {
+	if len(wf.Uuid) == 0 || len(wf.Tasks) == 0 {
+		return errors.ErrInvalidArgument
+	}
+	indegree := make(map[string]int, len(wf.Tasks))
+	for _, t := range wf.Tasks {
+		if len(t.Name) == 0 || t.Request == nil || len(t.Request.BinName) == 0 {
+			return errors.ErrInvalidArgument
+		}
+		if _, ok := indegree[t.Name]; ok {
+			return errors.NewError("duplicate workflow task " + t.Name)
+		}
+		switch t.PassOutput {
+		case PassOutputNone, PassOutputArgs, PassOutputStdin, PassOutputJson:
+		default:
+			return errors.NewError("invalid pass_output " + t.PassOutput)
+		}
+		switch t.Trigger {
+		case TriggerAllSuccess, TriggerAllDone:
+		default:
+			return errors.NewError("invalid trigger " + t.Trigger)
+		}
+		indegree[t.Name] = len(t.Parents)
+	}
+	for _, t := range wf.Tasks {
+		for _, p := range t.Parents {
+			if _, ok := indegree[p]; !ok {
+				return errors.NewError("workflow task " + t.Name + " depends on unknown task " + p)
+			}
+		}
+	}
+
+	//拓扑排序，剩余未访问的任务在环上
+	var ready []string
+	for name, n := range indegree {
+		if n == 0 {
+			ready = append(ready, name)
+		}
+	}
+	visited := 0
+	for len(ready) != 0 {
+		name := ready[0]
+		ready = ready[1:]
+		visited++
+		for _, c := range wf.Children(name) {
+			indegree[c.Name]--
+			if indegree[c.Name] == 0 {
+				ready = append(ready, c.Name)
+			}
+		}
+	}
+	if visited != len(wf.Tasks) {
+		return errors.NewError("workflow has a dependency cycle")
+	}
+	return nil
+}
+
+//补全任务的uuid和工作流信息，并把所有任务置为等待状态
+func (wf *Workflow) Prepare() {
+	now := time.Now().Unix()
+	wf.Status = WorkflowRunning
+	wf.CreateTime = now
+	wf.FinishTime = 0
+	for _, t := range wf.Tasks {
+		if len(t.Request.Uuid) == 0 {
+			t.Request.Uuid = uuid.New()
+		}
+		t.Request.Workflow = wf.Uuid
+		t.Request.StartTime = now
+		t.Status = TaskPending
+		t.Result = ""
+	}
+}
+
+func isDone(status string) bool {
+	return status == TaskSucceeded || status == TaskFailed || status == TaskCancelled
+}
+
+//父任务满足触发条件，可以入队
+func (wf *Workflow) IsReady(t *WorkflowTask) bool {
+	if t.Status != TaskPending {
+		return false
+	}
+	for _, p := range t.Parents {
+		parent := wf.Task(p)
+		if parent == nil {
+			return false
+		}
+		if t.Trigger == TriggerAllDone {
+			if !isDone(parent.Status) {
+				return false
+			}
+		} else if parent.Status != TaskSucceeded {
+			return false
+		}
+	}
+	return true
+}
+
+//返回所有可以入队的任务
+func (wf *Workflow) ReadyTasks() []*WorkflowTask {
+	var ready []*WorkflowTask
+	for _, t := range wf.Tasks {
+		if wf.IsReady(t) {
+			ready = append(ready, t)
+		}
+	}
+	return ready
+}
+
+//取消因为父任务失败而永远不会满足触发条件的任务，并向下传递
+func (wf *Workflow) CancelUnreachable() {
+	for changed := true; changed; {
+		changed = false
+		for _, t := range wf.Tasks {
+			if t.Status != TaskPending || t.Trigger == TriggerAllDone {
+				continue
+			}
+			for _, p := range t.Parents {
+				if parent := wf.Task(p); parent != nil &&
+					(parent.Status == TaskFailed || parent.Status == TaskCancelled) {
+					t.Status = TaskCancelled
+					changed = true
+					break
+				}
+			}
+		}
+	}
+}
+
+//生成入队的任务请求，按PassOutput把父任务的输出传给子任务
+func (wf *Workflow) ReadyRequest(t *WorkflowTask) *TaskRequest {
+	r := new(TaskRequest)
+	*r = *t.Request
+	var outputs []string
+	for _, p := range t.Parents {
+		outputs = append(outputs, wf.Task(p).Result)
+	}
+	switch t.PassOutput {
+	case PassOutputArgs:
+		args := strings.Fields(r.Args)
+		for _, output := range outputs {
+			args = append(args, strings.Fields(output)...)
+		}
+		r.Args = strings.Join(args, " ")
+	case PassOutputStdin:
+		r.Stdin = strings.Join(outputs, "\n")
+	case PassOutputJson:
+		results := make([]*TaskOutput, 0, len(t.Parents))
+		for _, p := range t.Parents {
+			parent := wf.Task(p)
+			results = append(results, &TaskOutput{
+				Name:   parent.Name,
+				Uuid:   parent.Request.Uuid,
+				Status: parent.Status,
+				Result: parent.Result,
+			})
+		}
+		data, _ := json.Marshal(results)
+		r.Stdin = string(data)
+	}
+	return r
+}
+
+//把还在等待父任务的任务置为取消状态，已入队的任务由broker从队列中删除
+func (wf *Workflow) CancelPending() {
+	for _, t := range wf.Tasks {
+		if t.Status == TaskPending {
+			t.Status = TaskCancelled
+		}
+	}
+}
+
+//所有任务都已结束时工作流结束，返回是否结束
+func (wf *Workflow) Finish() bool {
+	for _, t := range wf.Tasks {
+		if t.Status == TaskPending || t.Status == TaskQueued {
+			return false
+		}
+	}
+	if wf.Status == WorkflowRunning {
+		wf.Status = WorkflowSucceeded
+		for _, t := range wf.Tasks {
+			if t.Status == TaskFailed {
+				wf.Status = WorkflowFailed
+				break
+			}
+		}
+	}
+	wf.FinishTime = time.Now().Unix()
+	return true
+}
+
+func (k *BrokerClient) SubmitWorkflow(wf *Workflow) error {
+	if wf == nil {
+		return errors.ErrInvalidArgument
+	}
+	err := wf.Validate()
+	if err != nil {
+		return err
+	}
+	result := new(StatusResult)
+	err = k.call(config.TypeSubmitWorkflow, wf, result)
+	if err != nil {
+		return err
+	}
+	if result.Status == 1 {
+		return errors.NewError(result.Message)
+	}
+	return nil
+}
+
+func (k *BrokerClient) GetWorkflow(uuid string) (*Workflow, error) {
+	return k.workflowCall(config.TypeGetWorkflow, uuid)
+}
+
+//取消工作流，未入队的任务不再执行，已入队但还未执行的任务从队列中删除
+func (k *BrokerClient) CancelWorkflow(uuid string) (*Workflow, error) {
+	return k.workflowCall(config.TypeCancelWorkflow, uuid)
+}
+
+func (k *BrokerClient) workflowCall(msgType byte, uuid string) (*Workflow, error) {
+	args := struct {
+		Uuid string `json:"uuid"`
+	}{uuid}
+	reply := new(WorkflowReply)
+	err := k.call(msgType, &args, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Status == 1 {
+		return nil, errors.NewError(reply.Message)
+	}
+	return reply.Workflow, nil
+}
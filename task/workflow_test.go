@@ -0,0 +1,144 @@
+package task
+
+import (
+	"testing"
+)
+
+func newTestWorkflow(t *testing.T) *Workflow {
+	wf := NewWorkflow()
+	for _, name := range []string{"extract", "transform", "load"} {
+		r, err := NewTaskRequest("example", []string{name}, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wf.AddTask(name, r)
+	}
+	return wf
+}
+
+func TestWorkflowValidate(t *testing.T) {
+	wf := newTestWorkflow(t)
+	wf.Task("transform").Parents = []string{"extract"}
+	wf.Task("load").Parents = []string{"transform", "extract"}
+	if err := wf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	wf.Task("extract").Parents = []string{"load"}
+	if err := wf.Validate(); err == nil {
+		t.Fatal("cycle not detected")
+	}
+	wf.Task("extract").Parents = []string{"unknown"}
+	if err := wf.Validate(); err == nil {
+		t.Fatal("unknown parent not detected")
+	}
+	wf.Task("extract").Parents = nil
+	wf.Task("load").Name = "transform"
+	if err := wf.Validate(); err == nil {
+		t.Fatal("duplicate name not detected")
+	}
+}
+
+func TestWorkflowReadyRequest(t *testing.T) {
+	wf := newTestWorkflow(t)
+	transform := wf.Task("transform")
+	transform.Parents = []string{"extract"}
+	transform.PassOutput = PassOutputArgs
+	load := wf.Task("load")
+	load.Parents = []string{"extract", "transform"}
+	load.PassOutput = PassOutputStdin
+	wf.Prepare()
+
+	if !wf.IsReady(wf.Task("extract")) || wf.IsReady(transform) {
+		t.Fatal("only root task should be ready")
+	}
+	extract := wf.Task("extract")
+	extract.Status = TaskSucceeded
+	extract.Result = "1 2"
+	if !wf.IsReady(transform) || wf.IsReady(load) {
+		t.Fatal("transform should be ready")
+	}
+	r := wf.ReadyRequest(transform)
+	if r.Args != "transform 1 2" || r.Workflow != wf.Uuid || r.Uuid != transform.Request.Uuid {
+		t.Fatalf("unexpected request %+v", r)
+	}
+	if transform.Request.Args != "transform" {
+		t.Fatal("ready request modified the task")
+	}
+
+	transform.Status = TaskSucceeded
+	transform.Result = "3"
+	r = wf.ReadyRequest(load)
+	if r.Stdin != "1 2\n3" || r.Args != "load" {
+		t.Fatalf("unexpected request %+v", r)
+	}
+}
+
+func TestChordCallback(t *testing.T) {
+	var members []*TaskRequest
+	for _, arg := range []string{"1", "2"} {
+		r, err := NewTaskRequest("example", []string{arg}, 0, []int{5, 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, r)
+	}
+	callback, err := NewTaskRequest("sum", nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf := NewChord(callback, members...)
+	if err = wf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	wf.Prepare()
+	if len(wf.ReadyTasks()) != 2 {
+		t.Fatal("group members should run in parallel")
+	}
+
+	wf.Tasks[0].Status = TaskFailed
+	wf.Tasks[0].Result = "boom"
+	wf.CancelUnreachable()
+	cb := wf.Task(ChordCallback)
+	if cb.Status != TaskPending || wf.IsReady(cb) {
+		t.Fatal("callback should wait for all members")
+	}
+	wf.Tasks[1].Status = TaskSucceeded
+	wf.Tasks[1].Result = "2"
+	if !wf.IsReady(cb) {
+		t.Fatal("callback should run after all members finish")
+	}
+	r := wf.ReadyRequest(cb)
+	want := `[{"name":"0","uuid":"` + members[0].Uuid + `","status":"failed","result":"boom"},` +
+		`{"name":"1","uuid":"` + members[1].Uuid + `","status":"succeeded","result":"2"}]`
+	if r.Stdin != want {
+		t.Fatalf("unexpected callback stdin %s", r.Stdin)
+	}
+
+	cb.Status = TaskSucceeded
+	if !wf.Finish() || wf.Status != WorkflowFailed {
+		t.Fatalf("chord with a failed member should fail, status %s", wf.Status)
+	}
+}
+
+func TestChainCancelUnreachable(t *testing.T) {
+	var requests []*TaskRequest
+	for _, arg := range []string{"a", "b", "c"} {
+		r, err := NewTaskRequest("example", []string{arg}, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, r)
+	}
+	wf := NewChain(requests...)
+	wf.ContinueOnFailure = true
+	if err := wf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	wf.Prepare()
+	wf.Tasks[0].Status = TaskFailed
+	wf.CancelUnreachable()
+	if wf.Tasks[1].Status != TaskCancelled || wf.Tasks[2].Status != TaskCancelled {
+		t.Fatal("cancellation should propagate down the chain")
+	}
+}
@@ -0,0 +1,111 @@
+package worker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/flike/golog"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/task"
+)
+
+//任务输出按批写入存储，批次达到行数或者时间间隔时写入
+const (
+	logFlushLines    = 100
+	logFlushInterval = time.Millisecond * 200
+)
+
+//把任务的输出按行实时写入存储
+type taskLog struct {
+	sync.Mutex
+	//保证各批日志按顺序写入
+	flushLock sync.Mutex
+	w        *Worker
+	req      *task.TaskRequest
+	lines    []*task.LogLine
+	maxLines int
+	lineSize int
+	keepTime time.Duration
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+func (w *Worker) newTaskLog(req *task.TaskRequest) *taskLog {
+	cfg := w.config()
+	l := &taskLog{
+		w:        w,
+		req:      req,
+		maxLines: cfg.LogMaxLines,
+		lineSize: cfg.LogLineSize,
+		keepTime: time.Second * time.Duration(cfg.LogKeepTime),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if l.maxLines == 0 {
+		l.maxLines = config.DefaultLogMaxLines
+	}
+	if l.lineSize == 0 {
+		l.lineSize = config.DefaultLogLineSize
+	}
+	if l.keepTime == 0 {
+		l.keepTime = time.Second * config.DefaultLogKeepTime
+	}
+	go l.run()
+	return l
+}
+
+func (l *taskLog) Add(stream string, text string) {
+	if l.lineSize < len(text) {
+		text = text[:l.lineSize]
+	}
+	l.Lock()
+	l.lines = append(l.lines, &task.LogLine{
+		Stream: stream,
+		Text:   text,
+		Time:   time.Now().Unix(),
+	})
+	full := logFlushLines <= len(l.lines)
+	l.Unlock()
+	if full {
+		l.flush()
+	}
+}
+
+//任务结束后写入剩余的输出
+func (l *taskLog) Close() {
+	close(l.quit)
+	<-l.done
+	l.flush()
+}
+
+func (l *taskLog) run() {
+	defer close(l.done)
+	tick := time.NewTicker(logFlushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			l.flush()
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+func (l *taskLog) flush() {
+	l.flushLock.Lock()
+	defer l.flushLock.Unlock()
+	l.Lock()
+	lines := l.lines
+	l.lines = nil
+	l.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+	err := l.w.store.AppendLogs(l.req.Uuid, lines, l.maxLines, l.keepTime)
+	if err != nil {
+		golog.Error("Worker", "flushLog", err.Error(), 0,
+			l.w.logFields(l.req, "lines", len(lines))...)
+	}
+}
@@ -0,0 +1,18 @@
+package worker
+
+import (
+	"github.com/flike/kingtask/core/metrics"
+)
+
+var (
+	startedTasks = metrics.NewCounterVec("kingtask_tasks_started_total",
+		"Tasks started by the worker.", "bin")
+	succeededTasks = metrics.NewCounterVec("kingtask_tasks_succeeded_total",
+		"Tasks that exited successfully.", "bin")
+	failedTasks = metrics.NewCounterVec("kingtask_tasks_failed_total",
+		"Tasks that failed, including attempts that will be retried.", "bin")
+	queueWait = metrics.NewHistogramVec("kingtask_task_queue_wait_seconds",
+		"Time from the start time of a task until a worker starts it.", metrics.TaskBuckets, "bin")
+	execTime = metrics.NewHistogramVec("kingtask_task_exec_seconds",
+		"Execution time of tasks.", metrics.TaskBuckets, "bin")
+)
@@ -0,0 +1,125 @@
+package worker
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/flike/golog"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/task"
+)
+
+//两次保存进度的最小间隔，间隔内的报告只保留最后一次
+const progressInterval = time.Millisecond * 500
+
+//任务执行过程中输出的处理，字段可以为nil
+type ExecHooks struct {
+	//标准输出中的进度行
+	Progress func(percent int, msg string)
+	//除进度行之外的每一行输出
+	Log func(stream string, text string)
+}
+
+//按行处理任务的输出，标准输出中的进度行交给hooks.Progress，其它内容写入out
+type progressWriter struct {
+	out    *bytes.Buffer
+	line   []byte
+	stream string
+	hooks  *ExecHooks
+}
+
+func newProgressWriter(out *bytes.Buffer, stream string, hooks *ExecHooks) *progressWriter {
+	if hooks == nil {
+		hooks = new(ExecHooks)
+	}
+	return &progressWriter{out: out, stream: stream, hooks: hooks}
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		pw.line = append(pw.line, c)
+		if c == '\n' {
+			pw.flushLine()
+		}
+	}
+	return len(p), nil
+}
+
+//输出最后一行没有换行符时在任务结束后调用
+func (pw *progressWriter) Flush() {
+	if len(pw.line) != 0 {
+		pw.flushLine()
+	}
+}
+
+func (pw *progressWriter) flushLine() {
+	text := string(bytes.TrimRight(pw.line, "\r\n"))
+	pw.line = pw.line[:0]
+	if pw.stream == task.LogStdout {
+		if percent, msg, ok := task.ParseProgress(text); ok {
+			if pw.hooks.Progress != nil {
+				pw.hooks.Progress(percent, msg)
+			}
+			return
+		}
+	}
+	pw.out.WriteString(text)
+	pw.out.WriteByte('\n')
+	if pw.hooks.Log != nil {
+		pw.hooks.Log(pw.stream, text)
+	}
+}
+
+//限制保存进度的频率，任务结束时保存最后一次报告
+type progressReporter struct {
+	sync.Mutex
+	w        *Worker
+	req      *task.TaskRequest
+	last     time.Time
+	pending  *task.Progress
+	keepTime time.Duration
+}
+
+func (w *Worker) newProgressReporter(req *task.TaskRequest) *progressReporter {
+	//进度在任务执行期间和结果保存期间都可以查询
+	cfg := w.config()
+	keep := cfg.TaskRunTime + config.LeaseGraceTime + cfg.ResultKeepTime
+	return &progressReporter{
+		w:        w,
+		req:      req,
+		keepTime: time.Second * time.Duration(keep),
+	}
+}
+
+func (r *progressReporter) Report(percent int, msg string) {
+	r.Lock()
+	defer r.Unlock()
+	r.pending = &task.Progress{
+		Uuid:       r.req.Uuid,
+		Percent:    percent,
+		Message:    msg,
+		UpdateTime: time.Now().Unix(),
+	}
+	if progressInterval <= time.Since(r.last) {
+		r.save()
+	}
+}
+
+func (r *progressReporter) Flush() {
+	r.Lock()
+	defer r.Unlock()
+	if r.pending != nil {
+		r.save()
+	}
+}
+
+func (r *progressReporter) save() {
+	err := r.w.store.SetProgress(r.pending, r.keepTime)
+	if err != nil {
+		golog.Error("Worker", "saveProgress", err.Error(), 0, r.w.logFields(r.req)...)
+	}
+	r.pending = nil
+	r.last = time.Now()
+}
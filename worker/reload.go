@@ -0,0 +1,47 @@
+package worker
+
+import (
+	"strings"
+
+	"github.com/flike/golog"
+
+	"github.com/flike/kingtask/config"
+)
+
+func (w *Worker) config() *config.WorkerConfig {
+	w.cfgLock.RLock()
+	defer w.cfgLock.RUnlock()
+	return w.cfg
+}
+
+//应用重新读取的配置，正在执行的任务不受影响，从下一个任务开始生效。
+//需要重启才能生效的配置项保持原值并返回其名称，配置有误时返回错误，不做任何修改
+func (w *Worker) Reload(cfg *config.WorkerConfig) ([]string, error) {
+	binRates, err := parseRateLimits(cfg.BinRateLimit)
+	if err != nil {
+		return nil, err
+	}
+	queueRates, err := parseRateLimits(cfg.QueueRateLimit)
+	if err != nil {
+		return nil, err
+	}
+	queues := subscribedQueues(cfg)
+	restart := cfg.KeepRestartFields(w.config())
+
+	w.cfgLock.Lock()
+	w.cfg = cfg
+	w.queues = queues
+	w.binRates = binRates
+	w.queueRates = queueRates
+	w.cfgLock.Unlock()
+
+	w.infoLock.Lock()
+	w.info.Queues = queues
+	w.infoLock.Unlock()
+	golog.Info("Worker", "Reload", "config reloaded", 0,
+		"worker", w.info.Id,
+		"queues", strings.Join(queues, ","),
+		"bin_path", cfg.BinPath,
+		"task_run_time", cfg.TaskRunTime)
+	return restart, nil
+}
@@ -3,28 +3,80 @@ package worker
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/flike/golog"
 
 	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/backoff"
 	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/core/metrics"
+	"github.com/flike/kingtask/core/trace"
+	"github.com/flike/kingtask/store"
 	"github.com/flike/kingtask/task"
-	redis "gopkg.in/redis.v3"
 )
 
 type Worker struct {
-	cfg         *config.WorkerConfig
-	brokerAddr  string
-	redisAddr   string
-	redisDB     int
-	running     bool
-	redisClient *redis.Client
+	//cfg、订阅的队列和速率限制可以通过Reload替换，由cfgLock保护
+	cfgLock    sync.RWMutex
+	cfg        *config.WorkerConfig
+	brokerAddr string
+	store      store.Store
+	queues     []string
+	binRates   map[string]rateLimit
+	queueRates map[string]rateLimit
+
+	//心跳中上报的worker信息
+	infoLock sync.Mutex
+	info     task.WorkerInfo
+
+	//Prometheus指标，没有配置metrics_addr时为空
+	metricsListener net.Listener
+	//记录取出和执行任务的span
+	tracer *trace.Tracer
+
+	//退出时quit停止取新任务，interrupt终止正在执行的任务，Run返回时关闭done
+	quit          chan struct{}
+	interrupt     chan struct{}
+	done          chan struct{}
+	quitOnce      sync.Once
+	interruptOnce sync.Once
+}
+
+//任务被终止后等待读完输出的最长时间
+const outputWaitTime = time.Second * 2
+
+type rateLimit struct {
+	limit  int
+	period time.Duration
+}
+
+func parseRateLimits(rates map[string]string) (map[string]rateLimit, error) {
+	limits := make(map[string]rateLimit, len(rates))
+	for name, rate := range rates {
+		limit, period, err := config.ParseRateLimit(rate)
+		if err != nil {
+			return nil, err
+		}
+		limits[name] = rateLimit{limit, period}
+	}
+	return limits, nil
+}
+
+//订阅的队列，没有配置时只订阅default队列
+func subscribedQueues(cfg *config.WorkerConfig) []string {
+	if len(cfg.Queues) == 0 {
+		return []string{config.DefaultQueue}
+	}
+	return cfg.Queues
 }
 
 func NewWorker(cfg *config.WorkerConfig) (*Worker, error) {
@@ -32,132 +84,368 @@ func NewWorker(cfg *config.WorkerConfig) (*Worker, error) {
 	w := new(Worker)
 	w.cfg = cfg
 	w.brokerAddr = cfg.BrokerAddr
+	w.quit = make(chan struct{})
+	w.interrupt = make(chan struct{})
+	w.done = make(chan struct{})
+	w.queues = subscribedQueues(cfg)
+	w.binRates, err = parseRateLimits(cfg.BinRateLimit)
+	if err != nil {
+		return nil, err
+	}
+	w.queueRates, err = parseRateLimits(cfg.QueueRateLimit)
+	if err != nil {
+		return nil, err
+	}
 
-	vec := strings.SplitN(cfg.RedisAddr, "/", 2)
-	if len(vec) == 2 {
-		w.redisAddr = vec[0]
-		w.redisDB, err = strconv.Atoi(vec[1])
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		w.redisAddr = vec[0]
-		w.redisDB = config.DefaultRedisDB
+	exporter, err := trace.NewExporter(cfg.TraceExporter, cfg.TraceEndpoint)
+	if err != nil {
+		return nil, err
 	}
 
-	w.redisClient = redis.NewClient(
-		&redis.Options{
-			Addr:     w.redisAddr,
-			Password: "", // no password set
-			DB:       int64(w.redisDB),
-		},
-	)
-	_, err = w.redisClient.Ping().Result()
+	w.store, err = store.NewStore(&cfg.StoreConfig)
 	if err != nil {
-		golog.Error("worker", "NewWorker", "ping redis fail", 0, "err", err.Error())
+		golog.Error("worker", "NewWorker", "open store fail", 0, "err", err.Error())
+		if exporter != nil {
+			exporter.Close()
+		}
 		return nil, err
 	}
+	w.tracer = trace.NewTracer("kingtask-worker", exporter)
+
+	host, _ := os.Hostname()
+	w.info = task.WorkerInfo{
+		Id:        fmt.Sprintf("%s:%d", host, os.Getpid()),
+		Host:      host,
+		Pid:       os.Getpid(),
+		Queues:    w.queues,
+		StartTime: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+
+	if len(cfg.MetricsAddr) != 0 {
+		w.metricsListener, err = metrics.Listen(cfg.MetricsAddr, metrics.Default)
+		if err != nil {
+			w.store.Close()
+			w.tracer.Close()
+			return nil, err
+		}
+	}
 
 	return w, nil
 }
 
+//定期上报心跳，broker据此列出在线的worker和各队列的消费者
+func (w *Worker) heartbeat() {
+	ttl := time.Second * config.WorkerHeartbeatTTL
+	for !w.stopping() {
+		w.infoLock.Lock()
+		w.info.Heartbeat = time.Now().UnixNano() / int64(time.Millisecond)
+		info := w.info
+		w.infoLock.Unlock()
+		err := w.store.Heartbeat(&info, ttl)
+		if err != nil {
+			golog.Error("Worker", "heartbeat", "report heartbeat error", 0,
+				"worker", info.Id,
+				"err", err.Error())
+		}
+		w.sleep(time.Second * config.WorkerHeartbeatInterval)
+	}
+}
+
+//任务相关的日志带有任务的关联字段和worker id
+func (w *Worker) logFields(r *task.TaskRequest, args ...interface{}) []interface{} {
+	return r.LogFields(append([]interface{}{"worker", w.info.Id}, args...)...)
+}
+
+func (w *Worker) setRunning(uuid string) {
+	w.infoLock.Lock()
+	w.info.Running = uuid
+	w.infoLock.Unlock()
+}
+
 func (w *Worker) Run() error {
-	w.running = true
-	for w.running {
-		uuid, err := w.redisClient.SPop(config.RequestUuidSet).Result()
+	defer close(w.done)
+	//redis主从切换期间请求会失败，退避重试直到连上新的master
+	bf := backoff.New(time.Millisecond*100, time.Second*5)
+	go w.heartbeat()
+	for !w.stopping() {
+		w.cfgLock.RLock()
+		cfg, queues := w.cfg, w.queues
+		w.cfgLock.RUnlock()
+		//租约覆盖任务最长执行时间，超过租约还没写入结果的任务由broker重新放回队列
+		lease := time.Second * time.Duration(cfg.TaskRunTime+config.LeaseGraceTime)
+		request, err := w.store.PopRequest(queues, lease)
 		//没有请求
-		if err == redis.Nil {
-			time.Sleep(time.Second)
+		if err == errors.ErrKeyNotExist {
+			bf.Reset()
+			w.sleep(time.Second)
 			continue
 		}
 		if err != nil {
-			golog.Error("Worker", "run", "spop error", 0, "error", err.Error())
+			golog.Error("Worker", "run", "pop request error", 0, "error", err.Error())
+			bf.Sleep()
 			continue
 		}
-		reqKey := fmt.Sprintf("t_%s", uuid)
-
-		//获取请求中所有值
-		request, err := w.redisClient.HMGet(reqKey,
-			"uuid",
-			"bin_name",
-			"args",
-			"start_time",
-			"time_interval",
-			"index",
-		).Result()
+		bf.Reset()
+		//从取出到开始执行或者被延迟放回队列
+		span := w.tracer.Start("kingtask.dequeue", trace.KindConsumer, request.Traceparent)
+		span.SetAttr("uuid", request.Uuid)
+		span.SetAttr("bin_name", request.BinName)
+		span.SetAttr("queue", request.Queue)
+
+		//超过速率限制的任务延迟到有令牌时再放回待执行队列
+		wait, err := w.takeTokens(request)
 		if err != nil {
-			golog.Error("Worker", "run", err.Error(), 0, "req_key", reqKey)
-			continue
+			golog.Error("Worker", "run", "take rate limit token error", 0,
+				w.logFields(request, "err", err.Error())...)
+			wait = time.Second * config.ConcurrencyWaitTime
 		}
-		//key不存在
-		if request[0] == nil {
-			golog.Error("Worker", "run", "Key is not exist", 0, "req_key", reqKey)
+		if wait != 0 {
+			err = w.store.DeferRequest(request.Uuid, wait)
+			if err != nil {
+				golog.Error("Worker", "run", "defer request error", 0,
+					w.logFields(request, "err", err.Error())...)
+			}
+			span.SetAttr("deferred", "rate_limit")
+			span.SetError(err)
+			span.Finish()
 			continue
 		}
-		_, err = w.redisClient.Del(reqKey).Result()
+
+		//释放时使用与获取时相同的名额，不受期间重新加载配置的影响
+		slots := w.concurrencySlots(cfg, request)
+		ok, err := w.acquireSlots(request, slots, lease)
 		if err != nil {
-			golog.Error("Worker", "run", "delete result failed", 0, "req_key", reqKey)
+			golog.Error("Worker", "run", "acquire concurrency slot error", 0,
+				w.logFields(request, "err", err.Error())...)
+		}
+		//没有空闲的并发名额，任务延迟后放回待执行队列继续等待
+		if !ok {
+			err = w.store.DeferRequest(request.Uuid, time.Second*config.ConcurrencyWaitTime)
+			if err != nil {
+				golog.Error("Worker", "run", "defer request error", 0,
+					w.logFields(request, "err", err.Error())...)
+			}
+			span.SetAttr("deferred", "concurrency")
+			span.SetError(err)
+			span.Finish()
+			continue
+		}
+		span.Finish()
+		//执行span和结果中的traceparent以取出span为父span，失败重试时沿用
+		request.Traceparent = span.Traceparent()
+
+		w.setRunning(request.Uuid)
+		golog.Info("Worker", "run", "start task", 0, w.logFields(request)...)
+		startedTasks.Inc(request.BinName)
+		start := time.Now()
+		if wait := start.Unix() - request.StartTime; 0 <= wait {
+			queueWait.Observe(float64(wait), request.BinName)
 		}
 		taskResult, err := w.DoTaskRequest(request)
+		execTime.Observe(time.Since(start).Seconds(), request.BinName)
 		if err != nil {
-			golog.Error("Worker", "run", "DoTaskRequest", 0, "err", err.Error(),
-				"req_key", reqKey)
+			golog.Error("Worker", "run", "DoTaskRequest", 0,
+				w.logFields(request, "err", err.Error())...)
+		}
+		//退出时被终止的任务不写入结果，立即放回待执行队列，不计入重试次数
+		if err == errors.ErrExecInterrupted {
+			err = w.store.DeferRequest(request.Uuid, 0)
+			if err != nil {
+				golog.Error("Worker", "run", "requeue interrupted task error", 0,
+					w.logFields(request, "err", err.Error())...)
+			} else {
+				golog.Info("Worker", "run", "requeue interrupted task", 0, w.logFields(request)...)
+			}
 		}
 
 		if taskResult != nil {
+			if taskResult.IsSuccess == 1 {
+				succeededTasks.Inc(request.BinName)
+			} else {
+				failedTasks.Inc(request.BinName)
+			}
 			err = w.SetTaskResult(taskResult)
 			if err != nil {
 				golog.Error("Worker", "run", "DoTaskRequest", 0,
-					"err", err.Error(), "req_key", reqKey)
+					w.logFields(request, "err", err.Error())...)
 			}
-			golog.Info("worker", "run", "do task success", 0, "req_key", reqKey,
-				"result", taskResult.Result)
+			golog.Info("Worker", "run", "task finished", 0,
+				w.logFields(request,
+					"is_success", taskResult.IsSuccess,
+					"result", taskResult.Result)...)
 		}
+		w.releaseSlots(request, slots)
+		w.setRunning("")
 
-		if w.cfg.Peroid != 0 {
-			time.Sleep(time.Second * time.Duration(w.cfg.Peroid))
+		if cfg.Period != 0 {
+			w.sleep(time.Second * time.Duration(cfg.Period))
 		}
 	}
 	return nil
 }
 
+//Drain或Close之后不再取新任务
+func (w *Worker) stopping() bool {
+	select {
+	case <-w.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+//等待d或者直到开始退出
+func (w *Worker) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-w.quit:
+	}
+}
+
+//停止取新任务并等待正在执行的任务完成，超过timeout时终止任务并放回待执行队列。
+//Run返回后再调用Close关闭存储
+func (w *Worker) Drain(timeout time.Duration) {
+	w.quitOnce.Do(func() { close(w.quit) })
+	select {
+	case <-w.done:
+		return
+	case <-time.After(timeout):
+	}
+	golog.Warn("Worker", "Drain", "wait task timeout, interrupt it", 0,
+		"worker", w.info.Id,
+		"timeout", timeout.String())
+	w.interruptOnce.Do(func() { close(w.interrupt) })
+	<-w.done
+}
+
 func (w *Worker) Close() {
-	w.running = false
-	w.redisClient.Close()
+	w.quitOnce.Do(func() { close(w.quit) })
+	w.interruptOnce.Do(func() { close(w.interrupt) })
+	if w.metricsListener != nil {
+		w.metricsListener.Close()
+	}
+	w.store.Close()
+	w.tracer.Close()
+}
+
+//依次检查可执行文件和队列的速率限制，返回需要等待的最长时间
+func (w *Worker) takeTokens(req *task.TaskRequest) (time.Duration, error) {
+	var wait time.Duration
+	queue := req.Queue
+	if len(queue) == 0 {
+		queue = config.DefaultQueue
+	}
+	w.cfgLock.RLock()
+	binRate, hasBin := w.binRates[req.BinName]
+	queueRate, hasQueue := w.queueRates[queue]
+	w.cfgLock.RUnlock()
+	if hasBin {
+		d, err := w.store.TakeToken("bin:"+req.BinName, binRate.limit, binRate.period)
+		if err != nil {
+			return 0, err
+		}
+		wait = d
+	}
+	if !hasQueue || wait != 0 {
+		return wait, nil
+	}
+	wait, err := w.store.TakeToken("queue:"+queue, queueRate.limit, queueRate.period)
+	//任务被延迟时归还已经取得的可执行文件令牌，避免可执行文件的实际速率低于配置
+	if hasBin && (err != nil || wait != 0) {
+		if e := w.store.ReturnToken("bin:"+req.BinName, binRate.limit, binRate.period); e != nil {
+			golog.Error("Worker", "takeTokens", "return token error", 0,
+				w.logFields(req, "err", e.Error())...)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return wait, nil
+}
+
+type concurrencySlot struct {
+	key   string
+	limit int
+}
+
+//任务需要获取的并发名额：任务指定的并发键和可执行文件的并发限制
+func (w *Worker) concurrencySlots(cfg *config.WorkerConfig, req *task.TaskRequest) []concurrencySlot {
+	var slots []concurrencySlot
+	if len(req.ConcurrencyKey) != 0 {
+		limit := req.ConcurrencyLimit
+		if limit <= 0 {
+			limit = 1
+		}
+		slots = append(slots, concurrencySlot{"key:" + req.ConcurrencyKey, limit})
+	}
+	if limit := cfg.BinConcurrency[req.BinName]; 0 < limit {
+		slots = append(slots, concurrencySlot{"bin:" + req.BinName, limit})
+	}
+	return slots
+}
+
+//获取任务的所有并发名额，有一个获取失败时释放已获取的名额
+func (w *Worker) acquireSlots(req *task.TaskRequest, slots []concurrencySlot,
+	lease time.Duration) (bool, error) {
+	for i, slot := range slots {
+		ok, err := w.store.AcquireSlot(slot.key, req.Uuid, slot.limit, lease)
+		if err != nil || !ok {
+			for _, acquired := range slots[:i] {
+				w.store.ReleaseSlot(acquired.key, req.Uuid)
+			}
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (w *Worker) releaseSlots(req *task.TaskRequest, slots []concurrencySlot) {
+	for _, slot := range slots {
+		err := w.store.ReleaseSlot(slot.key, req.Uuid)
+		if err != nil {
+			golog.Error("Worker", "releaseSlots", err.Error(), 0,
+				w.logFields(req, "slot", slot.key)...)
+		}
+	}
 }
 
-func (w *Worker) DoTaskRequest(args []interface{}) (*task.TaskResult, error) {
+func (w *Worker) DoTaskRequest(req *task.TaskRequest) (*task.TaskResult, error) {
 	var err error
 	var output string
-	req := new(task.TaskRequest)
 	ret := new(task.TaskResult)
 
-	req.Uuid = args[0].(string)
-	req.BinName = args[1].(string)
-	req.Args = args[2].(string)
-	req.StartTime, err = strconv.ParseInt(args[3].(string), 10, 64)
-	if err != nil {
-		return nil, err
-	}
-	req.TimeInterval = args[4].(string)
-	req.Index, err = strconv.Atoi(args[5].(string))
-	if err != nil {
-		return nil, err
-	}
-	binPath := path.Clean(w.cfg.BinPath + "/" + req.BinName)
+	binPath := path.Clean(w.config().BinPath + "/" + req.BinName)
 	_, err = os.Stat(binPath)
 	if err != nil && os.IsNotExist(err) {
-		golog.Error("worker", "DoTaskRequest", "File not exist", 0,
-			"key", fmt.Sprintf("t_%s", req.Uuid),
-			"bin_path", binPath,
-		)
-		return nil, errors.ErrFileNotExist
+		golog.Error("Worker", "DoTaskRequest", "File not exist", 0,
+			w.logFields(req, "bin_path", binPath)...)
+		//记录失败结果，否则任务租约过期后会被反复放回队列
+		ret.TaskRequest = *req
+		ret.IsSuccess = int64(0)
+		ret.Result = errors.ErrFileNotExist.Error()
+		return ret, errors.ErrFileNotExist
 	}
+	span := w.tracer.Start("kingtask.execute", trace.KindInternal, req.Traceparent)
+	span.SetAttr("uuid", req.Uuid)
+	span.SetAttr("bin_name", req.BinName)
+	span.SetAttr("attempt", strconv.Itoa(req.Index))
+	//子进程通过TRACEPARENT环境变量继续这个trace
+	env := []string{trace.EnvTraceparent + "=" + span.Traceparent()}
+	progress := w.newProgressReporter(req)
+	log := w.newTaskLog(req)
+	hooks := &ExecHooks{Progress: progress.Report, Log: log.Add}
 	if len(req.Args) == 0 {
-		output, err = w.ExecBin(binPath, nil)
+		output, err = w.ExecBin(binPath, nil, req.Stdin, env, hooks)
 	} else {
 		argsVec := strings.Split(req.Args, " ")
-		output, err = w.ExecBin(binPath, argsVec)
+		output, err = w.ExecBin(binPath, argsVec, req.Stdin, env, hooks)
+	}
+	progress.Flush()
+	log.Close()
+	span.SetError(err)
+	span.Finish()
+	if err == errors.ErrExecInterrupted {
+		return nil, err
 	}
 
 	ret.TaskRequest = *req
@@ -173,7 +461,9 @@ func (w *Worker) DoTaskRequest(args []interface{}) (*task.TaskResult, error) {
 	return ret, nil
 }
 
-func (w *Worker) ExecBin(binPath string, args []string) (string, error) {
+//任务的输出按行交给hooks处理，标准输出中的进度行不计入结果，env追加到子进程的环境变量中
+func (w *Worker) ExecBin(binPath string, args []string, stdin string, env []string,
+	hooks *ExecHooks) (string, error) {
 	var cmd *exec.Cmd
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
@@ -185,13 +475,51 @@ func (w *Worker) ExecBin(binPath string, args []string) (string, error) {
 		cmd = exec.Command(binPath, args...)
 	}
 
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	cmd.Start() // attention!
+	if len(env) != 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if len(stdin) != 0 {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	outWriter := newProgressWriter(&stdout, task.LogStdout, hooks)
+	errWriter := newProgressWriter(&stderr, task.LogStderr, hooks)
+	//自己读取输出管道，进程被终止后等读完剩余的输出再刷新进度和日志
+	outReader, outPipe, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	errReader, errPipe, err := os.Pipe()
+	if err != nil {
+		outReader.Close()
+		outPipe.Close()
+		return "", err
+	}
+	defer outReader.Close()
+	defer errReader.Close()
+	cmd.Stdout = outPipe
+	cmd.Stderr = errPipe
+	setProcessGroup(cmd)
+	err = cmd.Start()
+	outPipe.Close()
+	errPipe.Close()
+	if err != nil {
+		return "", err
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go copyOutput(&wg, outWriter, outReader)
+	go copyOutput(&wg, errWriter, errReader)
 
-	err, _ = w.CmdRunWithTimeout(cmd,
-		time.Duration(w.cfg.TaskRunTime)*time.Second,
+	err, timeout := w.CmdRunWithTimeout(cmd,
+		time.Duration(w.config().TaskRunTime)*time.Second,
 	)
+	if timeout {
+		waitOutput(&wg, outReader, errReader)
+	} else {
+		wg.Wait()
+	}
+	outWriter.Flush()
+	errWriter.Flush()
 	if err != nil {
 		return "", err
 	}
@@ -203,6 +531,31 @@ func (w *Worker) ExecBin(binPath string, args []string) (string, error) {
 	return strings.TrimRight(stdout.String(), "\n"), nil
 }
 
+func copyOutput(wg *sync.WaitGroup, w io.Writer, r io.Reader) {
+	defer wg.Done()
+	io.Copy(w, r)
+}
+
+//进程组被终止后输出管道随之关闭，仍有脱离进程组的子进程持有管道时，
+//等待outputWaitTime后关闭读端
+func waitOutput(wg *sync.WaitGroup, readers ...*os.File) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(outputWaitTime):
+	}
+	for _, r := range readers {
+		r.Close()
+	}
+	<-done
+}
+
+//终止进程时同时终止其创建的子进程
 func (w *Worker) CmdRunWithTimeout(cmd *exec.Cmd, timeout time.Duration) (error, bool) {
 	done := make(chan error)
 	go func() {
@@ -213,7 +566,7 @@ func (w *Worker) CmdRunWithTimeout(cmd *exec.Cmd, timeout time.Duration) (error,
 	select {
 	case <-time.After(timeout):
 		// timeout
-		if err = cmd.Process.Kill(); err != nil {
+		if err = killProcess(cmd); err != nil {
 			golog.Error("worker", "CmdRunTimeout", "kill error", 0,
 				"path", cmd.Path,
 				"error", err.Error(),
@@ -227,37 +580,43 @@ func (w *Worker) CmdRunWithTimeout(cmd *exec.Cmd, timeout time.Duration) (error,
 			<-done // allow goroutine to exit
 		}()
 		return errors.ErrExecTimeout, true
+	case <-w.interrupt:
+		if err = killProcess(cmd); err != nil {
+			golog.Error("worker", "CmdRunTimeout", "kill error", 0,
+				"path", cmd.Path,
+				"error", err.Error(),
+			)
+		}
+		go func() {
+			<-done
+		}()
+		return errors.ErrExecInterrupted, true
 	case err = <-done:
 		return err, false
 	}
 }
 
-func (w *Worker) SetTaskResult(result *task.TaskResult) error {
-	key := fmt.Sprintf("r_%s", result.Uuid)
-	setCmd := w.redisClient.HMSet(key,
-		"uuid", result.Uuid,
-		"bin_name", result.BinName,
-		"args", result.Args,
-		"start_time", strconv.FormatInt(result.StartTime, 10),
-		"time_interval", result.TimeInterval,
-		"index", strconv.Itoa(result.Index),
-		"is_success", strconv.Itoa(int(result.IsSuccess)),
-		"result", result.Result,
-	)
-	err := setCmd.Err()
-	if err != nil {
-		return err
+func (w *Worker) interrupted() bool {
+	select {
+	case <-w.interrupt:
+		return true
+	default:
+		return false
 	}
-	if result.IsSuccess == int64(0) {
-		saddCmd := w.redisClient.SAdd(config.FailResultUuidSet, result.Uuid)
-		err = saddCmd.Err()
-		if err != nil {
+}
+
+//保存任务结果，存储不可用时退避重试，避免已执行任务的结果丢失。
+//退出时重试到终止任务为止
+func (w *Worker) SetTaskResult(result *task.TaskResult) error {
+	keepTime := time.Second * time.Duration(w.config().ResultKeepTime)
+	bf := backoff.New(time.Millisecond*100, time.Second*5)
+	for {
+		err := w.store.SetResult(result, keepTime)
+		if err == nil || w.interrupted() {
 			return err
 		}
+		golog.Error("Worker", "SetTaskResult", "set result error, retry", 0,
+			w.logFields(&result.TaskRequest, "err", err.Error())...)
+		bf.Sleep()
 	}
-	_, err = w.redisClient.Expire(key, time.Second*time.Duration(w.cfg.ResultKeepTime)).Result()
-	if err != nil {
-		return err
-	}
-	return nil
 }
@@ -0,0 +1,363 @@
+package worker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flike/kingtask/config"
+	"github.com/flike/kingtask/core/errors"
+	"github.com/flike/kingtask/task"
+)
+
+//使用临时目录中的文件存储和可执行文件目录
+func newTestWorker(t *testing.T, cfg *config.WorkerConfig) (*Worker, func()) {
+	dir, err := ioutil.TempDir("", "kingtask_worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.BinPath = path.Join(dir, "bin")
+	if err = os.Mkdir(cfg.BinPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg.StoreConfig = config.StoreConfig{Store: config.StoreFile, DataDir: path.Join(dir, "data")}
+	if cfg.TaskRunTime == 0 {
+		cfg.TaskRunTime = 60
+	}
+	if cfg.ResultKeepTime == 0 {
+		cfg.ResultKeepTime = 3600
+	}
+	w, err := NewWorker(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return w, func() {
+		w.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func writeBin(t *testing.T, w *Worker, name string, script string) {
+	err := ioutil.WriteFile(path.Join(w.config().BinPath, name), []byte("#!/bin/sh\n"+script+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addRequest(t *testing.T, w *Worker, binName string) *task.TaskRequest {
+	r, err := task.NewTaskRequest(binName, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.store.AddRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+//等待任务的状态满足条件
+func waitStatus(t *testing.T, w *Worker, uuid string, cond func(*task.TaskStatus) bool) *task.TaskStatus {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		st, err := w.store.GetStatus(uuid)
+		if err == nil && cond(st) {
+			return st
+		}
+		if deadline.Before(time.Now()) {
+			t.Fatalf("wait status of %s timeout, last %v,%v", uuid, st, err)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func hasState(st *task.TaskStatus, state string) bool {
+	for _, h := range st.History {
+		if h.State == state {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTakeTokens(t *testing.T) {
+	w, cleanup := newTestWorker(t, &config.WorkerConfig{
+		BinRateLimit:   map[string]string{"report": "1/s"},
+		QueueRateLimit: map[string]string{"mail": "2/m"},
+	})
+	defer cleanup()
+
+	report := &task.TaskRequest{Uuid: "1", BinName: "report"}
+	if wait, err := w.takeTokens(report); err != nil || wait != 0 {
+		t.Fatalf("first token:%s,%v", wait, err)
+	}
+	if wait, err := w.takeTokens(report); err != nil || wait <= 0 || time.Second < wait {
+		t.Fatalf("bin rate not limited:%s,%v", wait, err)
+	}
+	//没有配置速率限制的可执行文件和队列不受限制
+	other := &task.TaskRequest{Uuid: "2", BinName: "other"}
+	for i := 0; i < 3; i++ {
+		if wait, err := w.takeTokens(other); err != nil || wait != 0 {
+			t.Fatalf("unlimited request waited:%s,%v", wait, err)
+		}
+	}
+	mail := &task.TaskRequest{Uuid: "3", BinName: "other", Queue: "mail"}
+	for i := 0; i < 2; i++ {
+		if wait, err := w.takeTokens(mail); err != nil || wait != 0 {
+			t.Fatalf("queue token %d:%s,%v", i, wait, err)
+		}
+	}
+	if wait, _ := w.takeTokens(mail); wait <= 0 {
+		t.Fatalf("queue rate not limited")
+	}
+}
+
+//队列的速率限制延迟任务时不消耗可执行文件的令牌
+func TestTakeTokensBothLimits(t *testing.T) {
+	w, cleanup := newTestWorker(t, &config.WorkerConfig{
+		BinRateLimit:   map[string]string{"report": "2/m"},
+		QueueRateLimit: map[string]string{"mail": "1/m"},
+	})
+	defer cleanup()
+
+	mail := &task.TaskRequest{Uuid: "1", BinName: "report", Queue: "mail"}
+	if wait, err := w.takeTokens(mail); err != nil || wait != 0 {
+		t.Fatalf("first token:%s,%v", wait, err)
+	}
+	for i := 0; i < 3; i++ {
+		if wait, err := w.takeTokens(mail); err != nil || wait <= 0 {
+			t.Fatalf("queue rate not limited:%s,%v", wait, err)
+		}
+	}
+	//可执行文件的第二个令牌还在
+	report := &task.TaskRequest{Uuid: "2", BinName: "report"}
+	if wait, err := w.takeTokens(report); err != nil || wait != 0 {
+		t.Fatalf("bin token consumed by deferred task:%s,%v", wait, err)
+	}
+	if wait, _ := w.takeTokens(report); wait <= 0 {
+		t.Fatal("bin rate not limited")
+	}
+}
+
+func TestAcquireSlots(t *testing.T) {
+	w, cleanup := newTestWorker(t, &config.WorkerConfig{
+		BinConcurrency: map[string]int{"ledger": 1},
+	})
+	defer cleanup()
+
+	req := &task.TaskRequest{Uuid: "1", BinName: "ledger", ConcurrencyKey: "account-1"}
+	slots := w.concurrencySlots(w.config(), req)
+	if len(slots) != 2 || slots[0].limit != 1 || slots[1].key != "bin:ledger" {
+		t.Fatalf("concurrency slots:%v", slots)
+	}
+	//可执行文件的名额被占用时释放已获取的并发键名额
+	if ok, _ := w.store.AcquireSlot("bin:ledger", "other", 1, time.Minute); !ok {
+		t.Fatal("acquire bin slot failed")
+	}
+	if ok, err := w.acquireSlots(req, slots, time.Minute); ok || err != nil {
+		t.Fatalf("acquire slots over limit:%v,%v", ok, err)
+	}
+	if ok, _ := w.store.AcquireSlot("key:account-1", "other", 1, time.Minute); !ok {
+		t.Fatal("key slot not released after partial acquire")
+	}
+}
+
+//没有空闲的并发名额时任务延迟后放回队列，不会被判定为失败
+func TestConcurrencyDefer(t *testing.T) {
+	w, cleanup := newTestWorker(t, &config.WorkerConfig{
+		BinConcurrency: map[string]int{"ledger": 1},
+	})
+	defer cleanup()
+	writeBin(t, w, "ledger", "echo ok")
+
+	if ok, _ := w.store.AcquireSlot("bin:ledger", "other", 1, time.Minute); !ok {
+		t.Fatal("acquire bin slot failed")
+	}
+	r := addRequest(t, w, "ledger")
+	go w.Run()
+	st := waitStatus(t, w, r.Uuid, func(st *task.TaskStatus) bool {
+		return hasState(st, task.StateRunning) && st.State == task.StateQueued
+	})
+	w.Drain(time.Second)
+	if _, err := w.store.GetResult(r.Uuid); err != errors.ErrKeyNotExist {
+		t.Fatalf("deferred task has result, err=%v, status %v", err, st)
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var out bytes.Buffer
+	var percents []int
+	var logs []string
+	hooks := &ExecHooks{
+		Progress: func(percent int, msg string) {
+			percents = append(percents, percent)
+		},
+		Log: func(stream string, text string) {
+			logs = append(logs, stream+":"+text)
+		},
+	}
+	pw := newProgressWriter(&out, task.LogStdout, hooks)
+	//进度行可能分多次写入
+	pw.Write([]byte("start\nKINGTASK_PROG"))
+	pw.Write([]byte("RESS 40 copying\r\nKINGTASK_PROGRESS 100\ndone"))
+	pw.Flush()
+	if out.String() != "start\ndone\n" {
+		t.Errorf("output %q", out.String())
+	}
+	if len(percents) != 2 || percents[0] != 40 || percents[1] != 100 {
+		t.Errorf("progress %v", percents)
+	}
+	if len(logs) != 2 || logs[0] != "stdout:start" || logs[1] != "stdout:done" {
+		t.Errorf("logs %v", logs)
+	}
+
+	//标准错误中的进度行按普通输出处理
+	out.Reset()
+	percents = nil
+	pw = newProgressWriter(&out, task.LogStderr, hooks)
+	pw.Write([]byte("KINGTASK_PROGRESS 10\n"))
+	if out.String() != "KINGTASK_PROGRESS 10\n" || len(percents) != 0 {
+		t.Errorf("stderr progress line parsed:%q,%v", out.String(), percents)
+	}
+}
+
+//超过等待时间的任务被终止并放回待执行队列，不写入结果
+func TestDrainInterrupt(t *testing.T) {
+	w, cleanup := newTestWorker(t, &config.WorkerConfig{})
+	defer cleanup()
+	writeBin(t, w, "slow", "sleep 5")
+
+	r := addRequest(t, w, "slow")
+	go w.Run()
+	waitStatus(t, w, r.Uuid, func(st *task.TaskStatus) bool {
+		return st.State == task.StateRunning
+	})
+	start := time.Now()
+	w.Drain(time.Millisecond * 200)
+	if time.Second*3 < time.Since(start) {
+		t.Fatalf("drain waited %s for the interrupted task", time.Since(start))
+	}
+	if _, err := w.store.GetResult(r.Uuid); err != errors.ErrKeyNotExist {
+		t.Fatalf("interrupted task has result, err=%v", err)
+	}
+	st, err := w.store.GetStatus(r.Uuid)
+	if err != nil || st.State != task.StateQueued || st.Attempt != 0 {
+		t.Fatalf("interrupted task status:%v,%v", st, err)
+	}
+}
+
+//等待时间内结束的任务正常写入结果
+func TestDrainWait(t *testing.T) {
+	w, cleanup := newTestWorker(t, &config.WorkerConfig{})
+	defer cleanup()
+	writeBin(t, w, "short", "sleep 0.3; echo ok")
+
+	r := addRequest(t, w, "short")
+	go w.Run()
+	waitStatus(t, w, r.Uuid, func(st *task.TaskStatus) bool {
+		return st.State == task.StateRunning
+	})
+	w.Drain(time.Second * 5)
+	result, err := w.store.GetResult(r.Uuid)
+	if err != nil || result.IsSuccess != 1 || result.Result != "ok" {
+		t.Fatalf("task result after drain:%v,%v", result, err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	w, cleanup := newTestWorker(t, &config.WorkerConfig{
+		Queues:         []string{"default"},
+		BinConcurrency: map[string]int{"ledger": 1},
+	})
+	defer cleanup()
+
+	cfg := *w.config()
+	cfg.Queues = []string{"mail", "default"}
+	cfg.TaskRunTime = 10
+	cfg.BinRateLimit = map[string]string{"report": "5/s"}
+	cfg.MetricsAddr = "127.0.0.1:0"
+	cfg.BinConcurrency = map[string]int{"ledger": 2}
+	restart, err := w.Reload(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restart) != 1 || restart[0] != "metrics_addr" {
+		t.Fatalf("restart fields %v", restart)
+	}
+	if w.config().MetricsAddr != "" || w.config().TaskRunTime != 10 {
+		t.Fatalf("reloaded config %+v", w.config())
+	}
+	if len(w.queues) != 2 || w.queues[0] != "mail" || len(w.info.Queues) != 2 {
+		t.Fatalf("reloaded queues %v, heartbeat %v", w.queues, w.info.Queues)
+	}
+	if r, ok := w.binRates["report"]; !ok || r.limit != 5 || r.period != time.Second {
+		t.Fatalf("reloaded bin rates %v", w.binRates)
+	}
+	//新的并发名额数对下一个任务生效
+	req := &task.TaskRequest{Uuid: "1", BinName: "ledger"}
+	if ok, _ := w.store.AcquireSlot("bin:ledger", "other", 1, time.Minute); !ok {
+		t.Fatal("acquire bin slot failed")
+	}
+	slots := w.concurrencySlots(w.config(), req)
+	if len(slots) != 1 || slots[0].limit != 2 {
+		t.Fatalf("reloaded concurrency slots %v", slots)
+	}
+	if ok, err := w.acquireSlots(req, slots, time.Minute); !ok || err != nil {
+		t.Fatalf("acquire slot after reload:%v,%v", ok, err)
+	}
+
+	//配置有误时整个配置都不生效
+	bad := cfg
+	bad.Queues = []string{"other"}
+	bad.QueueRateLimit = map[string]string{"mail": "fast"}
+	if _, err = w.Reload(&bad); err == nil {
+		t.Fatal("invalid rate limit reloaded")
+	}
+	if w.queues[0] != "mail" {
+		t.Fatalf("queues changed by invalid config: %v", w.queues)
+	}
+}
+
+//任务超时被终止后，已经输出的内容(包括没有换行的最后一行)仍然交给hooks处理
+func TestExecBinTimeoutOutput(t *testing.T) {
+	w, cleanup := newTestWorker(t, &config.WorkerConfig{TaskRunTime: 1})
+	defer cleanup()
+	writeBin(t, w, "slow", "echo KINGTASK_PROGRESS 50 half; printf 'first\\nlast'; sleep 5")
+
+	var lock sync.Mutex
+	var percents []int
+	var logs []string
+	hooks := &ExecHooks{
+		Progress: func(percent int, msg string) {
+			lock.Lock()
+			percents = append(percents, percent)
+			lock.Unlock()
+		},
+		Log: func(stream string, text string) {
+			lock.Lock()
+			logs = append(logs, text)
+			lock.Unlock()
+		},
+	}
+	start := time.Now()
+	_, err := w.ExecBin(path.Join(w.config().BinPath, "slow"), nil, "", nil, hooks)
+	if err != errors.ErrExecTimeout {
+		t.Fatalf("exec error %v", err)
+	}
+	//子进程sleep随进程组一起终止，不会等到它结束
+	if time.Second*3 < time.Since(start) {
+		t.Fatalf("exec returned after %s", time.Since(start))
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(percents) != 1 || percents[0] != 50 {
+		t.Errorf("progress %v", percents)
+	}
+	if len(logs) != 2 || logs[0] != "first" || logs[1] != "last" {
+		t.Errorf("logs %v", logs)
+	}
+}